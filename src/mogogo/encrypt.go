@@ -0,0 +1,142 @@
+package mogogo
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"io"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+	"reflect"
+)
+
+// String and []byte fields tagged `mogogo:"encrypt"` are stored AES-GCM
+// sealed with the DialOptions.EncryptKey, bound to the document's id and
+// the field's key, so a sealed value can't be copied to another document
+// or field. The nonce is random, so such fields can't be keys, sorted,
+// indexed, extracted, matched by selectors or used in a PATCH If op.
+const encryptTag = "encrypt"
+
+var bytesType = reflect.TypeOf([]byte(nil))
+
+func isEncrypted(sf reflect.StructField) bool {
+	return hasTag(sf, encryptTag)
+}
+func newAEAD(key []byte) cipher.AEAD {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		panic(bugf("encrypt key: %v", err))
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(bugf("encrypt key: %v", err))
+	}
+	return aead
+}
+func (r *rest) checkEncrypted(t reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if !isEncrypted(sf) {
+			continue
+		}
+		ft := sf.Type
+		if ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		if ft.Kind() != reflect.String && sf.Type != bytesType {
+			panic(bugf("encrypted field '%s' must be string or []byte, got '%v'", sf.Name, sf.Type))
+		}
+		if !hasBase(t) {
+			panic(bugf("encrypted field '%s' needs a Base to bind to", sf.Name))
+		}
+		if r.aead == nil {
+			panic(bugf("encrypted field '%s' needs an EncryptKey", sf.Name))
+		}
+	}
+}
+
+// sealData is the additional data binding a sealed value to document id
+// and the field's storage key.
+func sealData(id bson.ObjectId, key string) []byte {
+	if id == "" {
+		panic(bugf("encrypted field '%s' sealed without a document id", key))
+	}
+	return append([]byte(id), key...)
+}
+
+// plainBytes is the plaintext of a value of an encrypted field.
+func plainBytes(v reflect.Value) []byte {
+	v = reflect.Indirect(v)
+	if v.Type() == bytesType {
+		return v.Bytes()
+	}
+	return []byte(v.String())
+}
+func (r *rest) sealElem(id bson.ObjectId, key string, plain []byte) []byte {
+	nonce := make([]byte, r.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		panic(&Error{Code: InternalServerError, Msg: "encrypt field", Err: err})
+	}
+	return r.aead.Seal(nonce, nonce, plain, sealData(id, key))
+}
+
+// decryptElem opens a sealed bson elem of field sf of document id back
+// into a string, or []byte for a []byte field.
+func (r *rest) decryptElem(id bson.ObjectId, sf reflect.StructField, elem interface{}) interface{} {
+	sealed, ok := elem.([]byte)
+	n := r.aead.NonceSize()
+	if !ok || len(sealed) < n {
+		panic(&Error{Code: InternalServerError, Msg: "decrypt field " + sf.Name, Err: errors.New("not ciphertext")})
+	}
+	plain, err := r.aead.Open(nil, sealed[:n], sealed[n:], sealData(id, bsonKey(sf)))
+	if err != nil {
+		panic(&Error{Code: InternalServerError, Msg: "decrypt field " + sf.Name, Err: err})
+	}
+	if sf.Type == bytesType {
+		return plain
+	}
+	return string(plain)
+}
+
+// sealOp holds, in an updater, the plaintext of the encrypted fields it
+// sets; updateAll seals them for each document.
+const sealOp = "$seal"
+
+// updateAll is c.UpdateAll, but with encrypted fields to set it updates
+// the documents q selects one by one, each with its own sealed values.
+func (r *rest) updateAll(c *mgo.Collection, q bson.M, updater map[string]interface{}) (info *mgo.ChangeInfo, err error) {
+	seal, ok := updater[sealOp].(map[string]interface{})
+	if !ok {
+		return c.UpdateAll(q, updater)
+	}
+	delete(updater, sealOp)
+	info = new(mgo.ChangeInfo)
+	iter := c.Find(q).Select(bson.M{"_id": 1}).Iter()
+	var doc struct {
+		Id bson.ObjectId `bson:"_id"`
+	}
+	for iter.Next(&doc) {
+		set := make(map[string]interface{})
+		if m, ok := updater["$set"].(map[string]interface{}); ok {
+			for k, v := range m {
+				set[k] = v
+			}
+		}
+		for k, v := range seal {
+			set[k] = r.sealElem(doc.Id, k, v.([]byte))
+		}
+		u := make(map[string]interface{})
+		for k, v := range updater {
+			u[k] = v
+		}
+		u["$set"] = set
+		one, err := c.UpdateAll(bson.M{"$and": []interface{}{q, bson.M{"_id": doc.Id}}}, u)
+		if err != nil {
+			iter.Close()
+			return info, err
+		}
+		info.Updated += one.Updated
+	}
+	return info, iter.Close()
+}
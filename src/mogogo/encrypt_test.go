@@ -0,0 +1,175 @@
+package mogogo
+
+import (
+	"bytes"
+	"fmt"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+	"testing"
+	"time"
+)
+
+type Secret struct {
+	Base
+	Name  string
+	Token string  `mogogo:"encrypt"`
+	Note  *string `mogogo:"encrypt"`
+	Key   []byte  `mogogo:"encrypt"`
+}
+
+func TestEncryptRoundTrip(t *testing.T) {
+	s := DialWithOptions(nil, "rest_test", DialOptions{EncryptKey: []byte("0123456789abcdef")})
+	s.DefType(Secret{})
+	r := s.(*rest)
+	note := "note"
+	id := bson.NewObjectId()
+	v, _ := r.newWithObjectId(r.types["Secret"], id)
+	sec := v.(*Secret)
+	sec.Name, sec.Token, sec.Note, sec.Key = "name", "token", &note, []byte{0, 1, 2}
+	now := time.Now()
+	sec.ct, sec.mt, sec.loaded = now, now, true
+	b := r.structToBson(sec)
+	if b["name"] != "name" {
+		t.Errorf("want plain name stored, got %v", b["name"])
+	}
+	for _, key := range []string{"token", "note", "key"} {
+		sealed, ok := b[key].([]byte)
+		if !ok || bytes.Contains(sealed, []byte(key)) {
+			t.Errorf("want %s stored as ciphertext, got %v", key, b[key])
+		}
+	}
+	var got Secret
+	r.bsonToStruct(b, &got)
+	if got.Token != "token" || got.Note == nil || *got.Note != "note" || !bytes.Equal(got.Key, []byte{0, 1, 2}) {
+		t.Errorf("want plaintext back, got %q %v %v", got.Token, got.Note, got.Key)
+	}
+	if m := r.structToMap(&got, baseURL1); m["key"] != "AAEC" {
+		t.Errorf("want []byte served as base64, got %v", m["key"])
+	}
+	var in Secret
+	if err := r.mapToStruct(map[string]interface{}{"name": "n", "token": "t", "key": "AAEC"}, &in, baseURL1); err != nil || !bytes.Equal(in.Key, []byte{0, 1, 2}) {
+		t.Errorf("want []byte read from base64, got %v %v", in.Key, err)
+	}
+	for _, moved := range []bson.M{
+		{"_id": bson.NewObjectId(), "ct": now, "mt": now, "name": "name", "token": b["token"]},
+		{"_id": id, "ct": now, "mt": now, "name": "name", "token": b["note"]},
+	} {
+		func() {
+			defer func() {
+				if e, ok := recover().(*Error); !ok || e.Code != InternalServerError {
+					t.Errorf("want ciphertext moved to %v rejected, got %v", moved["_id"], e)
+				}
+			}()
+			r.bsonToStruct(moved, &got)
+		}()
+	}
+	b["token"] = append([]byte(nil), b["token"].([]byte)...)
+	b["token"].([]byte)[len(b["token"].([]byte))-1] ^= 1
+	func() {
+		defer func() {
+			if e, ok := recover().(*Error); !ok || e.Code != InternalServerError {
+				t.Errorf("want tampered field rejected, got %v", e)
+			}
+		}()
+		r.bsonToStruct(b, &got)
+	}()
+	s = Dial(nil, "rest_test")
+	func() {
+		defer func() {
+			if _, ok := recover().(*Bug); !ok {
+				t.Error("want DefType without key to panic")
+			}
+		}()
+		s.DefType(Secret{})
+	}()
+}
+
+func TestEncryptedFieldRejected(t *testing.T) {
+	s := DialWithOptions(nil, "rest_test", DialOptions{EncryptKey: []byte("0123456789abcdef")})
+	s.DefType(Secret{})
+	r := s.(*rest)
+	for name, f := range map[string]func(){
+		"DefSort": func() { s.DefSort("Secret", []string{"Token"}) },
+		"Index":   func() { s.Index("Secret", I{Fields: []string{"Token"}}) },
+		"Fields": func() {
+			s.DefRes("test-secret-by-token", FieldResource{Type: "Secret", Fields: []string{"Token"}, Allow: GET})
+		},
+		"SelectorFields": func() {
+			s.DefRes("test-secret-sel", SelectorResource{
+				Type:           "Secret",
+				SelectorFunc:   func(req *Req, ctx *Context) (M, error) { return M{}, nil },
+				SelectorFields: []string{"Token"},
+			})
+		},
+		"Extract": func() { (&selectorIter{r: r, typ: r.types["Secret"]}).Extract("Token", new([]string)) },
+	} {
+		func() {
+			defer func() {
+				if _, ok := recover().(*Bug); !ok {
+					t.Errorf("%s: want encrypted field rejected", name)
+				}
+			}()
+			f()
+		}()
+	}
+	h := &sqHandler{r, &SelectorResource{Type: "Secret"}}
+	if _, err := h.toMgoSelector(M{"Token": "t"}); err == nil {
+		t.Error("want selector on encrypted field rejected")
+	}
+	_, err := r.toMgoUpdater(M{"If": M{"Token": "t"}, "Set": M{"Name": "n"}}, r.types["Secret"], []string{"Name"})
+	if e, ok := err.(*Error); !ok || e.Fields["Token"] != "encrypted" {
+		t.Errorf("want If op on encrypted field rejected, got %v", err)
+	}
+	u, err := r.toMgoUpdater(M{"Set": M{"Token": "t"}}, r.types["Secret"], []string{"Token"})
+	if seal, _ := u[sealOp].(map[string]interface{}); err != nil || seal == nil || string(seal["token"].([]byte)) != "t" {
+		t.Errorf("want encrypted Set left to seal per document, got %v %v", u, err)
+	}
+}
+func ExampleEncryptPatch() {
+	ms, err := mgo.Dial("localhost")
+	if err != nil {
+		panic(err)
+	}
+	defer ms.Close()
+	c := ms.DB("rest_test").C("secret")
+	err = c.DropCollection()
+	if err != nil && err.Error() != "ns not found" {
+		panic(err)
+	}
+	s := DialWithOptions(ms, "rest_test", DialOptions{EncryptKey: []byte("0123456789abcdef")})
+	s.DefType(Secret{})
+	s.DefRes("test-secret-named", FieldResource{
+		Type:        "Secret",
+		Allow:       POST | PATCH,
+		Fields:      []string{"Name"},
+		PatchFields: []string{"Token"},
+	})
+	ctx := s.NewContext()
+	defer ctx.Close()
+	r, err := s.R(NewResId("test-secret-named", "n"), ctx)
+	if err != nil {
+		panic(err)
+	}
+	var selves []*ResId
+	for i := 0; i < 2; i++ {
+		resp, err := r.Post(&Secret{Token: "old"})
+		if err != nil {
+			panic(err)
+		}
+		selves = append(selves, resp.(*Secret).Self())
+	}
+	if _, err = r.Patch(M{"Set": M{"Token": "new"}}); err != nil {
+		panic(err)
+	}
+	for _, resId := range selves {
+		self, err := s.R(resId, ctx)
+		if err != nil {
+			panic(err)
+		}
+		got, err := self.Get()
+		fmt.Println(got.(*Secret).Token, err)
+	}
+	//Output:
+	//new <nil>
+	//new <nil>
+}
@@ -0,0 +1,132 @@
+package mogogo
+
+import (
+	"bytes"
+	bo "encoding/binary"
+	"image"
+	"image/draw"
+	"image/jpeg"
+)
+
+const exifOrientationTag = 0x0112
+
+// exifOrientation returns the EXIF orientation (1-8) of jpeg data b,
+// or 1 if b carries none.
+func exifOrientation(b []byte) int {
+	if len(b) < 4 || b[0] != 0xff || b[1] != 0xd8 {
+		return 1
+	}
+	for i := 2; i+4 <= len(b); {
+		if b[i] != 0xff {
+			return 1
+		}
+		marker := b[i+1]
+		if marker == 0xda || marker == 0xd9 {
+			return 1
+		}
+		n := int(b[i+2])<<8 | int(b[i+3])
+		if n < 2 || i+2+n > len(b) {
+			return 1
+		}
+		seg := b[i+4 : i+2+n]
+		if marker == 0xe1 && bytes.HasPrefix(seg, []byte("Exif\x00\x00")) {
+			return tiffOrientation(seg[6:])
+		}
+		i += 2 + n
+	}
+	return 1
+}
+func tiffOrientation(t []byte) int {
+	if len(t) < 8 {
+		return 1
+	}
+	var order bo.ByteOrder
+	switch string(t[0:2]) {
+	case "II":
+		order = bo.LittleEndian
+	case "MM":
+		order = bo.BigEndian
+	default:
+		return 1
+	}
+	ifd := int(order.Uint32(t[4:8]))
+	if ifd < 8 || ifd+2 > len(t) {
+		return 1
+	}
+	count := int(order.Uint16(t[ifd : ifd+2]))
+	for i := 0; i < count; i++ {
+		e := ifd + 2 + i*12
+		if e+12 > len(t) {
+			return 1
+		}
+		if order.Uint16(t[e:e+2]) == exifOrientationTag {
+			o := int(order.Uint16(t[e+8 : e+10]))
+			if o < 1 || o > 8 {
+				return 1
+			}
+			return o
+		}
+	}
+	return 1
+}
+
+// orient returns a copy of m transformed so that EXIF orientation o
+// displays upright.
+func orient(m image.Image, o int) image.Image {
+	b := m.Bounds()
+	w, h := b.Dx(), b.Dy()
+	var dst *image.RGBA
+	if o >= 5 {
+		dst = image.NewRGBA(image.Rect(0, 0, h, w))
+	} else {
+		dst = image.NewRGBA(image.Rect(0, 0, w, h))
+	}
+	src := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(src, src.Bounds(), m, b.Min, draw.Src)
+	db := dst.Bounds()
+	for y := 0; y < db.Dy(); y++ {
+		for x := 0; x < db.Dx(); x++ {
+			var sx, sy int
+			switch o {
+			case 2:
+				sx, sy = w-1-x, y
+			case 3:
+				sx, sy = w-1-x, h-1-y
+			case 4:
+				sx, sy = x, h-1-y
+			case 5:
+				sx, sy = y, x
+			case 6:
+				sx, sy = y, h-1-x
+			case 7:
+				sx, sy = w-1-y, h-1-x
+			case 8:
+				sx, sy = w-1-y, x
+			default:
+				sx, sy = x, y
+			}
+			dst.SetRGBA(x, y, src.RGBAAt(sx, sy))
+		}
+	}
+	return dst
+}
+
+// autoOrient applies the EXIF orientation of jpeg data b to its pixels.
+// The re-encoded image carries no EXIF; b is returned as is when it
+// needs no transform.
+func autoOrient(b []byte) ([]byte, error) {
+	o := exifOrientation(b)
+	if o == 1 {
+		return b, nil
+	}
+	m, err := jpeg.Decode(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	err = imageEncoder["jpeg"](&buf, orient(m, o))
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,65 @@
+package mogogo
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"testing"
+)
+
+func jpegWithOrientation(t *testing.T, o byte) []byte {
+	m := image.NewRGBA(image.Rect(0, 0, 16, 8))
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 16; x++ {
+			if x < 8 {
+				m.Set(x, y, color.RGBA{255, 0, 0, 255})
+			} else {
+				m.Set(x, y, color.RGBA{0, 0, 255, 255})
+			}
+		}
+	}
+	var buf bytes.Buffer
+	err := jpeg.Encode(&buf, m, &jpeg.Options{Quality: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tiff := []byte{
+		'M', 'M', 0, 42, 0, 0, 0, 8,
+		0, 1,
+		0x01, 0x12, 0, 3, 0, 0, 0, 1, 0, o, 0, 0,
+		0, 0, 0, 0,
+	}
+	seg := append([]byte("Exif\x00\x00"), tiff...)
+	app1 := append([]byte{0xff, 0xe1, byte((len(seg) + 2) >> 8), byte(len(seg) + 2)}, seg...)
+	b := buf.Bytes()
+	return append(append([]byte{0xff, 0xd8}, app1...), b[2:]...)
+}
+func TestAutoOrient(t *testing.T) {
+	b := jpegWithOrientation(t, 6)
+	if o := exifOrientation(b); o != 6 {
+		t.Fatalf("want orientation 6, got %d", o)
+	}
+	b, err := autoOrient(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o := exifOrientation(b); o != 1 {
+		t.Errorf("want EXIF dropped, got orientation %d", o)
+	}
+	m, err := jpeg.Decode(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := m.Bounds().Size(); size != image.Pt(8, 16) {
+		t.Fatalf("want size (8,16), got %v", size)
+	}
+	r, _, bl, _ := m.At(4, 3).RGBA()
+	if r < bl {
+		t.Errorf("want red on top, got %v", m.At(4, 3))
+	}
+	r, _, bl, _ = m.At(4, 12).RGBA()
+	if r > bl {
+		t.Errorf("want blue at bottom, got %v", m.At(4, 12))
+	}
+}
@@ -0,0 +1,78 @@
+package mogogo
+
+import (
+	"encoding/json"
+	"io"
+	"net/url"
+	"reflect"
+	"time"
+)
+
+// Export writes every document of typ to w as newline delimited json,
+// in the shape a GET of it has. References come out per the RefShape and
+// are read back by their ids, so Import takes Export's output unchanged.
+// Times are time.RFC3339Nano whatever SetTimeFormat says, to keep their
+// precision. Encrypted fields are written in plaintext, so the output
+// needs the care the EncryptKey does.
+func (r *rest) Export(ctx *Context, typ string, w io.Writer) (n int, err error) {
+	r.checkType(typ)
+	r.checkHasBase(typ)
+	t := r.types[typ]
+	enc := json.NewEncoder(w)
+	iter := ctx.coll(typ).Find(nil).Sort("_id").Iter()
+	b := make(map[string]interface{})
+	for iter.Next(b) {
+		s := reflect.New(t).Interface()
+		r.bsonToStruct(b, s)
+		getBase(reflect.ValueOf(s).Elem()).loaded = true
+		if err = enc.Encode(r.structToMapLayout(s, &url.URL{}, time.RFC3339Nano)); err != nil {
+			iter.Close()
+			return n, err
+		}
+		n++
+		b = make(map[string]interface{})
+	}
+	if err = iter.Close(); err != nil {
+		return n, mgoError(err)
+	}
+	return n, nil
+}
+
+// Import inserts the documents Export wrote, keeping their id, ct and mt.
+// A document whose id is taken stops the import with Conflict; n counts
+// those inserted before.
+func (r *rest) Import(ctx *Context, typ string, rd io.Reader) (n int, err error) {
+	r.checkType(typ)
+	r.checkHasBase(typ)
+	t := r.types[typ]
+	dec := json.NewDecoder(rd)
+	dec.UseNumber()
+	c := ctx.coll(typ)
+	for {
+		var m map[string]interface{}
+		if err = dec.Decode(&m); err == io.EOF {
+			return n, nil
+		} else if err != nil {
+			return n, &Error{Code: BadRequest, Msg: "parse json error", Err: err}
+		}
+		s := reflect.New(t).Interface()
+		if err = r.mapToStruct(m, s, &url.URL{}); err != nil {
+			return n, err
+		}
+		base := getBase(reflect.ValueOf(s).Elem())
+		if base.id == "" {
+			return n, &Error{Code: BadRequest, Msg: "field 'id' not set"}
+		}
+		if base.ct.IsZero() {
+			return n, &Error{Code: BadRequest, Msg: "field 'ct' not set"}
+		}
+		if base.mt.IsZero() {
+			return n, &Error{Code: BadRequest, Msg: "field 'mt' not set"}
+		}
+		base.loaded = true
+		if err = c.Insert(r.structToBson(s)); err != nil {
+			return n, mgoError(err)
+		}
+		n++
+	}
+}
@@ -0,0 +1,42 @@
+package mogogo
+
+import (
+	"net/url"
+	"sort"
+)
+
+// index is the response of the root resource "/", which Dial registers.
+// It lists the resources by name, sys ones only for sys contexts.
+type index struct {
+	r     *rest
+	names []string
+}
+
+type indexHandler struct {
+	r *rest
+}
+
+func (r *rest) defIndex() {
+	r.DefType(index{})
+	r.queries[""] = &CustomResource{"index", "index", nil, &indexHandler{r}}
+}
+func (h *indexHandler) Get(req *Req, ctx *Context) (result interface{}, err error) {
+	names := make([]string, 0, len(h.r.queries))
+	for name := range h.r.queries {
+		if name != "" && (!isSysQueryName(name) || ctx.IsSys()) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return &index{h.r, names}, nil
+}
+func (idx *index) toMap(base *url.URL) map[string]interface{} {
+	resources := make([]interface{}, len(idx.names))
+	for i, name := range idx.names {
+		resources[i] = map[string]interface{}{
+			"name": name,
+			"href": (&ResId{r: idx.r, path: []string{name}}).URLWithBase(base).String(),
+		}
+	}
+	return map[string]interface{}{"resources": resources}
+}
@@ -0,0 +1,66 @@
+package mogogo
+
+// IterFunc transforms an item of an Iter; items with keep false are
+// dropped.
+type IterFunc func(item interface{}) (result interface{}, keep bool)
+
+// WrapIter decorates iter so Next, Peek and Slice items go through f.
+// The result is an Iter again, so After hooks can wrap a GET response
+// and wrappers compose. Count and paging links still come from iter.
+func WrapIter(iter Iter, f IterFunc) Iter {
+	return &wrapIter{Iter: iter, f: f}
+}
+
+type wrapIter struct {
+	Iter
+	f      IterFunc
+	peeked interface{}
+}
+
+func (wi *wrapIter) Next() (result interface{}, ok bool) {
+	if wi.peeked != nil {
+		result, wi.peeked = wi.peeked, nil
+		return result, true
+	}
+	for {
+		item, ok := wi.Iter.Next()
+		if !ok {
+			return nil, false
+		}
+		if result, keep := wi.f(item); keep {
+			return result, true
+		}
+	}
+}
+func (wi *wrapIter) Peek() (result interface{}, ok bool) {
+	if wi.peeked == nil {
+		wi.peeked, _ = wi.Next()
+	}
+	return wi.peeked, wi.peeked != nil
+}
+func (wi *wrapIter) Reset() {
+	wi.Iter.Reset()
+	wi.peeked = nil
+}
+func (wi *wrapIter) Slice() (slice Slice, err error) {
+	slice, err = wi.Iter.Slice()
+	if err != nil || !slice.HasItems() {
+		return slice, err
+	}
+	items := make([]interface{}, 0, len(slice.Items()))
+	for _, item := range slice.Items() {
+		if result, keep := wi.f(item); keep {
+			items = append(items, result)
+		}
+	}
+	return &wrapSlice{slice, items}, nil
+}
+
+type wrapSlice struct {
+	Slice
+	items []interface{}
+}
+
+func (ws *wrapSlice) Items() []interface{} {
+	return ws.items
+}
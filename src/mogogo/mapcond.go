@@ -30,12 +30,12 @@ func newMapCond() *mapCond {
 func (mc *mapCond) getKeySet(m map[string]interface{}) keyset {
 	var ret keyset
 	if len(m) > 8 {
-		panic("map len cannot great than 8")
+		panic(&Bug{Msg: "map len cannot great than 8"})
 	}
 	var s []string = make([]string, 0, len(m))
 	for k, _ := range m {
 		if k == "" {
-			panic("map key cannot empty")
+			panic(&Bug{Msg: "map key cannot empty"})
 		}
 		s = append(s, k)
 	}
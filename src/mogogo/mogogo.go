@@ -3,13 +3,20 @@ package mogogo
 import (
 	"bufio"
 	"bytes"
+	"crypto/cipher"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"image"
+	"image/gif"
 	"image/jpeg"
 	"image/png"
 	"io"
+	"io/ioutil"
 	"labix.org/v2/mgo"
 	"labix.org/v2/mgo/bson"
+	"log"
 	"math"
 	"mime"
 	"net/url"
@@ -17,6 +24,8 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 	"unicode"
 )
@@ -27,17 +36,25 @@ type A []interface{}
 type ErrorCode uint
 
 const (
-	BadRequest           = 400
-	Forbidden            = 403
-	Unauthorized         = 401
-	NotFound             = 404
-	MethodNotAllowed     = 405
-	Conflict             = 409
-	UnsupportedMediaType = 415
-	Teapot               = 418
-	InternalServerError  = 500
+	BadRequest            = 400
+	Forbidden             = 403
+	Unauthorized          = 401
+	NotFound              = 404
+	MethodNotAllowed      = 405
+	Conflict              = 409
+	PreconditionFailed    = 412
+	RequestEntityTooLarge = 413
+	UnsupportedMediaType  = 415
+	Teapot                = 418
+	TooManyRequests       = 429
+	InternalServerError   = 500
+	ServiceUnavailable    = 503
 )
 
+// MultiStatus is the status of a bulk response whose items didn't all
+// succeed; each item then carries its own.
+const MultiStatus = 207
+
 func (es ErrorCode) String() string {
 	var ret string
 	switch es {
@@ -53,23 +70,36 @@ func (es ErrorCode) String() string {
 		ret = "method not allowed"
 	case Conflict:
 		ret = "conflict"
+	case PreconditionFailed:
+		ret = "precondition failed"
+	case RequestEntityTooLarge:
+		ret = "request entity too large"
 	case UnsupportedMediaType:
 		ret = "unsupported media type"
 	case Teapot:
 		ret = "I'm a teapot"
+	case TooManyRequests:
+		ret = "too many requests"
 	case InternalServerError:
 		ret = "internal server error"
+	case ServiceUnavailable:
+		ret = "service unavailable"
+	case MultiStatus:
+		ret = "multi status"
 	default:
-		panic(fmt.Sprintf("invalid errorCode: %d", es))
+		panic(bugf("invalid errorCode: %d", es))
 	}
 	return ret
 }
 
+// RetryAfter, when set, tells clients how long to back off, as for
+// TooManyRequests or ServiceUnavailable.
 type Error struct {
-	Code   ErrorCode
-	Msg    string
-	Err    error
-	Fields map[string]string
+	Code       ErrorCode
+	Msg        string
+	Err        error
+	Fields     map[string]string
+	RetryAfter time.Duration
 }
 
 func (re *Error) Error() string {
@@ -85,6 +115,17 @@ func (re *Error) Error() string {
 	return ret
 }
 
+type Bug struct {
+	Msg string
+}
+
+func (b *Bug) Error() string {
+	return b.Msg
+}
+func bugf(format string, a ...interface{}) *Bug {
+	return &Bug{Msg: fmt.Sprintf(format, a...)}
+}
+
 type Params map[string]string
 
 func (p Params) Del(name string) {
@@ -130,6 +171,18 @@ func (p Params) SetString(name string, val string) {
 func (p Params) SetFloat(name string, val float64) {
 	p[name] = strconv.FormatFloat(val, 'f', -1, 64)
 }
+func (p Params) Encode() string {
+	keys := make([]string, 0, len(p))
+	for k := range p {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, 0, len(p))
+	for _, k := range keys {
+		pairs = append(pairs, url.QueryEscape(k)+"="+url.QueryEscape(p[k]))
+	}
+	return strings.Join(pairs, "&")
+}
 
 type ResId struct {
 	r      *rest
@@ -157,30 +210,61 @@ func (resId *ResId) NumSegment() int {
 	return len(resId.path) - 1
 }
 func (resId *ResId) Segment(index int) (val interface{}, err error) {
-	cq := resId.r.queries[resId.path[0]]
+	if resId.r == nil {
+		return nil, &Error{Code: InternalServerError, Msg: fmt.Sprintf("'%s' not resolved by a session", resId.String())}
+	}
+	cq, ok := resId.r.queries[resId.path[0]]
+	if !ok {
+		return nil, &Error{Code: NotFound, Msg: fmt.Sprintf("no resource named '%s'", resId.String())}
+	}
 	if resId.NumSegment() < len(cq.PathSegmentTypes) {
 		msg := fmt.Sprintf("path need %d segments, got %d", len(cq.PathSegmentTypes)+1, resId.NumSegment()+1)
 		return nil, &Error{Code: BadRequest, Msg: msg}
 	}
 	if index < 0 || index >= len(cq.PathSegmentTypes) {
-		panic(fmt.Sprintf("index out of bound: %d", index))
+		panic(bugf("index out of bound: %d", index))
 	}
 	typ := cq.PathSegmentTypes[index]
 	elem := resId.path[index+1]
+	if strings.HasPrefix(typ, "[]") {
+		elems := strings.Split(elem, ",")
+		vals := make([]interface{}, len(elems))
+		for i, e := range elems {
+			if vals[i], err = resId.parseSegment(typ[2:], e); err != nil {
+				break
+			}
+		}
+		val = vals
+	} else {
+		val, err = resId.parseSegment(typ, elem)
+	}
+	if err != nil {
+		msg := fmt.Sprintf("parse error at segment %d", index+1)
+		err = &Error{Code: BadRequest, Msg: msg, Err: err}
+	}
+	return
+}
+func (resId *ResId) parseSegment(typ string, elem string) (val interface{}, err error) {
 	switch typ {
 	case "int":
 		val, err = strconv.Atoi(elem)
 	case "string":
 		val, err = elem, nil
+	case "slug":
+		if isSlug(elem) {
+			val, err = elem, nil
+		} else {
+			err = fmt.Errorf("'%s' not a slug", elem)
+		}
 	case "bool":
 		val, err = strconv.ParseBool(elem)
+	case "float":
+		val, err = strconv.ParseFloat(elem, 64)
+	case "time":
+		val, err = time.Parse(time.RFC3339, elem)
 	default:
 		val, err = resId.r.newWithId(typ, elem)
 	}
-	if err != nil {
-		msg := fmt.Sprintf("parse error at segment %d", index+1)
-		err = &Error{Code: BadRequest, Msg: msg, Err: err}
-	}
 	return
 }
 func (resId *ResId) URLWithBase(base *url.URL) *url.URL {
@@ -192,17 +276,12 @@ func (resId *ResId) URLWithBase(base *url.URL) *url.URL {
 func (resId *ResId) URL() *url.URL {
 	var u url.URL
 	u.Path = "/" + strings.Join(resId.path, "/")
-	keys := make([]string, 0, len(resId.Params))
-	for k, _ := range resId.Params {
-		keys = append(keys, k)
+	segs := make([]string, len(resId.path))
+	for i, seg := range resId.path {
+		segs[i] = url.PathEscape(seg)
 	}
-	sort.Strings(keys)
-	pairs := make([]string, 0, len(resId.Params))
-	for _, k := range keys {
-		v := resId.Params[k]
-		pairs = append(pairs, url.QueryEscape(k)+"="+url.QueryEscape(v))
-	}
-	u.RawQuery = strings.Join(pairs, "&")
+	u.RawPath = "/" + strings.Join(segs, "/")
+	u.RawQuery = resId.Params.Encode()
 	return &u
 }
 func (resId *ResId) String() string {
@@ -215,13 +294,19 @@ func ResIdParse(s string) (resId *ResId, err error) {
 	}
 	return ResIdFromURL(url)
 }
+
 func ResIdFromURL(URL *url.URL) (resId *ResId, err error) {
-	if URL.Path[0] != '/' {
+	if URL.Path == "" || URL.Path[0] != '/' {
 		return nil, &Error{Code: BadRequest, Msg: fmt.Sprintf("must absolute url. %v", URL)}
 	}
-	err = nil
+	p := URL.EscapedPath()
 	resId = new(ResId)
-	resId.path = strings.Split(URL.Path[1:], "/")
+	resId.path = strings.Split(p[1:], "/")
+	for i, seg := range resId.path {
+		if resId.path[i], err = url.PathUnescape(seg); err != nil {
+			return nil, &Error{Code: BadRequest, Msg: "parse url error", Err: err}
+		}
+	}
 	resId.Params = make(map[string]string)
 	for k, v := range URL.Query() {
 		resId.Params[k] = v[0]
@@ -240,12 +325,22 @@ func NewResId(name string, segments ...interface{}) *ResId {
 			ret.path[i+1] = strconv.FormatBool(sv)
 		case int:
 			ret.path[i+1] = strconv.Itoa(sv)
+		case float64:
+			ret.path[i+1] = strconv.FormatFloat(sv, 'f', -1, 64)
+		case time.Time:
+			ret.path[i+1] = sv.UTC().Format(time.RFC3339)
 		case *string:
 			ret.path[i+1] = *sv
 		case *bool:
 			ret.path[i+1] = strconv.FormatBool(*sv)
 		case *int:
 			ret.path[i+1] = strconv.Itoa(*sv)
+		case *float64:
+			ret.path[i+1] = strconv.FormatFloat(*sv, 'f', -1, 64)
+		case *time.Time:
+			ret.path[i+1] = sv.UTC().Format(time.RFC3339)
+		case []interface{}:
+			ret.path[i+1] = strings.Join(NewResId(name, sv...).path[1:], ",")
 		default:
 			st := reflect.TypeOf(seg)
 			var base *Base
@@ -254,9 +349,9 @@ func NewResId(name string, segments ...interface{}) *ResId {
 			} else if st.Kind() == reflect.Struct {
 				base = getBase(reflect.ValueOf(seg))
 			} else {
-				panic(fmt.Sprintf("type '%v' not support for segment %d", st, i+1))
+				panic(bugf("type '%v' not support for segment %d", st, i+1))
 			}
-			ret.path[i+1] = base.id.Hex()
+			ret.path[i+1] = base.r.idString(base.id)
 		}
 	}
 	ret.Params = make(map[string]string)
@@ -289,7 +384,7 @@ func hasBase(t reflect.Type) bool {
 
 func checkHasBase(t reflect.Type) {
 	if !hasBase(t) {
-		panic(fmt.Sprintf("%s must embed %s", t.Name(), baseType.Name()))
+		panic(bugf("%s must embed %s", t.Name(), baseType.Name()))
 	}
 }
 
@@ -301,36 +396,38 @@ func getBaseValue(v reflect.Value) Base {
 }
 
 func (b *Base) Self() *ResId {
-	return &ResId{b.r, []string{typeNameToQueryName(b.t), b.id.Hex()}, nil}
+	return &ResId{b.r, []string{typeNameToQueryName(b.t), b.r.idString(b.id)}, nil}
 }
 
-func (b *Base) Load(ctx *Context) (ok bool) {
+func (b *Base) Load(ctx *Context) (ok bool, err error) {
 	if b.loaded {
-		return true
+		return true, nil
 	}
 	sel := bson.M{"_id": b.id}
 	bs := make(bson.M)
-	err := ctx.coll(b.t).Find(sel).One(bs)
-	if err == nil {
-		b.r.bsonToStruct(bs, b.self)
-		b.loaded = true
-		ok = true
-	} else if err == mgo.ErrNotFound {
-		ok = false
-	} else {
-		panic(&Error{Code: InternalServerError, Err: err})
+	err = ctx.coll(b.t).Find(sel).One(bs)
+	if err == mgo.ErrNotFound {
+		return false, nil
 	}
-	return
+	if err != nil {
+		return false, mgoError(err)
+	}
+	b.r.bsonToStruct(bs, b.self)
+	b.loaded = true
+	return true, nil
 }
 func (b *Base) Rel(name string) *ResId {
 	msg := fmt.Sprintf("resource '%s' not found in %s", name, b.t)
 	binds, ok := b.r.binds[b.t]
 	if !ok {
-		panic(msg)
+		panic(&Bug{Msg: msg})
 	}
 	bin, ok := binds[name]
 	if !ok {
-		panic(msg)
+		panic(&Bug{Msg: msg})
+	}
+	if bin.fn != nil {
+		return bin.fn(b.self)
 	}
 	segs := make([]interface{}, len(bin.segmentRef))
 	self := reflect.ValueOf(b.self).Elem()
@@ -338,14 +435,24 @@ func (b *Base) Rel(name string) *ResId {
 		if f, ok := v.(F); ok {
 			if f == "Id" {
 				segs[i] = b.self
+			} else if f == "CT" {
+				segs[i] = b.ct
+			} else if f == "MT" {
+				segs[i] = b.mt
 			} else {
 				segs[i] = self.FieldByName(string(f)).Interface()
 			}
+		} else if fn, ok := v.(Fn); ok {
+			segs[i] = fn.Func(b.self)
 		} else {
 			segs[i] = v
 		}
 	}
-	return NewResId(bin.res, segs...)
+	ret := NewResId(bin.res, segs...)
+	for k, v := range bin.params {
+		ret.Params[k] = v
+	}
+	return ret
 }
 func (b *Base) R(name string, ctx *Context) Resource {
 	r, err := b.r.R(b.Rel(name), ctx)
@@ -365,6 +472,15 @@ func (b *Base) AllRels() map[string]*ResId {
 	}
 	return ret
 }
+func (b *Base) ReverseRels() map[string]*ResId {
+	ret := make(map[string]*ResId)
+	for _, rb := range b.r.rbinds[b.t] {
+		if res, ok := b.r.collectionRes(rb.typ, rb.field); ok {
+			ret[res] = NewResId(res, b.self)
+		}
+	}
+	return ret
+}
 func (b *Base) IsNew() bool {
 	return b.isNew
 }
@@ -424,11 +540,22 @@ func (m Method) String() string {
 	case PATCH:
 		ret = "PATCH"
 	default:
-		panic(fmt.Sprintf("invalid method: %#x(%b)", m, m))
+		panic(bugf("invalid method: %#x(%b)", uint(m), uint(m)))
 	}
 	return ret
 }
 
+// With Sync, a FieldResource allowing PUT takes a json array of bodies,
+// upserted by id, instead of a single one; it need not be Unique.
+// With Replace, a PUT on a non-Unique FieldResource inserts its body and
+// then removes every other document the path matches. Mongo has no
+// transaction for this: readers may briefly see both, never neither.
+// With AllowClientId, POST keeps an id given in the body instead of
+// generating one, and answers Conflict if it is taken.
+// A PATCH with ?dryrun=true, here or on a SelectorResource, checks the
+// updater against PatchFields but doesn't apply it.
+// With Multi, the segment of the last of Fields is a comma joined list,
+// e.g. /items/a,b,c, and GET lists the documents matching any of it.
 type FieldResource struct {
 	Type             string
 	Allow            Method
@@ -441,15 +568,28 @@ type FieldResource struct {
 	Pull             bool
 	PatchFields      []string
 	UpdateWhenDelete M
+	ExpireAfter      time.Duration
+	ExpireField      string
+	ReadOnly         bool
+	Sync             bool
+	Replace          bool
+	AllowClientId    bool
+	Multi            bool
 }
 
 type SelectorResource struct {
 	Type             string
+	Allow            Method
 	SelectorFunc     func(req *Req, ctx *Context) (selector M, err error)
+	SelectorFields   []string
 	SortFields       []string
 	PathSegmentTypes []string
 	Count            bool
 	Limit            int
+	PatchFields      []string
+	UpdateWhenDelete M
+	ReadOnly         bool
+	AllowClientId    bool
 }
 type BoundType int
 
@@ -463,19 +603,76 @@ type Bound struct {
 	Type  BoundType
 	Value int
 }
+
+// Bucket names the GridFS bucket an ImageResource or FileResource stores
+// its files in, "fs" by default. Uploads to either are stored once: one
+// byte-identical to an older file of the bucket, with the same media type,
+// gets that file's id.
 type ImageResource struct {
-	Bounds map[string]*Bound
+	Bounds    map[string]*Bound
+	MaxPixels int
+	Bucket    string
+}
+type FileResource struct {
+	MediaTypes []string
+	MaxSize    int64
+	Bucket     string
 }
 
 type Verifiable interface {
 	Verify() (ok bool, msg string)
 }
+
+// Virtual adds computed fields to a type's responses; they are never
+// stored. DefType asks a zero value for the keys, so they must not depend
+// on the value, and panics if one is a field's.
+type Virtual interface {
+	Virtual() M
+}
+type AfterInsertable interface {
+	AfterInsert(ctx *Context) error
+}
 type Getable interface {
 	Get(req *Req, ctx *Context) (result interface{}, err error)
 }
 type Putable interface {
 	Put(req *Req, ctx *Context) (result interface{}, err error)
 }
+
+// PutManyable upserts the request bodies in req.Body, a []interface{},
+// by id.
+type PutManyable interface {
+	PutMany(req *Req, ctx *Context) (result *SyncResult, err error)
+}
+
+// SyncResult counts what a PutMany did. Items holds the outcome of each
+// body in order; Conflicts lists the positions of those refused for a
+// duplicate key. Refused bodies don't stop the rest being written.
+type SyncResult struct {
+	Inserted  int
+	Modified  int
+	Conflicts []int
+	Items     []ItemStatus
+}
+
+// ItemStatus is the outcome of one body of a bulk request: Status is 201
+// when inserted, 200 when modified, 204 when a Before hook kept it
+// unwritten, else the Code of Err.
+type ItemStatus struct {
+	Status int
+	Err    *Error
+}
+
+// Failed reports whether any body of a PutMany was refused.
+func (sr *SyncResult) Failed() bool {
+	for _, item := range sr.Items {
+		if item.Err != nil {
+			return true
+		}
+	}
+	return false
+}
+
 type Deletable interface {
 	Delete(req *Req, ctx *Context) (result interface{}, err error)
 }
@@ -493,12 +690,23 @@ type CustomResource struct {
 	Handler          interface{}
 }
 
+const principalKey = "principal"
+
+// A Context holds the one mgo session of a request, copied (or cloned)
+// by NewContext. Resources got with R, their hooks and handlers, and any
+// R they call in turn with the same Context, including net's prefetch,
+// all use that session; nothing below NewContext copies another. Only a
+// pull timeline waiting for items closes and reopens it meanwhile.
 type Context struct {
-	r       *rest
-	s       *mgo.Session
-	sys     bool
-	values  map[string]interface{}
-	updated bool
+	r         *rest
+	s         *mgo.Session
+	sys       bool
+	values    map[string]interface{}
+	updated   bool
+	reqId     string
+	signed    bool
+	principal interface{}
+	db        string
 }
 
 func (ctx *Context) IsUpdated() bool {
@@ -516,6 +724,28 @@ func (ctx *Context) IsSys() bool {
 func (ctx *Context) SetSys(b bool) {
 	ctx.sys = b
 }
+func (ctx *Context) RequestId() string {
+	return ctx.reqId
+}
+func (ctx *Context) SetRequestId(id string) {
+	ctx.reqId = id
+}
+func (ctx *Context) Principal() interface{} {
+	return ctx.principal
+}
+func (ctx *Context) SetPrincipal(p interface{}) {
+	ctx.updated = true
+	ctx.principal = p
+}
+func (ctx *Context) IsAuthenticated() bool {
+	return ctx.principal != nil
+}
+func (ctx *Context) IsSigned() bool {
+	return ctx.signed
+}
+func (ctx *Context) SetSigned(b bool) {
+	ctx.signed = b
+}
 func (ctx *Context) Get(key string) (val interface{}, ok bool) {
 	val, ok = ctx.values[key]
 	return
@@ -524,30 +754,105 @@ func (ctx *Context) Set(key string, val interface{}) {
 	ctx.updated = true
 	ctx.values[key] = val
 }
+func (ctx *Context) ref(key string) (reflect.Value, error) {
+	path := strings.Split(key, ".")
+	c, ok := ctx.Get(path[0])
+	if !ok && path[0] == principalKey && ctx.IsAuthenticated() {
+		c, ok = ctx.principal, true
+	}
+	if !ok {
+		msg := fmt.Sprintf("'%s' not in Context", path[0])
+		return reflect.Value{}, &Error{Code: Unauthorized, Msg: msg}
+	}
+	v := reflect.ValueOf(c)
+	for i, f := range path[1:] {
+		for v.IsValid() && (v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface) {
+			if v.IsNil() {
+				v = reflect.Value{}
+			} else {
+				v = v.Elem()
+			}
+		}
+		if !v.IsValid() {
+			msg := fmt.Sprintf("'%s' is nil in Context", strings.Join(path[:i+1], "."))
+			return reflect.Value{}, &Error{Code: Unauthorized, Msg: msg}
+		}
+		if v.Kind() != reflect.Struct {
+			msg := fmt.Sprintf("'%s' not a struct in Context", strings.Join(path[:i+1], "."))
+			return reflect.Value{}, &Error{Code: BadRequest, Msg: msg}
+		}
+		v = v.FieldByName(f)
+		if !v.IsValid() || !v.CanInterface() {
+			msg := fmt.Sprintf("'%s' not in Context", strings.Join(path[:i+2], "."))
+			return reflect.Value{}, &Error{Code: BadRequest, Msg: msg}
+		}
+	}
+	if !v.IsValid() || (v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface) && v.IsNil() {
+		msg := fmt.Sprintf("'%s' is nil in Context", key)
+		return reflect.Value{}, &Error{Code: Unauthorized, Msg: msg}
+	}
+	if v.Kind() == reflect.Struct {
+		ptr := reflect.New(v.Type())
+		ptr.Elem().Set(v)
+		v = ptr
+	}
+	return v, nil
+}
 func (ctx *Context) reopen() {
 	if ctx.s != nil {
-		panic("context has been opened")
+		panic(&Bug{Msg: "context has been opened"})
 	}
-	ctx.s = ctx.r.s.Copy()
+	ctx.s = ctx.r.session()
 }
 func (ctx *Context) Close() {
 	ctx.s.Close()
 	ctx.s = nil
 }
 
+// DB is the database the Context uses: the one set with SetDB, else the
+// one given to Dial.
+func (ctx *Context) DB() string {
+	if ctx.db != "" {
+		return ctx.db
+	}
+	return ctx.r.db
+}
+
+// SetDB makes the Context use database db, e.g. one per tenant, for its
+// collections and GridFS; "" restores Dial's. The indexes are ensured in
+// each database the first time a Context uses it.
+func (ctx *Context) SetDB(db string) {
+	ctx.db = db
+}
 func (ctx *Context) coll(typ string) *mgo.Collection {
 	if ctx.s == nil {
-		panic("context closed")
+		panic(&Bug{Msg: "context closed"})
 	}
-	return ctx.s.DB(ctx.r.db).C(strings.ToLower(typ))
+	ctx.ensureIndexes()
+	return ctx.s.DB(ctx.DB()).C(ctx.collName(strings.ToLower(typ)))
 }
-func (ctx *Context) fs() *mgo.GridFS {
+func (ctx *Context) fs(bucket string) *mgo.GridFS {
 	if ctx.s == nil {
-		panic("context closed")
+		panic(&Bug{Msg: "context closed"})
+	}
+	ctx.ensureIndexes()
+	if bucket == "" {
+		bucket = "fs"
+	}
+	return ctx.s.DB(ctx.DB()).GridFS(ctx.collName(bucket))
+}
+func (ctx *Context) collName(name string) string {
+	if ctx.r == nil || ctx.r.collPrefix == nil {
+		return name
 	}
-	return ctx.s.DB(ctx.r.db).GridFS("fs")
+	return ctx.r.collPrefix(ctx) + name
 }
 
+// Req is what handlers, hooks and policies get. Body is nil for GET and
+// DELETE, a pointer to the request type for PUT and POST, a []interface{}
+// of those for PutMany, with an *Error for any that failed to convert,
+// and for PATCH the M updater, or the request when the resource isn't
+// PatchesUpdater; Before hooks see it before the handler runs.
 type Req struct {
 	*ResId
 	Method Method
@@ -566,16 +871,21 @@ type Slice interface {
 	Items() []interface{}
 }
 type Iter interface {
-	Count() (n int)
+	Count() (n int, err error)
 	Next() (result interface{}, ok bool)
+	Err() error
 	Slice() (slice Slice, err error)
-	Extract(field string, result interface{})
+	Extract(field string, result interface{}) error
+	Reset()
+	Peek() (result interface{}, ok bool)
 }
 type Binary interface {
 	HasReader() bool
 	Reader() (io.ReadCloser, error)
 	Location() (*ResId, bool)
 	MediaType() string
+	ContentLength() int64
+	Etag() string
 }
 type ResourceMeta interface {
 	NewRequest() interface{}
@@ -585,26 +895,53 @@ type ResourceMeta interface {
 	ResponseType() reflect.Type
 	MapToRequest(m map[string]interface{}, base *url.URL) (interface{}, error)
 	MapToUpdater(m map[string]interface{}, base *url.URL) (M, error)
+	PatchesUpdater() bool
+	Parent() (parent *ResId, ok bool)
 	ResponseToMap(resp interface{}, base *url.URL) map[string]interface{}
 }
 type Resource interface {
 	Id() *ResId
+	Meta() ResourceMeta
 	Get() (result interface{}, err error)
 	Put(request interface{}) (response interface{}, err error)
+	PutMany(requests []interface{}) (response *SyncResult, err error)
 	Delete() (response interface{}, err error)
 	Post(request interface{}) (response interface{}, err error)
 	Patch(request interface{}) (response interface{}, err error)
 }
 type BeforeHookFunc func(req *Req, ctx *Context) (goOn bool, response interface{}, err error)
+type AuthorizeFunc func(req *Req, ctx *Context) error
 type AfterHookFunc func(req *Req, ctx *Context, response interface{}, err error) (goOn bool, newResp interface{}, newErr error)
 type Session interface {
 	NewContext() *Context
+	Close()
 	DefType(def interface{})
+	DefTypeWithOptions(def interface{}, opts TypeOptions)
 	DefRes(name string, resource interface{})
 	Before(method Method, res string, hook BeforeHookFunc)
 	After(method Method, res string, hook AfterHookFunc)
+	Authorize(res string, policy AuthorizeFunc)
+	SetMaxDepth(depth int)
+	SetStrict(strict bool)
+	SetBase64Ids(on bool)
+	SetMaxAllItems(n int)
+	SetMaxPathSegments(n int)
+	SetSlowQuery(threshold time.Duration)
+	SetTimeFormat(layout string)
+	SetRefShape(shape RefShape)
+	SetFieldNaming(naming FieldNaming)
 	Bind(name string, typ string, res string, segmentRef []interface{})
+	BindParams(name string, typ string, res string, segmentRef []interface{}, params Params)
+	BindFunc(name string, typ string, rel func(self interface{}) *ResId)
+	HasMany(parentType string, childType string, field string)
+	DefSort(typ string, sortFields []string)
 	Index(typ string, index I)
+	EnsureIndexes(bestEffort bool) error
+	SetCollectionPrefix(prefix func(ctx *Context) string)
+	EnsureContextIndexes(ctx *Context) error
+	Migrate(ctx *Context, typ string, field string, value interface{}) (n int, err error)
+	Export(ctx *Context, typ string, w io.Writer) (n int, err error)
+	Import(ctx *Context, typ string, rd io.Reader) (n int, err error)
 	R(resId *ResId, ctx *Context) (res Resource, err error)
 }
 
@@ -614,18 +951,138 @@ type I struct {
 	Sparse      bool
 	ExpireAfter time.Duration
 }
+type pendingIndex struct {
+	res    string
+	typ    string
+	index  I
+	bucket string // the GridFS bucket's files, indexed by the raw keys in index
+}
+type IndexError struct {
+	Res   string
+	Type  string
+	Index I
+	Err   error
+}
+
+func (e *IndexError) Error() string {
+	if e.Res == "" {
+		return fmt.Sprintf("index %v on type '%s': %v", e.Index.Fields, e.Type, e.Err)
+	}
+	return fmt.Sprintf("index %v of resource '%s': %v", e.Index.Fields, e.Res, e.Err)
+}
+
+type IndexErrors []*IndexError
+
+func (es IndexErrors) Error() string {
+	msgs := make([]string, len(es))
+	for i, e := range es {
+		msgs[i] = e.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Mode is the consistency DialOptions sets on the session, as mgo's
+// SetMode takes it.
+type Mode int
+
+const (
+	// the session's own
+	KeepMode Mode = iota
+	Eventual
+	Monotonic
+	Strong
+)
+
+// DialOptions tunes the copy DialWithOptions makes of the mgo session
+// given; zero fields keep the session's settings. Contexts copy that copy,
+// so they inherit them, and the caller's session stays as it was.
+//
+// With Clone, contexts clone the session instead, reusing its socket
+// rather than reserving one from the pool each. That is cheaper for
+// read-mostly workloads, but contexts then share the socket's
+// consistency: in Monotonic or Strong mode they all read from the server
+// the session is bound to, and one context's write is seen by the rest.
+//
+// ReadOnly refuses every Put, Post, Patch and Delete whatever resources
+// allow.
+//
+// EncryptKey, an AES-128, 192 or 256 key, seals the string fields tagged
+// `mogogo:"encrypt"` in the database.
+//
+// NanoTimes stores time fields as int64 nanoseconds since the epoch
+// instead of millisecond precision dates. Such fields can't be TTL
+// indexed, so only CT and MT can then be an ExpireField.
+type DialOptions struct {
+	SocketTimeout time.Duration
+	SyncTimeout   time.Duration
+	Mode          Mode
+	Clone         bool
+	ReadOnly      bool
+	EncryptKey    []byte
+	NanoTimes     bool
+}
 
 func Dial(s *mgo.Session, db string) Session {
-	return &rest{
+	return DialWithOptions(s, db, DialOptions{})
+}
+func DialWithOptions(s *mgo.Session, db string, opts DialOptions) Session {
+	if s != nil {
+		s = s.Copy()
+		if opts.SocketTimeout > 0 {
+			s.SetSocketTimeout(opts.SocketTimeout)
+		}
+		if opts.SyncTimeout > 0 {
+			s.SetSyncTimeout(opts.SyncTimeout)
+		}
+		switch opts.Mode {
+		case Eventual:
+			s.SetMode(mgo.Eventual, true)
+		case Monotonic:
+			s.SetMode(mgo.Monotonic, true)
+		case Strong:
+			s.SetMode(mgo.Strong, true)
+		}
+	}
+	var aead cipher.AEAD
+	if opts.EncryptKey != nil {
+		aead = newAEAD(opts.EncryptKey)
+	}
+	r := &rest{
 		s,
 		db,
 		make(map[string]reflect.Type),
 		make(map[string]*CustomResource),
 		make(map[string]map[string]*bind),
+		make(map[string][]*rbind),
+		make(map[string][]string),
 		make(map[hookKey]interface{}),
+		make(map[string]AuthorizeFunc),
+		make(map[reflect.Type]map[string]string),
 		newMapCond(),
 		make(map[string]bool),
-	}
+		nil,
+		sync.Mutex{},
+		defaultMaxDepth,
+		false,
+		false,
+		defaultMaxAllItems,
+		defaultMaxSegments,
+		0,
+		opts.Clone,
+		0,
+		opts.ReadOnly,
+		aead,
+		time.RFC3339,
+		opts.NanoTimes,
+		RefObject,
+		LowerCase,
+		nil,
+		0,
+		sync.Map{},
+		nil,
+	}
+	r.defIndex()
+	return r
 }
 
 type selectorSlice struct {
@@ -646,7 +1103,7 @@ func (ss *selectorSlice) HasPrev() bool {
 }
 func (ss *selectorSlice) Prev() *ResId {
 	if !ss.HasPrev() {
-		panic("no prev")
+		panic(&Bug{Msg: "no prev"})
 	}
 	return ss.prev
 }
@@ -655,7 +1112,7 @@ func (ss *selectorSlice) HasNext() bool {
 }
 func (ss *selectorSlice) Next() *ResId {
 	if !ss.HasNext() {
-		panic("no next")
+		panic(&Bug{Msg: "no next"})
 	}
 	return ss.next
 }
@@ -664,7 +1121,7 @@ func (ss *selectorSlice) HasCount() bool {
 }
 func (ss *selectorSlice) Count() int {
 	if !ss.HasCount() {
-		panic("no count")
+		panic(&Bug{Msg: "no count"})
 	}
 	return ss.count
 }
@@ -676,7 +1133,7 @@ func (ss *selectorSlice) HasItems() bool {
 }
 func (ss *selectorSlice) Items() []interface{} {
 	if ss.items == nil {
-		panic("no items")
+		panic(&Bug{Msg: "no items"})
 	}
 	return ss.items
 }
@@ -693,6 +1150,8 @@ type selectorIter struct {
 	sel        bson.M
 	lastId     bson.ObjectId
 	iter       *mgo.Iter
+	err        error
+	peeked     interface{}
 }
 
 func (si *selectorIter) copySel() bson.M {
@@ -702,15 +1161,35 @@ func (si *selectorIter) copySel() bson.M {
 	}
 	return ret
 }
-func (si *selectorIter) getLastId() (ret bson.ObjectId) {
+
+// setIdCursor narrows sel to ids beyond a timeline cursor, keeping any
+// _id range sel already has.
+func setIdCursor(sel bson.M, op string, id bson.ObjectId) {
+	cond := bson.M{op: id}
+	if cur, ok := sel["_id"]; ok {
+		v := reflect.ValueOf(cur)
+		if v.Kind() != reflect.Map {
+			sel["$and"] = []bson.M{{"_id": cur}, {"_id": cond}}
+			delete(sel, "_id")
+			return
+		}
+		for _, k := range v.MapKeys() {
+			if _, ok := cond[k.String()]; !ok {
+				cond[k.String()] = v.MapIndex(k).Interface()
+			}
+		}
+	}
+	sel["_id"] = cond
+}
+func (si *selectorIter) getLastId() (ret bson.ObjectId, err error) {
 	var b bson.M
-	err := si.query().Select(bson.M{"_id": 1}).Sort("-_id").One(&b)
+	err = si.query().Select(bson.M{"_id": 1}).Sort("-_id").One(&b)
 	if err == nil {
 		ret = b["_id"].(bson.ObjectId)
 	} else if err == mgo.ErrNotFound {
-		ret = ""
+		ret, err = "", nil
 	} else {
-		panic(err)
+		ret, err = "", mgoError(err)
 	}
 	return
 }
@@ -721,25 +1200,31 @@ func (si *selectorIter) query() *mgo.Query {
 	return si.ctx.coll(si.typ.Name()).Find(si.sel)
 }
 
-func (si *selectorIter) Count() (n int) {
-	n, err := si.query().Count()
+func (si *selectorIter) Count() (n int, err error) {
+	done := si.r.timeOp("count", si.typ.Name(), si.sel)
+	n, err = si.query().Count()
+	done()
 	if err != nil {
-		panic(&Error{Code: InternalServerError, Err: err})
+		return 0, mgoError(err)
 	}
 	return
 }
-func (si *selectorIter) Extract(field string, result interface{}) {
+func (si *selectorIter) Extract(field string, result interface{}) error {
 	if field == "Id" {
-		panic("can't use field Id")
+		panic(&Bug{Msg: "can't use field Id"})
 	}
-	if _, ok := si.typ.FieldByName(field); !ok {
-		panic(fmt.Sprintf("field '%s' not in %v", si.typ))
+	if sf, ok := si.typ.FieldByName(field); !ok {
+		panic(bugf("field '%s' not in %v", field, si.typ))
+	} else if isEncrypted(sf) {
+		panic(bugf("encrypted field '%s' can't be extracted", field))
 	}
-	field = strings.ToLower(field)
+	field = fieldBsonKey(si.typ, field)
 	var all []interface{}
+	done := si.r.timeOp("distinct", si.typ.Name(), si.sel)
 	err := si.query().Distinct(field, &all)
+	done()
 	if err != nil {
-		panic(&Error{Code: InternalServerError, Err: si.iter.Err()})
+		return mgoError(err)
 	}
 	var tmp = make([]interface{}, 0, len(all))
 	for _, v := range all {
@@ -749,10 +1234,18 @@ func (si *selectorIter) Extract(field string, result interface{}) {
 	}
 	v := reflect.ValueOf(result).Elem()
 	v.Set(si.r.bsonElemToSlice(reflect.ValueOf(tmp), v.Type()))
+	return nil
+}
+func (si *selectorIter) Err() error {
+	return si.err
 }
 func (si *selectorIter) Next() (result interface{}, ok bool) {
+	if si.peeked != nil {
+		result, si.peeked = si.peeked, nil
+		return result, true
+	}
 	result, ok = si.next()
-	if si.pull && !ok {
+	if si.pull && !ok && si.err == nil {
 		sel := si.copySel()
 		sel["$type"] = si.typ.Name()
 		si.iter = nil
@@ -761,12 +1254,35 @@ func (si *selectorIter) Next() (result interface{}, ok bool) {
 	}
 	return
 }
+
+// Reset makes Next start over from the first item. A pulling iter
+// replays the items before waiting for new ones again.
+func (si *selectorIter) Reset() {
+	if si.iter != nil {
+		si.iter.Close()
+	}
+	si.iter = nil
+	si.lastId = ""
+	si.err = nil
+	si.peeked = nil
+}
+
+// Peek returns the item the next call to Next will return.
+func (si *selectorIter) Peek() (result interface{}, ok bool) {
+	if si.peeked == nil {
+		si.peeked, _ = si.Next()
+	}
+	return si.peeked, si.peeked != nil
+}
 func (si *selectorIter) next() (result interface{}, ok bool) {
+	if si.err != nil {
+		return nil, false
+	}
 	if si.iter == nil {
 		if len(si.sortFields) > 0 {
 			sel := si.copySel()
 			if si.lastId != "" && si.isAscTimeline() {
-				sel["_id"] = bson.M{"$gt": si.lastId}
+				setIdCursor(sel, "$gt", si.lastId)
 			}
 			si.iter = si.selQuery(sel).Sort(si.sortFields...).Iter()
 		} else {
@@ -780,8 +1296,8 @@ func (si *selectorIter) next() (result interface{}, ok bool) {
 		si.r.bsonToStruct(b, s)
 		result, ok = s, true
 	} else {
-		if si.iter.Err() != nil {
-			panic(&Error{Code: InternalServerError, Err: si.iter.Err()})
+		if err := si.iter.Err(); err != nil {
+			si.err = mgoError(err)
 		}
 		result, ok = nil, false
 	}
@@ -796,7 +1312,7 @@ func reverse(s []interface{}) {
 		s[i], s[j] = s[j], s[i]
 	}
 }
-func (si *selectorIter) timelineItemsPrev(next bson.ObjectId, n int, all bool) (ret []interface{}) {
+func (si *selectorIter) timelineItemsPrev(next bson.ObjectId, n int) (ret []interface{}, err error) {
 	ret = make([]interface{}, 0)
 	if n <= 0 {
 		return
@@ -808,45 +1324,42 @@ func (si *selectorIter) timelineItemsPrev(next bson.ObjectId, n int, all bool) (
 	sortFields := make([]string, 1)
 	if si.sortFields[0] == "-_id" {
 		sortFields[0] = "_id"
-		sel["_id"] = bson.M{"$gt": next}
+		setIdCursor(sel, "$gt", next)
 	} else {
 		sortFields[0] = "-_id"
-		sel["_id"] = bson.M{"$lt": next}
-	}
-	var iter *mgo.Iter
-	if !all {
-		iter = si.selQuery(sel).Sort(sortFields...).Limit(n).Iter()
-	} else {
-		iter = si.selQuery(sel).Sort(sortFields...).Iter()
+		setIdCursor(sel, "$lt", next)
 	}
+	done := si.r.timeOp("find", si.typ.Name(), sel)
+	defer done()
+	iter := si.selQuery(sel).Sort(sortFields...).Limit(n).Iter()
 	b := make(bson.M)
 	for iter.Next(b) {
 		s := reflect.New(si.typ).Interface()
 		si.r.bsonToStruct(b, s)
 		ret = append(ret, s)
 	}
-	if iter.Err() != nil {
-		panic(&Error{Code: InternalServerError, Err: si.iter.Err()})
+	if err = iter.Close(); err != nil {
+		return nil, mgoError(err)
 	}
 	reverse(ret)
 	return
 }
-func (si *selectorIter) timelineItemsNext(next bson.ObjectId, n int, all bool) (ret []interface{}) {
+func (si *selectorIter) timelineItemsNext(next bson.ObjectId, n int) (ret []interface{}, err error) {
 	if next == "" && si.lastId != "" {
 		next = si.lastId
 	}
-	ret = si._timelineItemsNext(next, n, all)
-	if si.pull && len(ret) == 0 {
+	ret, err = si._timelineItemsNext(next, n)
+	if err == nil && si.pull && len(ret) == 0 {
 		si.ctx.Close()
 		sel := si.copySel()
 		sel["$type"] = si.typ.Name()
 		si.r.mc.Wait(sel)
 		si.ctx.reopen()
-		ret = si._timelineItemsNext(next, n, all)
+		ret, err = si._timelineItemsNext(next, n)
 	}
-	return ret
+	return
 }
-func (si *selectorIter) _timelineItemsNext(next bson.ObjectId, n int, all bool) (ret []interface{}) {
+func (si *selectorIter) _timelineItemsNext(next bson.ObjectId, n int) (ret []interface{}, err error) {
 	ret = make([]interface{}, 0)
 	if n <= 0 {
 		return
@@ -857,25 +1370,22 @@ func (si *selectorIter) _timelineItemsNext(next bson.ObjectId, n int, all bool)
 	sel := si.copySel()
 	if next != "" {
 		if si.sortFields[0] == "-_id" {
-			sel["_id"] = bson.M{"$lt": next}
+			setIdCursor(sel, "$lt", next)
 		} else {
-			sel["_id"] = bson.M{"$gt": next}
+			setIdCursor(sel, "$gt", next)
 		}
 	}
-	var iter *mgo.Iter
-	if !all {
-		iter = si.selQuery(sel).Sort(si.sortFields...).Limit(n).Iter()
-	} else {
-		iter = si.selQuery(sel).Sort(si.sortFields...).Iter()
-	}
+	done := si.r.timeOp("find", si.typ.Name(), sel)
+	defer done()
+	iter := si.selQuery(sel).Sort(si.sortFields...).Limit(n).Iter()
 	b := make(bson.M)
 	for iter.Next(b) {
 		s := reflect.New(si.typ).Interface()
 		si.r.bsonToStruct(b, s)
 		ret = append(ret, s)
 	}
-	if iter.Err() != nil {
-		panic(&Error{Code: InternalServerError, Err: si.iter.Err()})
+	if err = iter.Close(); err != nil {
+		return nil, mgoError(err)
 	}
 	return
 }
@@ -897,9 +1407,8 @@ func (si *selectorIter) timelineSlice() (slice *selectorSlice, err error) {
 	if err != nil {
 		return nil, err
 	}
-	if all && si.limit > 0 {
-		all = false
-		n = si.limit
+	if all {
+		n = si.allItems()
 	}
 	noitems, err := parseParamBool(si.resId.Params, "noitems", false)
 	if err != nil {
@@ -907,15 +1416,29 @@ func (si *selectorIter) timelineSlice() (slice *selectorSlice, err error) {
 	}
 	if !foundNext && !foundPrev && si.hasCount {
 		slice.hasCount = true
-		slice.count, slice.more = si.count()
+		slice.count, slice.more, err = si.count()
+		if err != nil {
+			return nil, err
+		}
 	}
 	if !noitems {
 		if foundNext {
-			slice.items = si.timelineItemsNext(next, n, all)
+			slice.items, err = si.timelineItemsNext(next, n)
 		} else if foundPrev {
-			slice.items = si.timelineItemsPrev(prev, n, all)
+			slice.items, err = si.timelineItemsPrev(prev, n)
 		} else {
-			slice.items = si.timelineItemsNext("", n, all)
+			slice.items, err = si.timelineItemsNext("", n)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if all && si.limit <= 0 && len(slice.items) > si.r.maxAllItems {
+			if foundPrev {
+				slice.items = slice.items[1:]
+			} else {
+				slice.items = slice.items[:si.r.maxAllItems]
+			}
+			slice.more = true
 		}
 	}
 	slice.self = si.timelineSelf()
@@ -936,7 +1459,7 @@ func (si *selectorIter) timelinePrev(s *selectorSlice) *ResId {
 	ret.Params.Del("prev")
 	ret.Params.Del("next")
 	ret.Params.Del("last")
-	prevId := getBase(reflect.ValueOf(s.items[0]).Elem()).id.Hex()
+	prevId := si.r.idString(getBase(reflect.ValueOf(s.items[0]).Elem()).id)
 	ret.Params.SetString("prev", prevId)
 	return ret
 }
@@ -945,13 +1468,23 @@ func (si *selectorIter) timelineNext(s *selectorSlice) *ResId {
 	ret.Params.Del("prev")
 	ret.Params.Del("next")
 	ret.Params.Del("last")
-	nextId := getBase(reflect.ValueOf(s.items[len(s.items)-1]).Elem()).id.Hex()
+	nextId := si.r.idString(getBase(reflect.ValueOf(s.items[len(s.items)-1]).Elem()).id)
 	ret.Params.SetString("next", nextId)
 	return ret
 }
-func (si *selectorIter) count() (c int, more bool) {
-	var err error
+
+// allItems is how many items all=true fetches: the resource limit, or
+// one past the session cap so truncation can be detected.
+func (si *selectorIter) allItems() int {
+	if si.limit > 0 {
+		return si.limit
+	}
+	return si.r.maxAllItems + 1
+}
+func (si *selectorIter) count() (c int, more bool, err error) {
 	q := si.query()
+	done := si.r.timeOp("count", si.typ.Name(), si.sel)
+	defer done()
 	if si.limit > 0 {
 		c, err = q.Limit(si.limit + 1).Count()
 		if c > si.limit {
@@ -964,11 +1497,11 @@ func (si *selectorIter) count() (c int, more bool) {
 		c, err = q.Count()
 	}
 	if err != nil {
-		panic(&Error{Code: InternalServerError, Err: si.iter.Err()})
+		return 0, false, mgoError(err)
 	}
 	return
 }
-func (si *selectorIter) sortedItems(c, n int, all bool) (ret []interface{}) {
+func (si *selectorIter) sortedItems(c, n int) (ret []interface{}, err error) {
 	ret = make([]interface{}, 0)
 	if c < 0 {
 		n += c
@@ -984,25 +1517,22 @@ func (si *selectorIter) sortedItems(c, n int, all bool) (ret []interface{}) {
 		return
 	}
 	var qry *mgo.Query
-	var iter *mgo.Iter
 	if len(si.sortFields) > 0 {
 		qry = si.query().Sort(si.sortFields...).Skip(c)
 	} else {
 		qry = si.query().Skip(c)
 	}
-	if !all {
-		iter = qry.Limit(n).Iter()
-	} else {
-		iter = qry.Iter()
-	}
+	done := si.r.timeOp("find", si.typ.Name(), si.sel)
+	defer done()
+	iter := qry.Limit(n).Iter()
 	b := make(bson.M)
 	for iter.Next(b) {
 		s := reflect.New(si.typ).Interface()
 		si.r.bsonToStruct(b, s)
 		ret = append(ret, s)
 	}
-	if iter.Err() != nil {
-		panic(&Error{Code: InternalServerError, Err: si.iter.Err()})
+	if err = iter.Close(); err != nil {
+		return nil, mgoError(err)
 	}
 	return
 }
@@ -1020,9 +1550,8 @@ func (si *selectorIter) sortedSlice() (slice *selectorSlice, err error) {
 	if err != nil {
 		return nil, err
 	}
-	if all && si.limit > 0 {
-		all = false
-		n = si.limit
+	if all {
+		n = si.allItems()
 	}
 	noitems, err := parseParamBool(si.resId.Params, "noitems", false)
 	if err != nil {
@@ -1030,10 +1559,20 @@ func (si *selectorIter) sortedSlice() (slice *selectorSlice, err error) {
 	}
 	if c == 0 && si.hasCount {
 		slice.hasCount = true
-		slice.count, slice.more = si.count()
+		slice.count, slice.more, err = si.count()
+		if err != nil {
+			return nil, err
+		}
 	}
 	if !noitems {
-		slice.items = si.sortedItems(c, n, all)
+		slice.items, err = si.sortedItems(c, n)
+		if err != nil {
+			return nil, err
+		}
+		if all && si.limit <= 0 && len(slice.items) > si.r.maxAllItems {
+			slice.items = slice.items[:si.r.maxAllItems]
+			slice.more = true
+		}
 	}
 	slice.self = si.sortedSelf()
 	if !slice.HasItems() || len(slice.items) != 0 {
@@ -1082,30 +1621,92 @@ func (si *selectorIter) Slice() (slice Slice, err error) {
 }
 
 type rest struct {
-	s       *mgo.Session
-	db      string
-	types   map[string]reflect.Type
-	queries map[string]*CustomResource
-	binds   map[string]map[string]*bind
-	hooks   map[hookKey]interface{}
-	mc      *mapCond
-	pull    map[string]bool
+	s           *mgo.Session
+	db          string
+	types       map[string]reflect.Type
+	queries     map[string]*CustomResource
+	binds       map[string]map[string]*bind
+	rbinds      map[string][]*rbind
+	sorts       map[string][]string
+	hooks       map[hookKey]interface{}
+	authz       map[string]AuthorizeFunc
+	fields      map[reflect.Type]map[string]string
+	mc          *mapCond
+	pull        map[string]bool
+	indexes     []*pendingIndex
+	idxMu       sync.Mutex
+	maxDepth    int
+	strict      bool
+	base64Ids   bool
+	maxAllItems int
+	maxSegments int
+	slowQuery   time.Duration
+	clone       bool
+	closed      int32 // atomic
+	readOnly    bool
+	aead        cipher.AEAD
+	timeFormat  string
+	nanoTimes   bool
+	refShape    RefShape
+	naming      FieldNaming
+	collPrefix  func(ctx *Context) string
+	idxCount    int32       // atomic; len(indexes)
+	idxDone     sync.Map    // database.prefix: indexes ensured there
+	idxErrs     IndexErrors // guarded by idxMu
 }
 
 func (r *rest) NewContext() *Context {
-	return &Context{r: r, s: r.s.Copy(), values: make(map[string]interface{})}
+	if atomic.LoadInt32(&r.closed) != 0 {
+		panic(&Bug{Msg: "session closed"})
+	}
+	return &Context{r: r, s: r.session(), values: make(map[string]interface{})}
+}
+
+// Close closes the copy Dial made of the mgo session given; the caller
+// still closes its own. Contexts already open keep working until closed;
+// NewContext panics afterwards.
+func (r *rest) Close() {
+	if !atomic.CompareAndSwapInt32(&r.closed, 0, 1) {
+		return
+	}
+	if r.s != nil {
+		r.s.Close()
+	}
+}
+func (r *rest) session() *mgo.Session {
+	if r.clone {
+		return r.s.Clone()
+	}
+	return r.s.Copy()
 }
 
 type F string
+type Fn struct {
+	Type string
+	Func func(self interface{}) interface{}
+}
 type bind struct {
 	res        string
 	segmentRef []interface{}
+	params     Params
+	fn         func(self interface{}) *ResId
+}
+type rbind struct {
+	typ   string
+	name  string
+	field string
 }
 
+func mgoError(err error) error {
+	if mgo.IsDup(err) {
+		return &Error{Code: Conflict}
+	}
+	return &Error{Code: InternalServerError, Err: err}
+}
 func getCheckNil(b bson.M, key string) interface{} {
 	ret := b[key]
 	if ret == nil {
-		panic(fmt.Sprintf("key '%s' is nil", key))
+		panic(bugf("key '%s' is nil", key))
 	}
 	return ret
 }
@@ -1132,59 +1733,360 @@ func (r *rest) After(method Method, res string, hook AfterHookFunc) {
 	r.hooks[hookKey{after, method, res}] = hook
 }
 
-func (r *rest) doBefore(m Method, res string, req *Req, ctx *Context) (goOn bool, response interface{}, err error) {
-	hk := hookKey{before, m, res}
-	hook, ok := r.hooks[hk]
-	if !ok {
-		goOn, response, err = true, nil, nil
-	} else {
-		bhf := hook.(BeforeHookFunc)
-		goOn, response, err = bhf(req, ctx)
-	}
-	return
+const defaultMaxDepth = 32
+
+// SetMaxDepth limits how deeply request bodies may nest slices, objects
+// and pointers; deeper input is rejected with BadRequest.
+func (r *rest) SetMaxDepth(depth int) {
+	r.maxDepth = depth
 }
-func (r *rest) doAfter(m Method, res string, req *Req, ctx *Context, resp interface{}, err error) (goOn bool, newResp interface{}, newErr error) {
-	hk := hookKey{after, m, res}
-	hook, ok := r.hooks[hk]
-	if !ok {
-		goOn, newResp, newErr = true, nil, nil
-	} else {
-		ahf := hook.(AfterHookFunc)
-		goOn, newResp, newErr = ahf(req, ctx, resp, err)
-	}
-	return
+
+// SetStrict makes request bodies with keys matching no field fail with
+// BadRequest, each unknown key listed in Fields.
+func (r *rest) SetStrict(strict bool) {
+	r.strict = strict
 }
-func (r *rest) bsonElemToSlice(v reflect.Value, t reflect.Type) reflect.Value {
-	ret := reflect.MakeSlice(t, v.Len(), v.Len())
-	for i := 0; i < ret.Len(); i++ {
-		ret.Index(i).Set(r.bsonElemToValue(v.Index(i), t.Elem()))
+
+// SetBase64Ids makes ResIds carry object ids as 16 base64url characters
+// instead of 24 hex ones. Both forms are accepted when parsing.
+func (r *rest) SetBase64Ids(on bool) {
+	r.base64Ids = on
+}
+
+const defaultMaxAllItems = 10000
+
+// SetMaxAllItems caps how many items all=true returns from a resource
+// without a Limit; a truncated slice reports more.
+func (r *rest) SetMaxAllItems(n int) {
+	r.maxAllItems = n
+}
+
+const defaultMaxSegments = 64
+
+// SetMaxPathSegments bounds the path segments, name included, R accepts,
+// so a crafted url can't make a resource parse a huge path.
+func (r *rest) SetMaxPathSegments(n int) {
+	r.maxSegments = n
+}
+
+// SetSlowQuery logs Mongo operations taking at least threshold; zero,
+// the default, disables it.
+func (r *rest) SetSlowQuery(threshold time.Duration) {
+	r.slowQuery = threshold
+}
+
+// UnixTime as a time format sends times as seconds since the Unix epoch.
+const UnixTime = "unix"
+
+// SetTimeFormat sets the layout of times in request and response bodies,
+// time.RFC3339 by default. With UnixTime, times are sent as numbers.
+// RFC3339 strings, as Export writes, are accepted with any layout.
+func (r *rest) SetTimeFormat(layout string) {
+	r.timeFormat = layout
+}
+func formatTime(tm time.Time, layout string) interface{} {
+	if layout == UnixTime {
+		return tm.Unix()
 	}
-	return ret
+	return tm.UTC().Format(layout)
 }
-func (r *rest) bsonElemToStruct(v reflect.Value, t reflect.Type) reflect.Value {
-	var ret reflect.Value
-	if hasBase(t) {
-		s, err := r.newWithObjectId(t, v.Interface().(bson.ObjectId))
-		if err != nil {
-			panic(err)
+
+// RefShape is how references to other resources appear in responses.
+type RefShape int
+
+const (
+	// {id, type, href}
+	RefObject RefShape = iota
+	// the bare id string
+	RefId
+	// the href string
+	RefHref
+)
+
+// SetRefShape sets the response shape of references, RefObject by
+// default. With the other shapes, requests may send a reference as a bare
+// id, or with RefHref as an href to the referenced type's self resource,
+// besides {id}.
+func (r *rest) SetRefShape(shape RefShape) {
+	r.refShape = shape
+}
+
+// FieldNaming is how field names become the keys of requests and
+// responses. Storage keys stay lowercased whatever the naming.
+type FieldNaming int
+
+const (
+	// FirstName as firstname
+	LowerCase FieldNaming = iota
+	// FirstName as firstName, URLPath as urlPath
+	CamelCase
+	// FirstName as first_name, URLPath as url_path
+	SnakeCase
+)
+
+func (n FieldNaming) key(name string) string {
+	rs := []rune(name)
+	switch n {
+	case CamelCase:
+		up := 0
+		for up < len(rs) && unicode.IsUpper(rs[up]) {
+			up++
 		}
-		ret = reflect.ValueOf(s).Elem()
-	} else if t == urlType {
-		s := v.Interface().(string)
-		if u, err := url.ParseRequestURI(s); err != nil {
-			panic(err)
-		} else {
-			ret = reflect.ValueOf(u).Elem()
+		if up > 1 && up < len(rs) && unicode.IsLower(rs[up]) {
+			up--
 		}
-	} else if t == timeType {
-		t := v.Interface().(time.Time)
-		ret = reflect.ValueOf(&t).Elem()
-	} else if t == geoType {
-		lon := v.Index(0).Interface().(float64)
-		lat := v.Index(1).Interface().(float64)
-		ret = reflect.ValueOf(&Geo{La: lat, Lo: lon}).Elem()
-	} else {
-		panic(fmt.Sprintf("not support struct type %v", t))
+		return strings.ToLower(string(rs[:up])) + string(rs[up:])
+	case SnakeCase:
+		var ret []rune
+		for i, c := range rs {
+			if i > 0 && unicode.IsUpper(c) && (!unicode.IsUpper(rs[i-1]) || i+1 < len(rs) && unicode.IsLower(rs[i+1])) {
+				ret = append(ret, '_')
+			}
+			ret = append(ret, unicode.ToLower(c))
+		}
+		return string(ret)
+	}
+	return strings.ToLower(name)
+}
+
+// fieldKey is the request and response key of sf: its json tag name,
+// else its name under n.
+func (n FieldNaming) fieldKey(sf reflect.StructField) string {
+	if name := tagName(sf, "json"); name != "" {
+		return name
+	}
+	return n.key(sf.Name)
+}
+
+// bsonKey is the storage key of sf: its bson tag name, else its name
+// lowercased. It doesn't follow the FieldNaming, so stored documents keep
+// their keys when the naming changes.
+func bsonKey(sf reflect.StructField) string {
+	if name := tagName(sf, "bson"); name != "" {
+		return name
+	}
+	return strings.ToLower(sf.Name)
+}
+func fieldBsonKey(t reflect.Type, name string) string {
+	if sf, ok := t.FieldByName(name); ok {
+		return bsonKey(sf)
+	}
+	return strings.ToLower(name)
+}
+func fieldByBsonKey(t reflect.Type, key string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if !(sf.Anonymous && sf.Type == baseType) && unicode.IsUpper(rune(sf.Name[0])) && bsonKey(sf) == key {
+			return sf, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// checkVirtual rejects virtual fields taking a field's key, or one of
+// Base's.
+func (r *rest) checkVirtual(t reflect.Type) {
+	virtual, ok := reflect.New(t).Interface().(Virtual)
+	if !ok {
+		return
+	}
+	for k := range virtual.Virtual() {
+		_, stored := r.fields[t][k]
+		if _, ok := indexOf([]string{"id", "self", "type", "ct", "mt"}, k); ok && hasBase(t) {
+			stored = true
+		}
+		if stored {
+			panic(bugf("virtual field '%s' of '%v' collides with a stored one", k, t))
+		}
+	}
+}
+
+// checkTags rejects "-" tags, as every field is stored and served, and
+// tags taking the keys Base is stored and served under.
+func checkTags(t reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		for _, tag := range []struct {
+			key      string
+			reserved []string
+		}{{"json", []string{"id", "ct", "mt"}}, {"bson", []string{"_id", "ct", "mt"}}} {
+			name := strings.Split(sf.Tag.Get(tag.key), ",")[0]
+			if name == "-" {
+				panic(bugf("field '%s' of '%s': %s tag '-' not supported", sf.Name, t.Name(), tag.key))
+			}
+			if _, ok := indexOf(tag.reserved, name); ok {
+				panic(bugf("field '%s' of '%s': %s tag '%s' is reserved", sf.Name, t.Name(), tag.key, name))
+			}
+		}
+	}
+}
+
+// SetFieldNaming sets the naming of request and response keys, LowerCase
+// by default. Requests are read with the same naming responses use.
+// Fields with a json tag keep its name.
+func (r *rest) SetFieldNaming(naming FieldNaming) {
+	r.naming = naming
+	for t := range r.fields {
+		r.fields[t] = keyedFieldNames(t, naming.fieldKey)
+	}
+}
+
+// Time fields tagged `mogogo:"zone"` keep the offset they were sent with.
+// They are stored as {t: time, z: offset seconds}, so selectors on them
+// match against field.t.
+const zoneTag = "zone"
+
+func isZoned(sf reflect.StructField) bool {
+	return hasTag(sf, zoneTag)
+}
+func checkZoned(t reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if isZoned(sf) && sf.Type != timeType && sf.Type != reflect.PtrTo(timeType) {
+			panic(bugf("zoned field '%s' must be time.Time, got '%v'", sf.Name, sf.Type))
+		}
+	}
+}
+
+// zonedTime reads back a stored zoned time; plain times, stored before
+// the field was zoned, stay as they are.
+func zonedTime(elem interface{}) (interface{}, error) {
+	m, ok := elem.(bson.M)
+	if !ok {
+		return elem, nil
+	}
+	tm, err := bsonElemToTime(m["t"])
+	if err != nil {
+		return nil, err
+	}
+	var z int
+	switch val := m["z"].(type) {
+	case int:
+		z = val
+	case int64:
+		z = int(val)
+	}
+	return tm.In(time.FixedZone("", z)), nil
+}
+func formatZonedTime(tm time.Time, layout string) interface{} {
+	if layout == UnixTime {
+		return tm.Unix()
+	}
+	return tm.Format(layout)
+}
+func (r *rest) parseTime(i interface{}, key string) (time.Time, error) {
+	layout := r.timeFormat
+	if layout == UnixTime {
+		if f, ok := toFloat(i); ok {
+			sec, frac := math.Modf(f)
+			return time.Unix(int64(sec), int64(frac*1e9)).UTC(), nil
+		}
+		layout = time.RFC3339
+	}
+	s, ok := i.(string)
+	if !ok {
+		return time.Time{}, typeError(key, timeType, reflect.TypeOf(i))
+	}
+	tm, err := time.Parse(layout, s)
+	if err != nil && layout != time.RFC3339 {
+		if rfc, rfcErr := time.Parse(time.RFC3339, s); rfcErr == nil {
+			return rfc, nil
+		}
+	}
+	if err != nil {
+		return tm, &Error{Code: BadRequest, Msg: "field '" + key + "' parse error", Err: err}
+	}
+	return tm, nil
+}
+func (r *rest) timeOp(op, typ string, sel interface{}) func() {
+	if r.slowQuery <= 0 {
+		return func() {}
+	}
+	start := time.Now()
+	return func() {
+		if d := time.Since(start); d >= r.slowQuery {
+			log.Printf("mogogo: slow %s on '%s' %v took %v", op, strings.ToLower(typ), r.redactSel(typ, sel), d)
+		}
+	}
+}
+func (r *rest) idString(id bson.ObjectId) string {
+	if r != nil && r.base64Ids {
+		return base64.URLEncoding.EncodeToString([]byte(id))
+	}
+	return id.Hex()
+}
+func (r *rest) Authorize(res string, policy AuthorizeFunc) {
+	if res != "" {
+		r.checkQuery(res)
+	}
+	r.authz[res] = policy
+}
+func (r *rest) authorize(req *Req, ctx *Context) error {
+	for _, res := range []string{"", req.Name()} {
+		if policy, ok := r.authz[res]; ok {
+			if err := policy(req, ctx); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+func (r *rest) doBefore(m Method, res string, req *Req, ctx *Context) (goOn bool, response interface{}, err error) {
+	hk := hookKey{before, m, res}
+	hook, ok := r.hooks[hk]
+	if !ok {
+		goOn, response, err = true, nil, nil
+	} else {
+		bhf := hook.(BeforeHookFunc)
+		goOn, response, err = bhf(req, ctx)
+	}
+	return
+}
+func (r *rest) doAfter(m Method, res string, req *Req, ctx *Context, resp interface{}, err error) (goOn bool, newResp interface{}, newErr error) {
+	hk := hookKey{after, m, res}
+	hook, ok := r.hooks[hk]
+	if !ok {
+		goOn, newResp, newErr = true, nil, nil
+	} else {
+		ahf := hook.(AfterHookFunc)
+		goOn, newResp, newErr = ahf(req, ctx, resp, err)
+	}
+	return
+}
+func (r *rest) bsonElemToSlice(v reflect.Value, t reflect.Type) reflect.Value {
+	ret := reflect.MakeSlice(t, v.Len(), v.Len())
+	for i := 0; i < ret.Len(); i++ {
+		ret.Index(i).Set(r.bsonElemToValue(v.Index(i), t.Elem()))
+	}
+	return ret
+}
+func (r *rest) bsonElemToStruct(v reflect.Value, t reflect.Type) reflect.Value {
+	var ret reflect.Value
+	if hasBase(t) {
+		s, err := r.newWithObjectId(t, v.Interface().(bson.ObjectId))
+		if err != nil {
+			panic(err)
+		}
+		ret = reflect.ValueOf(s).Elem()
+	} else if t == urlType {
+		s := v.Interface().(string)
+		if u, err := url.ParseRequestURI(s); err != nil {
+			panic(err)
+		} else {
+			ret = reflect.ValueOf(u).Elem()
+		}
+	} else if t == timeType {
+		t, err := bsonElemToTime(v.Interface())
+		if err != nil {
+			panic(&Error{Code: InternalServerError, Msg: "decode time", Err: err})
+		}
+		ret = reflect.ValueOf(&t).Elem()
+	} else if t == geoType {
+		lon := v.Index(0).Interface().(float64)
+		lat := v.Index(1).Interface().(float64)
+		ret = reflect.ValueOf(&Geo{La: lat, Lo: lon}).Elem()
+	} else {
+		panic(bugf("not support struct type %v", t))
 	}
 	return ret
 }
@@ -1210,7 +2112,7 @@ func (r *rest) bsonElemToValue(v reflect.Value, t reflect.Type) reflect.Value {
 	case reflect.Ptr:
 		ret = r.bsonElemToValue(v, t.Elem()).Addr()
 	default:
-		panic(fmt.Sprintf("type not support: '%v'", t))
+		panic(bugf("type not support: '%v'", t))
 	}
 	return ret
 }
@@ -1230,11 +2132,23 @@ func (r *rest) bsonToStruct(b bson.M, s interface{}) {
 			continue
 		}
 		fv := v.Field(i)
-		elem := b[strings.ToLower(sf.Name)]
+		elem := b[bsonKey(sf)]
+		if elem != nil && isEncrypted(sf) {
+			elem = r.decryptElem(base.id, sf, elem)
+		} else if elem != nil && isZoned(sf) {
+			var err error
+			if elem, err = zonedTime(elem); err != nil {
+				panic(&Error{Code: InternalServerError, Msg: "decode zoned field " + sf.Name, Err: err})
+			}
+		}
 		if sf.Type.Kind() == reflect.Ptr {
 			if elem != nil {
 				fv.Set(r.bsonElemToValue(reflect.ValueOf(elem), sf.Type.Elem()).Addr())
 			}
+		} else if sf.Type == bytesType {
+			if elem != nil {
+				fv.SetBytes(elem.([]byte))
+			}
 		} else if sf.Type.Kind() == reflect.Slice {
 			if elem != nil {
 				fv.Set(r.bsonElemToValue(reflect.ValueOf(elem), sf.Type))
@@ -1243,7 +2157,7 @@ func (r *rest) bsonToStruct(b bson.M, s interface{}) {
 			}
 		} else {
 			if elem == nil {
-				panic(fmt.Sprintf("'%v.%s' not nil", v.Type(), sf.Name))
+				panic(bugf("'%v.%s' not nil", v.Type(), sf.Name))
 			}
 			fv.Set(r.bsonElemToValue(reflect.ValueOf(elem), sf.Type))
 		}
@@ -1251,21 +2165,28 @@ func (r *rest) bsonToStruct(b bson.M, s interface{}) {
 	base.loaded = true
 }
 
-func (r *rest) sliceToMapElem(v reflect.Value, t reflect.Type, baseURL *url.URL) interface{} {
+func (r *rest) sliceToMapElem(v reflect.Value, t reflect.Type, baseURL *url.URL, layout string) interface{} {
 	ret := make([]interface{}, v.Len(), v.Len())
 	for i := 0; i < len(ret); i++ {
-		ret[i] = r.valueToMapElem(v.Index(i), t.Elem(), baseURL)
+		ret[i] = r.valueToMapElem(v.Index(i), t.Elem(), baseURL, layout)
 	}
 	return ret
 }
-func (r *rest) structToMapElem(v reflect.Value, t reflect.Type, baseURL *url.URL) interface{} {
+func (r *rest) structToMapElem(v reflect.Value, t reflect.Type, baseURL *url.URL, layout string) interface{} {
 	var ret interface{}
 	if hasBase(t) {
 		base := getBase(v)
-		ret = map[string]interface{}{
-			"id":   base.id.Hex(),
-			"type": strings.ToLower(base.t),
-			"href": base.Self().URLWithBase(baseURL).String(),
+		switch r.refShape {
+		case RefId:
+			ret = r.idString(base.id)
+		case RefHref:
+			ret = base.Self().URLWithBase(baseURL).String()
+		default:
+			ret = map[string]interface{}{
+				"id":   r.idString(base.id),
+				"type": strings.ToLower(base.t),
+				"href": base.Self().URLWithBase(baseURL).String(),
+			}
 		}
 
 	} else if t == urlType {
@@ -1276,17 +2197,25 @@ func (r *rest) structToMapElem(v reflect.Value, t reflect.Type, baseURL *url.URL
 		}
 		ret = url.String()
 	} else if t == timeType {
-		tm := v.Interface().(time.Time)
-		ret = tm.UTC().Format(time.RFC3339)
+		ret = formatTime(v.Interface().(time.Time), layout)
 	} else if t == geoType {
 		geo := v.Interface().(Geo)
 		ret = map[string]interface{}{"lon": geo.Lo, "lat": geo.La}
 	} else {
-		panic(fmt.Sprintf("struct type not support %v", t))
+		panic(bugf("struct type not support %v", t))
 	}
 	return ret
 }
-func (r *rest) valueToMapElem(v reflect.Value, t reflect.Type, baseURL *url.URL) interface{} {
+func (r *rest) fieldToMapElem(sf reflect.StructField, v reflect.Value, t reflect.Type, baseURL *url.URL, layout string) interface{} {
+	if t == bytesType {
+		return base64.StdEncoding.EncodeToString(v.Bytes())
+	}
+	if isZoned(sf) {
+		return formatZonedTime(v.Interface().(time.Time), layout)
+	}
+	return r.valueToMapElem(v, t, baseURL, layout)
+}
+func (r *rest) valueToMapElem(v reflect.Value, t reflect.Type, baseURL *url.URL, layout string) interface{} {
 	var ret interface{}
 	switch t.Kind() {
 	case reflect.String:
@@ -1298,59 +2227,69 @@ func (r *rest) valueToMapElem(v reflect.Value, t reflect.Type, baseURL *url.URL)
 	case reflect.Float32, reflect.Float64:
 		ret = v.Interface()
 	case reflect.Slice:
-		ret = r.sliceToMapElem(v, t, baseURL)
+		ret = r.sliceToMapElem(v, t, baseURL, layout)
 	case reflect.Struct:
-		ret = r.structToMapElem(v, t, baseURL)
+		ret = r.structToMapElem(v, t, baseURL, layout)
 	default:
-		panic(fmt.Sprintf("type not support: '%v'", t))
+		panic(bugf("type not support: '%v'", t))
 	}
 	return ret
 }
 func (r *rest) structToMap(s interface{}, baseURL *url.URL) map[string]interface{} {
+	return r.structToMapLayout(s, baseURL, r.timeFormat)
+}
+
+// structToMapLayout is structToMap with times formatted per layout.
+func (r *rest) structToMapLayout(s interface{}, baseURL *url.URL, layout string) map[string]interface{} {
 	ret := make(map[string]interface{})
 	sv := reflect.ValueOf(s).Elem()
 	st := sv.Type()
 	if hasBase(st) {
 		base := getBase(sv)
 		if !base.loaded {
-			panic("struct not loaded")
+			panic(&Bug{Msg: "struct not loaded"})
 		}
 		if base.id != "" {
-			ret["id"] = base.id.Hex()
+			ret["id"] = r.idString(base.id)
 			ret["self"] = base.Self().URLWithBase(baseURL).String()
 			ret["type"] = strings.ToLower(base.t)
 			if base.mt.IsZero() {
-				panic("modifiy time not set")
+				panic(&Bug{Msg: "modifiy time not set"})
 			}
 			if base.ct.IsZero() {
-				panic("create time not set")
+				panic(&Bug{Msg: "create time not set"})
 			}
-			ret["mt"] = base.mt.UTC().Format(time.RFC3339)
-			ret["ct"] = base.ct.UTC().Format(time.RFC3339)
+			ret["mt"] = formatTime(base.mt, layout)
+			ret["ct"] = formatTime(base.ct, layout)
 		}
 	}
 	for i := 0; i < st.NumField(); i++ {
 		sf := st.Field(i)
-		key := strings.ToLower(sf.Name)
+		key := r.naming.fieldKey(sf)
 		if sf.Anonymous && sf.Type == baseType {
 			continue
 		}
 		fv := sv.Field(i)
 		if sf.Type.Kind() == reflect.Ptr {
 			if !fv.IsNil() {
-				ret[key] = r.valueToMapElem(fv.Elem(), sf.Type.Elem(), baseURL)
+				ret[key] = r.fieldToMapElem(sf, fv.Elem(), sf.Type.Elem(), baseURL, layout)
 			}
 		} else if sf.Type.Kind() == reflect.Slice {
-			if !fv.IsNil() {
-				ret[key] = r.valueToMapElem(fv, sf.Type, baseURL)
+			if !fv.IsNil() || sf.Type == bytesType {
+				ret[key] = r.fieldToMapElem(sf, fv, sf.Type, baseURL, layout)
 			} else {
 				ret[key] = make([]interface{}, 0)
 			}
 		} else {
-			ret[key] = r.valueToMapElem(fv, sf.Type, baseURL)
+			ret[key] = r.fieldToMapElem(sf, fv, sf.Type, baseURL, layout)
 		}
 
 	}
+	if virtual, ok := s.(Virtual); ok {
+		for k, v := range virtual.Virtual() {
+			ret[k] = v
+		}
+	}
 	return ret
 
 }
@@ -1361,6 +2300,24 @@ func (r *rest) sliceToBsonElem(v reflect.Value, t reflect.Type) interface{} {
 	}
 	return ret
 }
+func (r *rest) timeToBsonElem(tm time.Time) interface{} {
+	if r.nanoTimes {
+		return tm.UnixNano()
+	}
+	return tm
+}
+
+// bsonElemToTime reads a time stored either as a date or, with NanoTimes,
+// as nanoseconds.
+func bsonElemToTime(elem interface{}) (time.Time, error) {
+	switch tm := elem.(type) {
+	case int64:
+		return time.Unix(0, tm), nil
+	case time.Time:
+		return tm, nil
+	}
+	return time.Time{}, fmt.Errorf("want a date or nanoseconds, got %T", elem)
+}
 func (r *rest) structToBsonElem(v reflect.Value, t reflect.Type) interface{} {
 	var ret interface{}
 	if hasBase(t) {
@@ -1368,19 +2325,35 @@ func (r *rest) structToBsonElem(v reflect.Value, t reflect.Type) interface{} {
 	} else if t == urlType {
 		ret = v.Addr().Interface().(*url.URL).String()
 	} else if t == timeType {
-		ret = v.Interface()
+		ret = r.timeToBsonElem(v.Interface().(time.Time))
 	} else if t == geoType {
 		geo := v.Interface().(Geo)
 		ret = []interface{}{geo.Lo, geo.La}
 	} else {
-		panic(fmt.Sprintf("not support struct type %v", t))
+		panic(bugf("not support struct type %v", t))
 	}
 	return ret
 }
 func checkType(t reflect.Type, v reflect.Value) {
 	if t != v.Type() {
-		panic(fmt.Sprintf("want type '%v', got '%v'", t, v.Type()))
+		panic(bugf("want type '%v', got '%v'", t, v.Type()))
+	}
+}
+
+// fieldToBsonElem is valueToBsonElem for the value of struct field sf of
+// document id, sealing it when encrypted and keeping its offset when zoned.
+func (r *rest) fieldToBsonElem(id bson.ObjectId, sf reflect.StructField, v reflect.Value, t reflect.Type) interface{} {
+	if isEncrypted(sf) {
+		return r.sealElem(id, bsonKey(sf), plainBytes(v))
 	}
+	elem := r.valueToBsonElem(v, t)
+	if elem == nil {
+		return elem
+	} else if isZoned(sf) {
+		_, offset := reflect.Indirect(v).Interface().(time.Time).Zone()
+		return bson.D{{Name: "t", Value: elem}, {Name: "z", Value: offset}}
+	}
+	return elem
 }
 func (r *rest) valueToBsonElem(v reflect.Value, t reflect.Type) interface{} {
 	checkType(t, v)
@@ -1401,7 +2374,7 @@ func (r *rest) valueToBsonElem(v reflect.Value, t reflect.Type) interface{} {
 	case reflect.Ptr:
 		ret = r.valueToBsonElem(v.Elem(), t.Elem())
 	default:
-		panic(fmt.Sprintf("type not support: '%v'", t))
+		panic(bugf("type not support: '%v'", t))
 	}
 	return ret
 }
@@ -1411,49 +2384,52 @@ func (r *rest) structToBson(s interface{}) bson.M {
 	st := sv.Type()
 	base := getBase(sv)
 	if !base.loaded {
-		panic("struct not loaded")
+		panic(&Bug{Msg: "struct not loaded"})
 	}
 	if base.id != "" {
 		ret["_id"] = base.id
 		if base.mt.IsZero() {
-			panic("modifiy time not set")
+			panic(&Bug{Msg: "modifiy time not set"})
 		}
 		if base.ct.IsZero() {
-			panic("create time not set")
+			panic(&Bug{Msg: "create time not set"})
 		}
 		ret["mt"] = base.mt
 		ret["ct"] = base.ct
 	}
 	for i := 0; i < st.NumField(); i++ {
 		sf := st.Field(i)
-		key := strings.ToLower(sf.Name)
+		key := bsonKey(sf)
 		if sf.Anonymous && sf.Type == baseType {
 			continue
 		}
 		fv := sv.Field(i)
 		if sf.Type.Kind() == reflect.Ptr {
 			if !fv.IsNil() {
-				ret[key] = r.valueToBsonElem(fv.Elem(), sf.Type.Elem())
+				ret[key] = r.fieldToBsonElem(base.id, sf, fv.Elem(), sf.Type.Elem())
 			}
 		} else if sf.Type.Kind() == reflect.Slice {
-			if !fv.IsNil() {
-				ret[key] = r.valueToBsonElem(fv, sf.Type)
+			if !fv.IsNil() || isEncrypted(sf) {
+				ret[key] = r.fieldToBsonElem(base.id, sf, fv, sf.Type)
 			} else {
 				ret[key] = make([]interface{}, 0)
 			}
 		} else {
-			ret[key] = r.valueToBsonElem(fv, sf.Type)
+			ret[key] = r.fieldToBsonElem(base.id, sf, fv, sf.Type)
 		}
 
 	}
 	return ret
 
 }
-func (r *rest) mapElemToSlice(v reflect.Value, t reflect.Type, key string, baseURL *url.URL) (reflect.Value, error) {
+func (r *rest) mapElemToSlice(v reflect.Value, t reflect.Type, key string, baseURL *url.URL, depth int) (reflect.Value, error) {
+	if v.Kind() != reflect.Slice {
+		return reflect.Value{}, typeError(key, t, v.Type())
+	}
 	ret := reflect.MakeSlice(t, v.Len(), v.Len())
 	for i := 0; i < ret.Len(); i++ {
 		ki := fmt.Sprintf("%s[%d]", key, i)
-		val, err := r.mapElemToValue(v.Index(i), t.Elem(), ki, baseURL)
+		val, err := r.mapElemToValue(v.Index(i), t.Elem(), ki, baseURL, depth+1)
 		if err != nil {
 			return reflect.Value{}, err
 		}
@@ -1464,32 +2440,70 @@ func (r *rest) mapElemToSlice(v reflect.Value, t reflect.Type, key string, baseU
 	}
 	return ret, nil
 }
-func (r *rest) mapElemToBase(v reflect.Value, t reflect.Type, key string) (reflect.Value, error) {
+func (r *rest) mapElemToBase(v reflect.Value, t reflect.Type, key string, baseURL *url.URL) (reflect.Value, error) {
 	var ret reflect.Value
-	msg := fmt.Sprintf("field '%s' want {id: objectId}", key)
-	obj, ok := v.Interface().(map[string]interface{})
-	if !ok {
-		return ret, &Error{Code: BadRequest, Msg: msg}
-	}
-	idi, ok := obj["id"]
-	if !ok {
-		return ret, &Error{Code: BadRequest, Msg: msg}
+	var msg string
+	switch r.refShape {
+	case RefId:
+		msg = fmt.Sprintf("field '%s' want objectId or {id: objectId}", key)
+	case RefHref:
+		msg = fmt.Sprintf("field '%s' want href or {id: objectId}", key)
+	default:
+		msg = fmt.Sprintf("field '%s' want {id: objectId}", key)
 	}
-	hexId, ok := idi.(string)
-	if !ok {
+	hexId, ok := v.Interface().(string)
+	if ok && r.refShape == RefObject {
 		return ret, &Error{Code: BadRequest, Msg: msg}
+	} else if ok && r.refShape == RefHref {
+		var err error
+		if hexId, err = r.hrefToId(hexId, t, key, baseURL); err != nil {
+			return ret, err
+		}
+	} else if !ok {
+		obj, ok := v.Interface().(map[string]interface{})
+		if !ok {
+			return ret, &Error{Code: BadRequest, Msg: msg}
+		}
+		idi, ok := obj["id"]
+		if !ok {
+			return ret, &Error{Code: BadRequest, Msg: msg}
+		}
+		hexId, ok = idi.(string)
+		if !ok {
+			return ret, &Error{Code: BadRequest, Msg: msg}
+		}
 	}
 	id, err := parseObjectId(hexId)
 	if err != nil {
-		return ret, &Error{Code: BadRequest, Msg: "field '" + key + "'.id parse error", Err: err}
+		return ret, &Error{Code: BadRequest, Msg: "field '" + key + ".id' parse error", Err: err}
 	}
 	s, err := r.newWithObjectId(t, id)
 	if err != nil {
-		return ret, &Error{Code: BadRequest, Msg: "field '" + key + "'.id", Err: err}
+		return ret, &Error{Code: BadRequest, Msg: "field '" + key + ".id'", Err: err}
 	}
 	ret = reflect.ValueOf(s).Elem()
 	return ret, nil
 }
+
+// hrefToId returns the id segment of an href to the self resource of
+// type t, on baseURL's host when it names one.
+func (r *rest) hrefToId(href string, t reflect.Type, key string, baseURL *url.URL) (string, error) {
+	u, err := url.Parse(href)
+	if err != nil {
+		return "", &Error{Code: BadRequest, Msg: "field '" + key + "' parse error", Err: err}
+	}
+	msg := fmt.Sprintf("field '%s' want href of a '%s'", key, typeNameToQueryName(t.Name()))
+	if u.Host != "" && baseURL != nil && (u.Scheme != baseURL.Scheme || u.Host != baseURL.Host) {
+		return "", &Error{Code: BadRequest, Msg: msg}
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/")
+	u.RawPath = strings.TrimSuffix(u.RawPath, "/")
+	resId, err := ResIdFromURL(u)
+	if err != nil || resId.Name() != typeNameToQueryName(t.Name()) || resId.NumSegment() != 1 {
+		return "", &Error{Code: BadRequest, Msg: msg}
+	}
+	return resId.path[1], nil
+}
 func (r *rest) mapElemToURL(v reflect.Value, t reflect.Type, key string, baseURL *url.URL) (reflect.Value, error) {
 	var ret reflect.Value
 	s, ok := v.Interface().(string)
@@ -1509,13 +2523,9 @@ func (r *rest) mapElemToURL(v reflect.Value, t reflect.Type, key string, baseURL
 }
 func (r *rest) mapElemToTime(v reflect.Value, t reflect.Type, key string) (reflect.Value, error) {
 	var ret reflect.Value
-	s, ok := v.Interface().(string)
-	if !ok {
-		return ret, typeError(key, t, v.Type())
-	}
-	tm, err := time.Parse(time.RFC3339, s)
+	tm, err := r.parseTime(v.Interface(), key)
 	if err != nil {
-		return ret, &Error{Code: BadRequest, Msg: "field '" + key + "'", Err: err}
+		return ret, err
 	}
 	ret = reflect.ValueOf(&tm).Elem()
 	return ret, nil
@@ -1527,19 +2537,22 @@ func (r *rest) mapElemToGeo(v reflect.Value, t reflect.Type, key string) (reflec
 	if !ok {
 		return ret, &Error{Code: BadRequest, Msg: msg}
 	}
-	lon, lonOk := geomap["lon"].(float64)
-	lat, latOk := geomap["lat"].(float64)
+	lon, lonOk := toFloat(geomap["lon"])
+	lat, latOk := toFloat(geomap["lat"])
 	if !lonOk || !latOk {
 		return ret, &Error{Code: BadRequest, Msg: msg}
 	}
 	ret = reflect.ValueOf(&Geo{La: lat, Lo: lon}).Elem()
 	return ret, nil
 }
-func (r *rest) mapElemToStruct(v reflect.Value, t reflect.Type, key string, baseURL *url.URL) (reflect.Value, error) {
+func (r *rest) mapElemToStruct(v reflect.Value, t reflect.Type, key string, baseURL *url.URL, depth int) (reflect.Value, error) {
 	var ret reflect.Value
 	var err error = nil
+	if err = r.depthError(key, depth); err != nil {
+		return ret, err
+	}
 	if hasBase(t) {
-		ret, err = r.mapElemToBase(v, t, key)
+		ret, err = r.mapElemToBase(v, t, key, baseURL)
 	} else if t == urlType {
 		ret, err = r.mapElemToURL(v, t, key, baseURL)
 	} else if t == timeType {
@@ -1547,26 +2560,45 @@ func (r *rest) mapElemToStruct(v reflect.Value, t reflect.Type, key string, base
 	} else if t == geoType {
 		ret, err = r.mapElemToGeo(v, t, key)
 	} else {
-		panic(fmt.Sprintf("not support struct type %v", t))
+		panic(bugf("not support struct type %v", t))
 	}
 	return ret, err
 }
+func parseInt(s string, t, but reflect.Type, key string) (int64, error) {
+	i, err := strconv.ParseInt(s, 10, 64)
+	if e, ok := err.(*strconv.NumError); ok && e.Err == strconv.ErrRange {
+		return 0, overflowError(key, t)
+	} else if err != nil {
+		return 0, typeError(key, t, but)
+	}
+	return i, nil
+}
 func (r *rest) mapElemToInt(v reflect.Value, t reflect.Type, key string) (ret int64, err error) {
 	i := v.Interface()
 	switch val := i.(type) {
 	case int:
 		ret, err = int64(val), nil
+	case json.Number:
+		ret, err = parseInt(string(val), t, numberType, key)
+		if f, ferr := val.Float64(); err != nil && ferr == nil && f == math.Trunc(f) && math.Abs(f) <= maxSafeInt {
+			ret, err = int64(f), nil
+		}
+	case string:
+		ret, err = parseInt(val, t, stringType, key)
 	case float64:
 		n, frac := math.Modf(val)
 		if frac != 0.0 {
-			ret, err = 0, typeError(key, t, v.Type())
+			ret, err = 0, typeError(key, t, reflect.TypeOf(i))
+		} else if math.Abs(n) > maxSafeInt {
+			msg := fmt.Sprintf("field '%s' loses precision as a number, send it as a string", key)
+			ret, err = 0, &Error{Code: BadRequest, Msg: msg}
 		} else {
 			ret, err = int64(n), nil
 		}
 	case float32:
 		n, frac := math.Modf(float64(val))
 		if frac != 0.0 {
-			ret, err = 0, typeError(key, t, v.Type())
+			ret, err = 0, typeError(key, t, reflect.TypeOf(i))
 		} else {
 			ret, err = int64(n), nil
 		}
@@ -1579,32 +2611,142 @@ func (r *rest) mapElemToInt(v reflect.Value, t reflect.Type, key string) (ret in
 	case int64:
 		ret, err = int64(val), nil
 	default:
-		ret, err = 0, typeError(key, t, v.Type())
+		ret, err = 0, typeError(key, t, reflect.TypeOf(i))
 	}
 	return
 }
 
 func (r *rest) mapElemToFloat(v reflect.Value, t reflect.Type, key string) (ret float64, err error) {
-
-	switch val := v.Interface().(type) {
+	i := v.Interface()
+	ret, ok := toFloat(i)
+	if !ok {
+		return 0, typeError(key, t, reflect.TypeOf(i))
+	}
+	return ret, nil
+}
+func toFloat(i interface{}) (ret float64, ok bool) {
+	switch val := i.(type) {
 	case float64:
-		ret, err = val, nil
+		ret, ok = val, true
 	case float32:
-		ret, err = float64(val), nil
-	default:
-		ret, err = 0, typeError(key, t, v.Type())
+		ret, ok = float64(val), true
+	case json.Number:
+		f, err := val.Float64()
+		ret, ok = f, err == nil
 	}
 	return
 }
 
+const maxSafeInt = 1<<53 - 1
+
+var numberType = reflect.TypeOf(json.Number(""))
+var stringType = reflect.TypeOf("")
+
 func typeError(key string, want, but reflect.Type) error {
-	msg := fmt.Sprintf("field '%s' want type '%v' but '%v'", key, want, but)
+	var msg string
+	if but == numberType {
+		msg = fmt.Sprintf("field '%s' want type '%v' but 'number'", key, want)
+	} else {
+		msg = fmt.Sprintf("field '%s' want type '%v' but '%v'", key, want, but)
+	}
 	return &Error{Code: BadRequest, Msg: msg}
 }
+func overflowError(key string, t reflect.Type) error {
+	msg := fmt.Sprintf("field '%s' overflows type '%v'", key, t)
+	return &Error{Code: BadRequest, Msg: msg}
+}
+
+// Values of fields tagged `mogogo:"sensitive"` are masked in errors and
+// logs.
+const redacted = "***"
+
+func isSensitive(sf reflect.StructField) bool {
+	return hasTag(sf, "sensitive")
+}
+
+// redact masks the cause of err, which may quote the value of sf.
+func redact(sf reflect.StructField, err error) error {
+	e, ok := err.(*Error)
+	if !ok || !isSensitive(sf) || e.Err == nil {
+		return err
+	}
+	ret := *e
+	ret.Err = errors.New(redacted)
+	return &ret
+}
 
-func (r *rest) mapElemToValue(v reflect.Value, t reflect.Type, key string, baseURL *url.URL) (reflect.Value, error) {
+// redactSel copies sel with the values of typ's sensitive fields masked.
+func (r *rest) redactSel(typ string, sel interface{}) interface{} {
+	t, ok := r.types[typ]
+	if !ok {
+		return sel
+	}
+	var walk func(v interface{}) interface{}
+	walk = func(v interface{}) interface{} {
+		switch val := v.(type) {
+		case bson.M:
+			return bson.M(walk(map[string]interface{}(val)).(map[string]interface{}))
+		case M:
+			return M(walk(map[string]interface{}(val)).(map[string]interface{}))
+		case map[string]interface{}:
+			ret := make(map[string]interface{}, len(val))
+			for k, e := range val {
+				if sf, ok := fieldByBsonKey(t, k); ok && isSensitive(sf) {
+					ret[k] = redacted
+				} else {
+					ret[k] = walk(e)
+				}
+			}
+			return ret
+		case []interface{}:
+			ret := make([]interface{}, len(val))
+			for i, e := range val {
+				ret[i] = walk(e)
+			}
+			return ret
+		}
+		return v
+	}
+	return walk(sel)
+}
+
+func (r *rest) depthError(key string, depth int) error {
+	if depth > r.maxDepth {
+		msg := fmt.Sprintf("field '%s' nested too deep", key)
+		return &Error{Code: BadRequest, Msg: msg}
+	}
+	return nil
+}
+
+// mapElemToValue returns the zero value of t for a JSON null when t is
+// a pointer or slice, so a null differs from an absent key.
+func (r *rest) mapElemToValue(v reflect.Value, t reflect.Type, key string, baseURL *url.URL, depth int) (reflect.Value, error) {
 	var ret reflect.Value
 	var err error
+	if err = r.depthError(key, depth); err != nil {
+		return ret, err
+	}
+	if !v.IsValid() || (v.Kind() == reflect.Interface && v.IsNil()) {
+		if t.Kind() == reflect.Ptr || t.Kind() == reflect.Slice {
+			return reflect.Zero(t), nil
+		}
+		msg := fmt.Sprintf("field '%s' can not be null", key)
+		return ret, &Error{Code: BadRequest, Msg: msg}
+	}
+	if v.Kind() == reflect.Interface {
+		v = v.Elem()
+	}
+	if t == bytesType {
+		s, ok := v.Interface().(string)
+		if !ok {
+			return ret, typeError(key, reflect.TypeOf(""), v.Type())
+		}
+		b, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return ret, &Error{Code: BadRequest, Msg: fmt.Sprintf("field '%s' not base64", key), Err: err}
+		}
+		return reflect.ValueOf(b), nil
+	}
 	switch t.Kind() {
 	case reflect.String:
 		ret = reflect.New(t).Elem()
@@ -1626,20 +2768,26 @@ func (r *rest) mapElemToValue(v reflect.Value, t reflect.Type, key string, baseU
 		if err != nil {
 			return ret, err
 		}
-		ret.SetInt(int64(i))
+		if ret.OverflowInt(i) {
+			return ret, overflowError(key, t)
+		}
+		ret.SetInt(i)
 	case reflect.Float32, reflect.Float64:
 		ret = reflect.New(t).Elem()
 		f, err := r.mapElemToFloat(v, t, key)
 		if err != nil {
 			return ret, err
 		}
+		if ret.OverflowFloat(f) {
+			return ret, overflowError(key, t)
+		}
 		ret.SetFloat(f)
 	case reflect.Slice:
-		ret, err = r.mapElemToSlice(v, t, key, baseURL)
+		ret, err = r.mapElemToSlice(v, t, key, baseURL, depth)
 	case reflect.Struct:
-		ret, err = r.mapElemToStruct(v, t, key, baseURL)
+		ret, err = r.mapElemToStruct(v, t, key, baseURL, depth+1)
 	case reflect.Ptr:
-		ret, err = r.mapElemToValue(v, t.Elem(), key, baseURL)
+		ret, err = r.mapElemToValue(v, t.Elem(), key, baseURL, depth+1)
 		if err == nil {
 			ret = ret.Addr()
 		}
@@ -1649,6 +2797,9 @@ func (r *rest) mapElemToValue(v reflect.Value, t reflect.Type, key string, baseU
 	}
 	return ret, err
 }
+
+// mapToBase reads id, ct and mt. ct and mt may be left out, as a client
+// giving its own id to POST doesn't know them; writes set them anyway.
 func (r *rest) mapToBase(m map[string]interface{}, b *Base) error {
 	var err error
 	idi, ok := m["id"]
@@ -1662,27 +2813,15 @@ func (r *rest) mapToBase(m map[string]interface{}, b *Base) error {
 	if b.id, err = parseObjectId(id); err != nil {
 		return &Error{Code: BadRequest, Msg: "field 'id' parse error", Err: err}
 	}
-	cti, ok := m["ct"]
-	if !ok {
-		return &Error{Code: BadRequest, Msg: "field 'ct' not set"}
-	}
-	ct, ok := cti.(string)
-	if !ok {
-		return typeError("ct", reflect.TypeOf(""), reflect.TypeOf(cti))
-	}
-	if b.ct, err = time.Parse(time.RFC3339, ct); err != nil {
-		return &Error{Code: BadRequest, Msg: "field 'ct' parse error", Err: err}
-	}
-	mti, ok := m["mt"]
-	if !ok {
-		return &Error{Code: BadRequest, Msg: "field 'mt' not set"}
-	}
-	mt, ok := mti.(string)
-	if !ok {
-		return typeError("mt", reflect.TypeOf(""), reflect.TypeOf(mti))
+	if cti, ok := m["ct"]; ok {
+		if b.ct, err = r.parseTime(cti, "ct"); err != nil {
+			return err
+		}
 	}
-	if b.mt, err = time.Parse(time.RFC3339, mt); err != nil {
-		return &Error{Code: BadRequest, Msg: "field 'mt' parse error", Err: err}
+	if mti, ok := m["mt"]; ok {
+		if b.mt, err = r.parseTime(mti, "mt"); err != nil {
+			return err
+		}
 	}
 	b.r = r
 	return nil
@@ -1708,18 +2847,15 @@ func (r *rest) mapToStruct(m map[string]interface{}, s interface{}, baseURL *url
 		fv := v.Field(i)
 		var v reflect.Value
 		var err error = nil
-		key := strings.ToLower(sf.Name)
+		key := r.naming.fieldKey(sf)
 		elem, ok := m[key]
 		if sf.Type.Kind() == reflect.Ptr {
 			if ok {
-				v, err = r.mapElemToValue(reflect.ValueOf(elem), sf.Type.Elem(), key, baseURL)
-				if err == nil {
-					v = v.Addr()
-				}
+				v, err = r.mapElemToValue(reflect.ValueOf(elem), sf.Type, key, baseURL, 0)
 			}
 		} else if sf.Type.Kind() == reflect.Slice {
 			if ok {
-				v, err = r.mapElemToValue(reflect.ValueOf(elem), sf.Type, key, baseURL)
+				v, err = r.mapElemToValue(reflect.ValueOf(elem), sf.Type, key, baseURL, 0)
 			} else {
 				v = reflect.MakeSlice(sf.Type, 0, 0)
 			}
@@ -1728,17 +2864,19 @@ func (r *rest) mapToStruct(m map[string]interface{}, s interface{}, baseURL *url
 				msg := fmt.Sprintf("field '%s' not set", key)
 				err = &Error{Code: BadRequest, Msg: msg}
 			} else {
-				v, err = r.mapElemToValue(reflect.ValueOf(elem), sf.Type, key, baseURL)
+				v, err = r.mapElemToValue(reflect.ValueOf(elem), sf.Type, key, baseURL, 0)
 			}
 		}
 		if err != nil {
-			return err
+			return redact(sf, err)
 		}
 		if v.IsValid() {
 			verifiable, ok := v.Interface().(Verifiable)
-			if ok {
+			if ok && !(v.Kind() == reflect.Ptr && v.IsNil()) {
 				ok, msg := verifiable.Verify()
-				if !ok {
+				if !ok && isSensitive(sf) {
+					fieldsErr[sf.Name] = redacted
+				} else if !ok {
 					fieldsErr[sf.Name] = msg
 				}
 			}
@@ -1748,32 +2886,54 @@ func (r *rest) mapToStruct(m map[string]interface{}, s interface{}, baseURL *url
 	if base != nil {
 		base.loaded = true
 	}
+	if r.strict {
+		var virtual M
+		if v, ok := s.(Virtual); ok {
+			virtual = v.Virtual()
+		}
+		r.unknownKeys(m, t, base != nil, virtual, fieldsErr)
+	}
 	if len(fieldsErr) > 0 {
 		return &Error{Code: BadRequest, Fields: fieldsErr}
 	}
 	return nil
 }
-func (r *rest) mapToUpdaterSetOp(m map[string]interface{}, ret M, base *url.URL, t reflect.Type) error {
-	for k, v := range m {
-		fs, ok := t.FieldByNameFunc(func(name string) bool {
-			return unicode.IsUpper(rune(name[0])) && strings.ToLower(name) == k
-		})
-		if !ok {
-			return &Error{Code: BadRequest, Msg: fmt.Sprintf("field '%s' not in '%v'", k, t)}
-		}
-		retv, err := r.mapElemToValue(reflect.ValueOf(v), fs.Type, k, base)
+
+// unknownKeys lists keys of m matching no field of t. Echoed back base
+// and virtual fields are ignored.
+func (r *rest) unknownKeys(m map[string]interface{}, t reflect.Type, hasBase bool, virtual M, fieldsErr map[string]string) {
+	for k := range m {
+		if _, ok := virtual[k]; ok {
+			continue
+		}
+		if hasBase {
+			if _, ok := indexOf([]string{"id", "self", "type", "ct", "mt"}, k); ok {
+				continue
+			}
+		}
+		_, ok := r.field(t, k)
+		if !ok {
+			fieldsErr[k] = "unknown"
+		}
+	}
+}
+func (r *rest) mapToUpdaterSetOp(m map[string]interface{}, ret M, base *url.URL, t reflect.Type, op string) error {
+	for k, v := range m {
+		fs, ok := r.field(t, k)
+		if !ok {
+			return &Error{Code: BadRequest, Msg: fmt.Sprintf("field '%s' not in '%v'", k, t)}
+		}
+		retv, err := r.mapElemToValue(reflect.ValueOf(v), fs.Type, k, base, 0)
 		if err != nil {
-			return err
+			return redact(fs, err)
 		}
-		accMM(ret, "Set", fs.Name, retv.Interface())
+		accMM(ret, op, fs.Name, retv.Interface())
 	}
 	return nil
 }
 func (r *rest) mapToUpdaterAddOp(m map[string]interface{}, ret M, base *url.URL, t reflect.Type) error {
 	for k, v := range m {
-		fs, ok := t.FieldByNameFunc(func(name string) bool {
-			return unicode.IsUpper(rune(name[0])) && strings.ToLower(name) == k
-		})
+		fs, ok := r.field(t, k)
 		if !ok {
 			return &Error{Code: BadRequest, Msg: fmt.Sprintf("field '%s' not in '%v'", k, t)}
 		}
@@ -1783,15 +2943,15 @@ func (r *rest) mapToUpdaterAddOp(m map[string]interface{}, ret M, base *url.URL,
 		}
 		switch ft.Kind() {
 		case reflect.Slice:
-			retv, err := r.mapElemToValue(reflect.ValueOf(v), ft.Elem(), k, base)
+			retv, err := r.mapElemToValue(reflect.ValueOf(v), ft.Elem(), k, base, 0)
 			if err != nil {
-				return err
+				return redact(fs, err)
 			}
 			accMM(ret, "Add", fs.Name, retv.Interface())
 		default:
-			retv, err := r.mapElemToValue(reflect.ValueOf(v), fs.Type, k, base)
+			retv, err := r.mapElemToValue(reflect.ValueOf(v), fs.Type, k, base, 0)
 			if err != nil {
-				return err
+				return redact(fs, err)
 			}
 			accMM(ret, "Add", fs.Name, retv.Interface())
 		}
@@ -1808,7 +2968,12 @@ func (r *rest) mapToUpdater(mupdater map[string]interface{}, baseURL *url.URL, t
 		}
 		switch k {
 		case "set":
-			err := r.mapToUpdaterSetOp(m, ret, baseURL, t)
+			err := r.mapToUpdaterSetOp(m, ret, baseURL, t, "Set")
+			if err != nil {
+				return nil, err
+			}
+		case "if":
+			err := r.mapToUpdaterSetOp(m, ret, baseURL, t, "If")
 			if err != nil {
 				return nil, err
 			}
@@ -1823,28 +2988,151 @@ func (r *rest) mapToUpdater(mupdater map[string]interface{}, baseURL *url.URL, t
 	}
 	return M(ret), nil
 }
+func (r *rest) toMgoUpdaterSetOp(m M, ret map[string]interface{}, t reflect.Type, patchFields []string, fieldsErr map[string]string) {
+	for k, v := range m {
+		if _, ok := indexOf(patchFields, k); fieldsErr != nil && !ok {
+			fieldsErr[k] = "not_allowed"
+			continue
+		}
+		fs, ok := t.FieldByName(k)
+		if !ok && fieldsErr != nil {
+			fieldsErr[k] = "unknown"
+			continue
+		} else if !ok {
+			panic(bugf("field '%s' not in '%v'", k, t))
+		}
+		if isEncrypted(fs) {
+			if rv := reflect.Indirect(reflect.ValueOf(v)); rv.IsValid() {
+				accMapMap(ret, sealOp, bsonKey(fs), plainBytes(rv))
+			} else {
+				accMapMap(ret, "$set", bsonKey(fs), nil)
+			}
+			continue
+		}
+		accMapMap(ret, "$set", bsonKey(fs), r.fieldToBsonElem("", fs, reflect.ValueOf(v), fs.Type))
+	}
+}
+func (r *rest) toMgoUpdaterAddOp(m M, ret map[string]interface{}, t reflect.Type, patchFields []string, fieldsErr map[string]string) {
+	for k, v := range m {
+		if _, ok := indexOf(patchFields, k); !ok {
+			fieldsErr[k] = "not_allowed"
+			continue
+		}
+		fs, ok := t.FieldByName(k)
+		if !ok {
+			fieldsErr[k] = "unknown"
+			continue
+		}
+		ft := fs.Type
+		if ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		switch ft.Kind() {
+		case reflect.Slice:
+			accMapMap(ret, "$addToSet", bsonKey(fs), r.valueToBsonElem(reflect.ValueOf(v), ft.Elem()))
+		default:
+			accMapMap(ret, "$inc", bsonKey(fs), r.valueToBsonElem(reflect.ValueOf(v), ft))
+		}
+	}
+}
+
+// toMgoUpdater reports unknown fields and fields outside patchFields as
+// a BadRequest with Fields, like mapToStruct does for invalid values.
+func (r *rest) toMgoUpdater(updater M, t reflect.Type, patchFields []string) (ret map[string]interface{}, err error) {
+	ret = make(map[string]interface{})
+	fieldsErr := make(map[string]string)
+	for k, v := range updater {
+		m, ok := v.(M)
+		if !ok {
+			msg := fmt.Sprintf("op '%s' want object, got '%v'", k, reflect.TypeOf(v))
+			return nil, &Error{Code: BadRequest, Msg: msg}
+		}
+		switch k {
+		case "Set":
+			r.toMgoUpdaterSetOp(m, ret, t, patchFields, fieldsErr)
+		case "Add":
+			r.toMgoUpdaterAddOp(m, ret, t, patchFields, fieldsErr)
+		case "If":
+			for f := range m {
+				if sf, ok := t.FieldByName(f); !ok {
+					fieldsErr[f] = "unknown"
+				} else if isEncrypted(sf) {
+					fieldsErr[f] = "encrypted"
+				}
+			}
+		default:
+			return nil, &Error{Code: BadRequest, Msg: fmt.Sprintf("unknown op '%s'", k)}
+		}
+	}
+	if len(fieldsErr) > 0 {
+		return nil, &Error{Code: BadRequest, Fields: fieldsErr}
+	}
+	accMapMap(ret, "$set", "mt", bson.Now().UTC())
+	return ret, nil
+}
+
+// toMgoPrecondition narrows sel by the fields an updater's If op requires
+// to still hold; ok is false without one. As updaters always set mt, a
+// document the result selects is updated, so none updated means the
+// precondition failed.
+func (r *rest) toMgoPrecondition(sel bson.M, updater M, t reflect.Type) (ret bson.M, ok bool) {
+	cond, ok := updater["If"].(M)
+	if !ok {
+		return sel, false
+	}
+	ifSel := make(bson.M)
+	for k, v := range cond {
+		fs, ok := t.FieldByName(k)
+		if !ok {
+			panic(bugf("field '%s' not in '%v'", k, t))
+		}
+		ifSel[bsonKey(fs)] = r.fieldToBsonElem("", fs, reflect.ValueOf(v), fs.Type)
+	}
+	return bson.M{"$and": []interface{}{sel, ifSel}}, true
+}
 func (r *rest) checkSegmentsType(typ string, segmentRef []interface{}, res string) {
+	fieldsType := r.segmentRefToPathSegmentTypes(r.types[typ], segmentRef)
 	segsType := r.queries[res].PathSegmentTypes
 	if len(segsType) != len(segmentRef) {
 		msg := fmt.Sprintf("fields len is %d but path segments len is %d", len(segmentRef), len(segsType))
-		panic(msg)
+		panic(&Bug{Msg: msg})
 	}
-	fieldsType := r.segmentRefToPathSegmentTypes(r.types[typ], segmentRef)
 	for i, t := range fieldsType {
 		st := segsType[i]
 		if t != st {
 			msg := fmt.Sprintf("type not match (%s and %s) at index %d", t, st, i)
-			panic(msg)
+			panic(&Bug{Msg: msg})
 		}
 	}
 
 }
 func (r *rest) Bind(name string, typ string, res string, segmentRef []interface{}) {
+	r.BindParams(name, typ, res, segmentRef, nil)
+}
+
+// BindParams binds like Bind, with params as the default query of the
+// relation, e.g. a sort or a page size.
+func (r *rest) BindParams(name string, typ string, res string, segmentRef []interface{}, params Params) {
 	r.checkType(typ)
 	r.checkQuery(res)
 	r.checkSegmentsType(typ, segmentRef, res)
+	r.addBind(name, typ, &bind{res, segmentRef, params, nil})
+	r.reverseBind(name, typ, segmentRef)
+}
+
+// BindFunc binds a relation computed by rel from the document, for
+// relations no field maps to, e.g. a handler keyed on the id alone.
+func (r *rest) BindFunc(name string, typ string, rel func(self interface{}) *ResId) {
+	r.checkType(typ)
+	r.checkHasBase(typ)
+	if rel == nil {
+		panic(&Bug{Msg: "rel is nil"})
+	}
+	r.addBind(name, typ, &bind{fn: rel})
+}
+func (r *rest) addBind(name string, typ string, b *bind) {
 	if name == "" {
-		panic("name is empty")
+		panic(&Bug{Msg: "name is empty"})
 	}
 	bt, ok := r.binds[typ]
 	if !ok {
@@ -1852,14 +3140,79 @@ func (r *rest) Bind(name string, typ string, res string, segmentRef []interface{
 		r.binds[typ] = bt
 	}
 	if _, ok = bt[name]; ok {
-		panic(fmt.Sprintf("'%s' already bind", name))
+		panic(bugf("'%s' already bind", name))
+	}
+	bt[name] = b
+}
+func (r *rest) HasMany(parentType string, childType string, field string) {
+	r.checkType(parentType)
+	r.checkType(childType)
+	r.checkHasBase(parentType)
+	sf, ok := r.types[childType].FieldByName(field)
+	if !ok {
+		panic(bugf("field '%s' not in '%s'", field, childType))
+	}
+	ft := sf.Type
+	if ft.Kind() == reflect.Ptr {
+		ft = ft.Elem()
+	}
+	if ft != r.types[parentType] {
+		panic(bugf("field '%s.%s' want type '%s', got '%v'", childType, field, parentType, ft))
+	}
+	name := typeNameToQueryName(parentType) + "-" + strings.ToLower(childType)
+	r.queueIndex(name, childType, I{Fields: []string{field, "Id"}})
+	r.DefRes(name, SelectorResource{
+		Type: childType,
+		SelectorFunc: func(req *Req, ctx *Context) (M, error) {
+			parent, err := req.Segment(0)
+			if err != nil {
+				return nil, err
+			}
+			return M{field: parent}, nil
+		},
+		SortFields:       []string{"-Id"},
+		PathSegmentTypes: []string{parentType},
+	})
+	r.Bind(strings.ToLower(childType), parentType, name, []interface{}{F("Id")})
+}
+func (r *rest) reverseBind(name string, typ string, segmentRef []interface{}) {
+	t := r.types[typ]
+	for _, ref := range segmentRef {
+		f, ok := ref.(F)
+		if !ok || f == "Id" || f == "CT" || f == "MT" {
+			continue
+		}
+		sf, _ := t.FieldByName(string(f))
+		ft := sf.Type
+		if ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		if ft.Kind() == reflect.Struct && hasBase(ft) {
+			r.rbinds[ft.Name()] = append(r.rbinds[ft.Name()], &rbind{typ, name, string(f)})
+		}
+	}
+}
+func (r *rest) collectionRes(typ string, field string) (name string, ok bool) {
+	names := make([]string, 0)
+	for k, cq := range r.queries {
+		h, isFQ := cq.Handler.(*fqHandler)
+		if !isFQ || h.fq.Type != typ || h.fq.Unique || h.fq.Allow&GET == 0 {
+			continue
+		}
+		if len(h.fq.Fields) == 1 && h.fq.Fields[0] == field {
+			names = append(names, k)
+		}
 	}
-	bt[name] = &bind{res, segmentRef}
+	if len(names) == 0 {
+		return "", false
+	}
+	sort.Strings(names)
+	return names[0], true
 }
 func (r *rest) registerQuery(name string, cq CustomResource) {
 	checkQueryName(name)
 	if _, ok := r.queries[name]; ok {
-		panic(fmt.Sprintf("resource '%s' already defined", name))
+		panic(bugf("resource '%s' already defined", name))
 	}
 	r.queries[name] = &cq
 }
@@ -1870,7 +3223,7 @@ func (r *rest) typeDefined(typ string) bool {
 func (r *rest) checkType(typ string) {
 	if !r.typeDefined(typ) {
 		f := "'%s' not defined"
-		panic(fmt.Sprintf(f, typ))
+		panic(bugf(f, typ))
 	}
 }
 func (r *rest) typeByName(name string) reflect.Type {
@@ -1880,32 +3233,93 @@ func (r *rest) typeByName(name string) reflect.Type {
 func (r *rest) checkQuery(query string) {
 	if _, ok := r.queries[query]; !ok {
 		f := "'%s' not defined"
-		panic(fmt.Sprintf(f, query))
+		panic(bugf(f, query))
 	}
 }
+
+// TypeOptions tunes DefTypeWithOptions.
+//
+// NoSelf skips the GET resource a Base type gets at its lowercased name,
+// for value objects never fetched by id. Self and the "self" href of
+// responses still name that resource, so they 404; so do Rel and
+// ReverseRels links to the type.
+type TypeOptions struct {
+	NoSelf bool
+}
+
 func (r *rest) DefType(def interface{}) {
+	r.DefTypeWithOptions(def, TypeOptions{})
+}
+func (r *rest) DefTypeWithOptions(def interface{}, opts TypeOptions) {
 	typ := reflect.TypeOf(def)
 	if typ.Kind() != reflect.Struct {
-		panic("only struct type allowed")
+		panic(&Bug{Msg: "only struct type allowed"})
 	}
 	name := typ.Name()
 	if _, ok := r.types[name]; ok {
-		panic(fmt.Sprintf("type '%s' already defined", name))
+		panic(bugf("type '%s' already defined", name))
 	}
 	checkQueryName(strings.ToLower(name))
+	keyedFieldNames(typ, bsonKey)
+	r.fields[typ] = keyedFieldNames(typ, r.naming.fieldKey)
+	r.checkEncrypted(typ)
+	checkZoned(typ)
+	checkTags(typ)
+	r.checkVirtual(typ)
 	r.types[name] = typ
-	if hasBase(typ) {
+	if hasBase(typ) && !opts.NoSelf {
 		r.defSelf(name)
 	}
 }
+
+// keyedFieldNames maps the keys key gives t's exported fields to the field
+// names, panicking when two fields share a key.
+func keyedFieldNames(t reflect.Type, key func(reflect.StructField) string) map[string]string {
+	ret := make(map[string]string)
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if sf.Anonymous && sf.Type == baseType || !unicode.IsUpper(rune(sf.Name[0])) {
+			continue
+		}
+		key := key(sf)
+		if other, ok := ret[key]; ok {
+			panic(bugf("type '%s' fields '%s' and '%s' collide as '%s'", t.Name(), other, sf.Name, key))
+		}
+		ret[key] = sf.Name
+	}
+	return ret
+}
+func (r *rest) fieldNames(t reflect.Type) map[string]string {
+	if names, ok := r.fields[t]; ok {
+		return names
+	}
+	return keyedFieldNames(t, r.naming.fieldKey)
+}
+func (r *rest) field(t reflect.Type, key string) (sf reflect.StructField, ok bool) {
+	name, ok := r.fieldNames(t)[key]
+	if !ok {
+		return
+	}
+	return t.FieldByName(name)
+}
 func (r *rest) defSelf(typ string) {
 	r.checkType(typ)
-	r.DefRes(typeNameToQueryName(typ), FieldResource{
+	name := typeNameToQueryName(typ)
+	r.DefRes(name, FieldResource{
 		Type:   typ,
 		Fields: []string{"Id"},
 		Allow:  GET,
 		Unique: true,
 	})
+	r.queueIndex(name, typ, I{Fields: []string{"MT"}})
+}
+func (r *rest) DefSort(typ string, sortFields []string) {
+	r.checkType(typ)
+	if len(sortFields) == 0 {
+		panic(&Bug{Msg: "sortFields is empty"})
+	}
+	r.fieldsToKeys(r.types[typ], sortFields)
+	r.sorts[typ] = sortFields
 }
 func (r *rest) DefRes(name string, resource interface{}) {
 	switch res := resource.(type) {
@@ -1915,10 +3329,12 @@ func (r *rest) DefRes(name string, resource interface{}) {
 		r.defSelectorResource(name, res)
 	case ImageResource:
 		r.defImageResource(name, res)
+	case FileResource:
+		r.defFileResource(name, res)
 	case CustomResource:
 		r.defCustomResource(name, res)
 	default:
-		panic(fmt.Sprintf("unknown resource type: %v", reflect.TypeOf(resource)))
+		panic(bugf("unknown resource type: %v", reflect.TypeOf(resource)))
 	}
 }
 
@@ -1934,7 +3350,7 @@ func setFieldValue(sv reflect.Value, f string, v reflect.Value) error {
 	if f != "Id" {
 		fv := sv.FieldByName(f)
 		if !fv.IsValid() {
-			panic(fmt.Sprintf("field '%s' not in '%s'", f, sv.Type().Name()))
+			panic(bugf("field '%s' not in '%s'", f, sv.Type().Name()))
 		}
 		if fv.Kind() == reflect.Ptr {
 			if v.Kind() == reflect.Ptr {
@@ -1976,12 +3392,11 @@ func (h *fqHandler) setStructFields(s interface{}, req *Req, ctx *Context) error
 	}
 	if h.fq.ContextRef != nil {
 		for f, ctxkey := range h.fq.ContextRef {
-			c, ok := ctx.Get(ctxkey)
-			if !ok {
-				msg := fmt.Sprintf("'%s' not in Context", ctxkey)
-				return &Error{Code: Unauthorized, Msg: msg}
+			c, err := h.contextRef(ctx, f, ctxkey)
+			if err != nil {
+				return err
 			}
-			err := setFieldValue(sv, f, reflect.ValueOf(c))
+			err = setFieldValue(sv, f, c)
 			if err != nil {
 				return err
 			}
@@ -1989,13 +3404,61 @@ func (h *fqHandler) setStructFields(s interface{}, req *Req, ctx *Context) error
 	}
 	return nil
 }
-func setBsonValue(b bson.M, f string, v reflect.Value) {
+
+// contextRef is the Context value ctxkey names, checked to fit field f so
+// a misconfigured Context fails with an Error rather than a reflect panic.
+func (h *fqHandler) contextRef(ctx *Context, f string, ctxkey string) (reflect.Value, error) {
+	c, err := ctx.ref(ctxkey)
+	if err != nil {
+		return c, err
+	}
+	ct := c.Type()
+	if ct.Kind() == reflect.Ptr {
+		ct = ct.Elem()
+	}
+	var ok bool
+	var want string
+	if f == "Id" {
+		ok, want = ct.Kind() == reflect.Struct && hasBase(ct), "a Base struct"
+	} else {
+		sf, _ := h.r.types[h.fq.Type].FieldByName(f)
+		ft := sf.Type
+		if ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		ok, want = ct.AssignableTo(ft), ft.String()
+	}
+	if !ok {
+		msg := fmt.Sprintf("context '%s' is %v, field '%s' wants %s", ctxkey, ct, f, want)
+		return reflect.Value{}, &Error{Code: InternalServerError, Msg: msg}
+	}
+	return c, nil
+}
+func (r *rest) setBsonValue(b bson.M, t reflect.Type, f string, v reflect.Value) {
+	if vals, ok := v.Interface().([]interface{}); ok {
+		in := make([]interface{}, len(vals))
+		for i, val := range vals {
+			elem := make(bson.M)
+			r.setBsonValue(elem, t, f, reflect.ValueOf(val))
+			for _, e := range elem {
+				in[i] = e
+			}
+		}
+		key := "_id"
+		if f != "Id" {
+			key = fieldBsonKey(t, f)
+		}
+		b[key] = bson.M{"$in": in}
+		return
+	}
 	if f != "Id" {
 		if v.Kind() == reflect.Ptr {
 			v = v.Elem()
 		}
-		f = strings.ToLower(f)
-		if v.Kind() != reflect.Struct {
+		f = fieldBsonKey(t, f)
+		if v.Type() == timeType {
+			b[f] = r.timeToBsonElem(v.Interface().(time.Time))
+		} else if v.Kind() != reflect.Struct {
 			b[f] = v.Interface()
 		} else {
 			b[f] = getBase(v).id
@@ -2013,22 +3476,40 @@ func (h *fqHandler) query(req *Req, ctx *Context) (bson.M, error) {
 				return nil, err
 			}
 			segv := reflect.ValueOf(seg)
-			setBsonValue(ret, f, segv)
+			h.r.setBsonValue(ret, h.r.types[h.fq.Type], f, segv)
 		}
 	}
 	if h.fq.ContextRef != nil {
 		for f, ctxkey := range h.fq.ContextRef {
-			c, ok := ctx.Get(ctxkey)
-			if !ok {
-				msg := fmt.Sprintf("'%s' not in Context", ctxkey)
-				return nil, &Error{Code: Unauthorized, Msg: msg}
+			c, err := h.contextRef(ctx, f, ctxkey)
+			if err != nil {
+				return nil, err
+			}
+			h.r.setBsonValue(ret, h.r.types[h.fq.Type], f, c)
+		}
+	}
+	if !h.fq.Unique {
+		from, err := parseParamTime(req.ResId.Params, "from")
+		if err != nil {
+			return nil, err
+		}
+		to, err := parseParamTime(req.ResId.Params, "to")
+		if err != nil {
+			return nil, err
+		}
+		if r := idRange(from, to); len(r) > 0 {
+			if in, ok := ret["_id"].(bson.M); ok {
+				for k, v := range r {
+					in[k] = v
+				}
+			} else {
+				ret["_id"] = r
 			}
-			setBsonValue(ret, f, reflect.ValueOf(c))
 		}
 	}
 	return ret, nil
 }
-func (h *fqHandler) ensureIndex() {
+func (h *fqHandler) ensureIndex(name string) {
 	fields := make([]string, 0)
 	if h.fq.Fields != nil {
 		fields = append(fields, h.fq.Fields...)
@@ -2045,19 +3526,40 @@ func (h *fqHandler) ensureIndex() {
 	}
 	if !h.fq.Unique {
 		if h.fq.Pull && h.fq.SortFields != nil {
-			panic("pull and sort fields")
+			panic(&Bug{Msg: "pull and sort fields"})
 		}
-		if h.fq.SortFields == nil {
-			fields = append(fields, "Id")
-		} else {
-			fields = append(fields, h.fq.SortFields...)
+		sortFields := []string{"Id"}
+		if _, ok := h.r.sorts[h.fq.Type]; h.fq.SortFields != nil || !h.fq.Pull && ok {
+			sortFields = h.sortFields()
+		}
+		for _, f := range sortFields {
+			if _, ok := indexOf(fields, strings.TrimLeft(f, "-@")); !ok {
+				fields = append(fields, f)
+			}
 		}
 	}
 	if len(fields) > 0 {
 		idx := I{Fields: fields, Unique: h.fq.Unique}
-		h.r.Index(h.fq.Type, idx)
+		h.r.queueIndex(name, h.fq.Type, idx)
+	}
+	if h.fq.ExpireAfter > 0 {
+		idx := I{Fields: []string{h.fq.ExpireField}, ExpireAfter: h.fq.ExpireAfter}
+		h.r.queueIndex(name, h.fq.Type, idx)
 	}
 }
+func (h *fqHandler) sortFields() []string {
+	sortFields := make([]string, 0)
+	if h.fq.SortFields != nil {
+		sortFields = append(sortFields, h.fq.SortFields...)
+	} else if h.fq.Pull {
+		sortFields = append(sortFields, "Id")
+	} else if def, ok := h.r.sorts[h.fq.Type]; ok {
+		sortFields = append(sortFields, def...)
+	} else {
+		sortFields = append(sortFields, "-Id")
+	}
+	return sortFields
+}
 func (h *fqHandler) coll(ctx *Context) *mgo.Collection {
 	return ctx.coll(h.fq.Type)
 }
@@ -2071,7 +3573,9 @@ func (h *fqHandler) Get(req *Req, ctx *Context) (result interface{}, err error)
 	}
 	b := make(bson.M)
 	if h.fq.Unique {
+		done := h.r.timeOp("find", h.fq.Type, q)
 		err = h.coll(ctx).Find(q).One(b)
+		done()
 		if err == nil {
 			s := h.r.newStruct(h.fq.Type)
 			h.r.bsonToStruct(b, s)
@@ -2079,23 +3583,14 @@ func (h *fqHandler) Get(req *Req, ctx *Context) (result interface{}, err error)
 		} else if err == mgo.ErrNotFound {
 			result, err = nil, &Error{Code: NotFound}
 		} else {
-			panic(&Error{Code: InternalServerError, Err: err})
+			return nil, mgoError(err)
 		}
 	} else {
-		sortFields := make([]string, 0)
-		if h.fq.SortFields == nil {
-			if !h.fq.Pull {
-				sortFields = append(sortFields, "-Id")
-			} else {
-				sortFields = append(sortFields, "Id")
-			}
-		} else {
-			sortFields = append(sortFields, h.fq.SortFields...)
-		}
+		sortFields := h.sortFields()
 		si := &selectorIter{
 			r:          h.r,
 			typ:        h.r.types[h.fq.Type],
-			sortFields: h.r.fieldsToKeys(h.r.types[h.fq.Type], sortFields),
+			sortFields: h.r.sortKeys(h.r.types[h.fq.Type], sortFields),
 			hasCount:   h.fq.Count,
 			limit:      h.fq.Limit,
 			pull:       h.fq.Pull,
@@ -2110,7 +3605,10 @@ func (h *fqHandler) Get(req *Req, ctx *Context) (result interface{}, err error)
 				return nil, err
 			}
 			if last {
-				si.lastId = si.getLastId()
+				si.lastId, err = si.getLastId()
+				if err != nil {
+					return nil, err
+				}
 			}
 		}
 		result = si
@@ -2118,7 +3616,7 @@ func (h *fqHandler) Get(req *Req, ctx *Context) (result interface{}, err error)
 	return
 }
 func (h *fqHandler) Put(req *Req, ctx *Context) (result interface{}, err error) {
-	if h.fq.Allow&PUT == 0 {
+	if h.fq.Allow&PUT == 0 || !h.fq.Unique && !h.fq.Replace {
 		return nil, &Error{Code: MethodNotAllowed}
 	}
 	q, err := h.query(req, ctx)
@@ -2127,8 +3625,16 @@ func (h *fqHandler) Put(req *Req, ctx *Context) (result interface{}, err error)
 	}
 	body := req.Body
 	err = h.setStructFields(body, req, ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !h.fq.Unique {
+		return h.replace(q, body, ctx)
+	}
 	old := make(bson.M)
+	done := h.r.timeOp("find", h.fq.Type, q)
 	err = h.coll(ctx).Find(q).One(old)
+	done()
 	if err == mgo.ErrNotFound {
 		base := getBase(reflect.ValueOf(body).Elem())
 		if base.id == "" {
@@ -2142,14 +3648,15 @@ func (h *fqHandler) Put(req *Req, ctx *Context) (result interface{}, err error)
 		base.self = body
 		base.t = h.fq.Type
 		b := h.r.structToBson(body)
+		done := h.r.timeOp("insert", h.fq.Type, nil)
 		err = h.coll(ctx).Insert(b)
+		done()
 		if err != nil {
-			lasterr := err.(*mgo.LastError)
-			if lasterr.Code == 11000 {
-				return nil, &Error{Code: Conflict}
-			} else {
-				panic(&Error{Code: InternalServerError, Err: err})
-			}
+			return nil, mgoError(err)
+		}
+		err = afterInsert(body, ctx)
+		if err != nil {
+			return nil, err
 		}
 	} else if err == nil {
 		base := getBase(reflect.ValueOf(body).Elem())
@@ -2157,25 +3664,140 @@ func (h *fqHandler) Put(req *Req, ctx *Context) (result interface{}, err error)
 		base.mt = bson.Now().UTC()
 		base.ct = old["ct"].(time.Time)
 		base.loaded = true
+		base.isNew = false
 		base.r = h.r
 		base.self = body
 		base.t = h.fq.Type
 		b := h.r.structToBson(body)
+		done := h.r.timeOp("upsert", h.fq.Type, bson.M{"_id": base.id})
 		_, err = h.coll(ctx).UpsertId(base.id, b)
+		done()
 		if err != nil {
-			lasterr := err.(*mgo.LastError)
-			if lasterr.Code == 11000 {
-				return nil, &Error{Code: Conflict}
-			} else {
-				return nil, &Error{Code: InternalServerError, Err: err}
-			}
+			return nil, mgoError(err)
 		}
 
 	} else {
-		panic(Error{Code: InternalServerError, Err: err})
+		return nil, mgoError(err)
+	}
+	return body, nil
+}
+func (h *fqHandler) replace(q bson.M, body interface{}, ctx *Context) (result interface{}, err error) {
+	base := getBase(reflect.ValueOf(body).Elem())
+	base.id = bson.NewObjectId()
+	base.mt = bson.Now().UTC()
+	base.ct = base.mt
+	base.loaded = true
+	base.isNew = true
+	base.r = h.r
+	base.self = body
+	base.t = h.fq.Type
+	done := h.r.timeOp("insert", h.fq.Type, nil)
+	err = h.coll(ctx).Insert(h.r.structToBson(body))
+	done()
+	if err != nil {
+		return nil, mgoError(err)
+	}
+	others := bson.M{"$and": []interface{}{q, bson.M{"_id": bson.M{"$ne": base.id}}}}
+	done = h.r.timeOp("remove", h.fq.Type, others)
+	_, err = h.coll(ctx).RemoveAll(others)
+	done()
+	if err != nil {
+		return nil, mgoError(err)
+	}
+	if err = afterInsert(body, ctx); err != nil {
+		return nil, err
 	}
 	return body, nil
 }
+func (h *fqHandler) PutMany(req *Req, ctx *Context) (result *SyncResult, err error) {
+	if h.fq.Allow&PUT == 0 || !h.fq.Sync {
+		return nil, &Error{Code: MethodNotAllowed}
+	}
+	bodies := req.Body.([]interface{})
+	result = &SyncResult{Conflicts: []int{}, Items: make([]ItemStatus, len(bodies))}
+	ids := make([]bson.ObjectId, 0, len(bodies))
+	for i, body := range bodies {
+		if e, ok := body.(*Error); ok {
+			result.Items[i].Err = e
+			continue
+		}
+		err = h.setStructFields(body, req, ctx)
+		if e, ok := err.(*Error); ok {
+			result.Items[i].Err = e
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if id := getBase(reflect.ValueOf(body).Elem()).id; id != "" {
+			ids = append(ids, id)
+		}
+	}
+	// an id outside the path's and context's scope matches nothing here,
+	// so its upsert inserts a duplicate _id and the item is a Conflict
+	q, err := h.query(req, ctx)
+	if err != nil {
+		return nil, err
+	}
+	inScope := func(sel bson.M) bson.M {
+		return bson.M{"$and": []interface{}{q, sel}}
+	}
+	cts := make(map[bson.ObjectId]time.Time)
+	var old bson.M
+	iter := h.coll(ctx).Find(inScope(bson.M{"_id": bson.M{"$in": ids}})).Select(bson.M{"ct": 1}).Iter()
+	for iter.Next(&old) {
+		cts[old["_id"].(bson.ObjectId)] = old["ct"].(time.Time)
+	}
+	if err = iter.Close(); err != nil {
+		return nil, mgoError(err)
+	}
+	now := bson.Now().UTC()
+	for i, body := range bodies {
+		if result.Items[i].Err != nil {
+			continue
+		}
+		base := getBase(reflect.ValueOf(body).Elem())
+		if base.id == "" {
+			base.id = bson.NewObjectId()
+		}
+		ct, ok := cts[base.id]
+		if !ok {
+			ct = now
+		}
+		base.mt = now
+		base.ct = ct
+		base.loaded = true
+		base.isNew = !ok
+		base.r = h.r
+		base.self = body
+		base.t = h.fq.Type
+		sel := inScope(bson.M{"_id": base.id})
+		done := h.r.timeOp("upsert", h.fq.Type, sel)
+		_, err = h.coll(ctx).Upsert(sel, h.r.structToBson(body))
+		done()
+		if mgo.IsDup(err) {
+			result.Items[i].Err = &Error{Code: Conflict, Err: err}
+			result.Conflicts = append(result.Conflicts, i)
+		} else if err != nil {
+			result.Items[i].Err = &Error{Code: InternalServerError, Err: err}
+		}
+	}
+	for i, body := range bodies {
+		item := &result.Items[i]
+		if item.Err != nil {
+			item.Status = int(item.Err.Code)
+		} else if !getBase(reflect.ValueOf(body).Elem()).isNew {
+			item.Status = 200
+			result.Modified++
+		} else {
+			item.Status = 201
+			result.Inserted++
+			if err = afterInsert(body, ctx); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return result, nil
+}
 func (h *fqHandler) Delete(req *Req, ctx *Context) (result interface{}, err error) {
 	if h.fq.Allow&DELETE == 0 {
 		return nil, &Error{Code: MethodNotAllowed}
@@ -2185,21 +3807,20 @@ func (h *fqHandler) Delete(req *Req, ctx *Context) (result interface{}, err erro
 		return nil, err
 	}
 	if h.fq.UpdateWhenDelete == nil {
+		done := h.r.timeOp("remove", h.fq.Type, q)
 		_, err = h.coll(ctx).RemoveAll(q)
+		done()
 		if err != nil {
-			panic(&Error{Code: InternalServerError, Err: err})
+			return nil, mgoError(err)
 		}
 	} else {
 		updater := make(map[string]interface{})
-		h.toMgoUpdaterSetOp(h.fq.UpdateWhenDelete, updater, false)
-		_, err = h.coll(ctx).UpdateAll(q, updater)
+		h.toMgoUpdaterSetOp(h.fq.UpdateWhenDelete, updater)
+		done := h.r.timeOp("update", h.fq.Type, q)
+		_, err = h.r.updateAll(h.coll(ctx), q, updater)
+		done()
 		if err != nil {
-			lasterr := err.(*mgo.LastError)
-			if lasterr.Code == 11000 {
-				return nil, &Error{Code: Conflict}
-			} else {
-				return nil, &Error{Code: InternalServerError, Err: err}
-			}
+			return nil, mgoError(err)
 		}
 	}
 	return nil, nil
@@ -2213,84 +3834,48 @@ func (h *fqHandler) Post(req *Req, ctx *Context) (result interface{}, err error)
 	if err != nil {
 		return nil, err
 	}
+	err = h.r.insert(h.fq.Type, body, ctx, h.fq.AllowClientId)
+	if err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+func (r *rest) insert(typ string, body interface{}, ctx *Context, clientId bool) error {
 	base := getBase(reflect.ValueOf(body).Elem())
-	base.id = bson.NewObjectId()
+	if !clientId || base.id == "" {
+		base.id = bson.NewObjectId()
+	}
 	base.mt = bson.Now().UTC()
 	base.ct = base.mt
 	base.loaded = true
 	base.isNew = true
-	base.r = h.r
+	base.r = r
 	base.self = body
-	base.t = h.fq.Type
-	b := h.r.structToBson(body)
-	err = h.coll(ctx).Insert(b)
+	base.t = typ
+	b := r.structToBson(body)
+	done := r.timeOp("insert", typ, nil)
+	err := ctx.coll(typ).Insert(b)
+	done()
 	if err != nil {
-		lasterr := err.(*mgo.LastError)
-		if lasterr.Code == 11000 {
-			return nil, &Error{Code: Conflict}
-		} else {
-			panic(&Error{Code: InternalServerError, Err: err})
-		}
+		return mgoError(err)
 	}
-	if h.r.pull[h.fq.Type] {
-		b["$type"] = h.fq.Type
-		h.r.mc.Broadcast(b)
+	if r.pull[typ] {
+		b["$type"] = typ
+		r.mc.Broadcast(b)
 	}
-	return body, nil
+	return afterInsert(body, ctx)
 }
-func (h *fqHandler) toMgoUpdaterSetOp(m M, ret map[string]interface{}, checkPatchFields bool) {
-	t := h.r.types[h.fq.Type]
-	for k, v := range m {
-		if _, ok := indexOf(h.fq.PatchFields, k); checkPatchFields && !ok {
-			panic(fmt.Sprintf("field '%s' not allow", k))
-		}
-		fs, ok := t.FieldByName(k)
-		if !ok {
-			panic(fmt.Sprintf("field '%s' not in '%v'", k, t))
-		}
-		accMapMap(ret, "$set", strings.ToLower(k), h.r.valueToBsonElem(reflect.ValueOf(v), fs.Type))
+func afterInsert(body interface{}, ctx *Context) error {
+	if ai, ok := body.(AfterInsertable); ok {
+		return ai.AfterInsert(ctx)
 	}
+	return nil
 }
-func (h *fqHandler) toMgoUpdaterAddOp(m M, ret map[string]interface{}) {
-	t := h.r.types[h.fq.Type]
-	for k, v := range m {
-		if _, ok := indexOf(h.fq.PatchFields, k); !ok {
-			panic(fmt.Sprintf("field '%s' not allow", k))
-		}
-		fs, ok := t.FieldByName(k)
-		if !ok {
-			panic(fmt.Sprintf("field '%s' not in '%v'", k, t))
-		}
-		ft := fs.Type
-		if ft.Kind() == reflect.Ptr {
-			ft = ft.Elem()
-		}
-		switch ft.Kind() {
-		case reflect.Slice:
-			accMapMap(ret, "$addToSet", strings.ToLower(k), h.r.valueToBsonElem(reflect.ValueOf(v), ft.Elem()))
-		default:
-			accMapMap(ret, "$inc", strings.ToLower(k), h.r.valueToBsonElem(reflect.ValueOf(v), ft))
-		}
-	}
+func (h *fqHandler) toMgoUpdaterSetOp(m M, ret map[string]interface{}) {
+	h.r.toMgoUpdaterSetOp(m, ret, h.r.types[h.fq.Type], h.fq.PatchFields, nil)
 }
-func (h *fqHandler) toMgoUpdater(updater M) (ret map[string]interface{}) {
-	ret = make(map[string]interface{})
-	for k, v := range updater {
-		m, ok := v.(M)
-		if !ok {
-			panic(fmt.Sprintf("want type %v, got '%v'", reflect.TypeOf(m), reflect.TypeOf(v)))
-		}
-		switch k {
-		case "Set":
-			h.toMgoUpdaterSetOp(m, ret, true)
-		case "Add":
-			h.toMgoUpdaterAddOp(m, ret)
-		default:
-			panic(fmt.Sprintf("unknown op '%s'", k))
-		}
-	}
-	accMapMap(ret, "$set", "mt", bson.Now().UTC())
-	return
+func (h *fqHandler) toMgoUpdater(updater M) (ret map[string]interface{}, err error) {
+	return h.r.toMgoUpdater(updater, h.r.types[h.fq.Type], h.fq.PatchFields)
 }
 func (h *fqHandler) Patch(req *Req, ctx *Context) (result interface{}, err error) {
 	if h.fq.Allow&PATCH == 0 {
@@ -2300,15 +3885,22 @@ func (h *fqHandler) Patch(req *Req, ctx *Context) (result interface{}, err error
 	if err != nil {
 		return nil, err
 	}
-	updater := h.toMgoUpdater(req.Body.(M))
-	_, err = h.coll(ctx).UpdateAll(q, updater)
+	updater, err := h.toMgoUpdater(req.Body.(M))
 	if err != nil {
-		lasterr := err.(*mgo.LastError)
-		if lasterr.Code == 11000 {
-			return nil, &Error{Code: Conflict}
-		} else {
-			return nil, &Error{Code: InternalServerError, Err: err}
-		}
+		return nil, err
+	}
+	q, cond := h.r.toMgoPrecondition(q, req.Body.(M), h.r.types[h.fq.Type])
+	if dryrun, err := parseParamBool(req.Params, "dryrun", false); err != nil || dryrun {
+		return nil, err
+	}
+	done := h.r.timeOp("update", h.fq.Type, q)
+	info, err := h.r.updateAll(h.coll(ctx), q, updater)
+	done()
+	if err != nil {
+		return nil, mgoError(err)
+	}
+	if cond && info.Updated == 0 {
+		return nil, &Error{Code: PreconditionFailed}
 	}
 	return nil, nil
 }
@@ -2334,13 +3926,24 @@ func (r *rest) segmentRefToPathSegmentTypes(t reflect.Type, segmentRef []interfa
 				continue
 			}
 			if field == "CT" || field == "MT" {
-				panic(fmt.Sprintf("segment not support type '%s'", "time.Time"))
+				ret = append(ret, "time")
+				continue
 			}
 			sf, ok := t.FieldByName(field)
-			if !ok {
-				panic(fmt.Sprintf("field '%s' not in '%v'", field, t))
+			if !ok || sf.PkgPath != "" {
+				panic(bugf("field '%s' not in '%v'", field, t))
 			}
 			ft = sf.Type
+		} else if fn, ok := ref.(Fn); ok {
+			if fn.Func == nil {
+				panic(&Bug{Msg: "Func can't be nil"})
+			}
+			r.checkPathSegmentTypes([]string{fn.Type})
+			if r.typeDefined(fn.Type) {
+				r.checkHasBase(fn.Type)
+			}
+			ret = append(ret, fn.Type)
+			continue
 		} else {
 			ft = reflect.TypeOf(ref)
 		}
@@ -2354,12 +3957,18 @@ func (r *rest) segmentRefToPathSegmentTypes(t reflect.Type, segmentRef []interfa
 			ret = append(ret, "string")
 		case reflect.Bool:
 			ret = append(ret, "bool")
+		case reflect.Float64:
+			ret = append(ret, "float")
 		case reflect.Struct:
+			if ft == timeType {
+				ret = append(ret, "time")
+				break
+			}
 			r.checkType(ft.Name())
 			r.checkHasBase(ft.Name())
 			ret = append(ret, ft.Name())
 		default:
-			panic(fmt.Sprintf("segment not support type '%v'", ft))
+			panic(bugf("segment not support type '%v'", ft))
 		}
 
 	}
@@ -2374,42 +3983,86 @@ type sqHandler struct {
 func newSQHandler(r *rest, sq *SelectorResource) *sqHandler {
 	return &sqHandler{r, sq}
 }
-func (h *sqHandler) toMgoSelMap(elem interface{}) map[string]interface{} {
-	typ := h.r.types[h.sq.Type]
+
+// toMgoSelMap translates the field names of a selector map against typ.
+// Below a field, as inside its $elemMatch, names refer to the field's
+// element: a nested struct, or nothing when elements are scalars or refs.
+func (h *sqHandler) toMgoSelMap(elem interface{}, typ reflect.Type) (map[string]interface{}, error) {
 	selelem := make(map[string]interface{})
 	ev := reflect.ValueOf(elem)
 	for _, kv := range ev.MapKeys() {
 		vv := ev.MapIndex(kv)
 		k := kv.Interface().(string)
 		v := vv.Interface()
-		if k[0] == '$' {
-			selelem[k] = h.toMgoSelElem(v)
+		var key string
+		scope := typ
+		if k == "" {
+			return nil, &Error{Code: BadRequest, Msg: "empty field in selector"}
+		} else if k[0] == '$' {
+			key = k
+		} else if typ == nil {
+			msg := fmt.Sprintf("field '%s' not allow in selector of scalar elements", k)
+			return nil, &Error{Code: BadRequest, Msg: msg}
 		} else {
+			top := typ == h.r.types[h.sq.Type]
+			if _, ok := indexOf(h.sq.SelectorFields, k); top && h.sq.SelectorFields != nil && !ok {
+				msg := fmt.Sprintf("field '%s' not allow in selector", k)
+				return nil, &Error{Code: BadRequest, Msg: msg}
+			}
 			switch k {
 			case "Id":
-				selelem["_id"] = h.toMgoSelElem(v)
+				key = "_id"
 			case "CT":
-				selelem["ct"] = h.toMgoSelElem(v)
+				key = "ct"
 			case "MT":
-				selelem["mt"] = h.toMgoSelElem(v)
+				key = "mt"
 			default:
-				_, ok := typ.FieldByName(k)
+				sf, ok := typ.FieldByName(k)
+				if ok {
+					var name string
+					name, ok = h.r.fieldNames(typ)[h.r.naming.fieldKey(sf)]
+					ok = ok && name == k
+				}
 				if !ok {
-					panic(fmt.Sprintf("field '%s' not found in %v", k, typ))
+					msg := fmt.Sprintf("field '%s' not found in %v", k, typ)
+					return nil, &Error{Code: BadRequest, Msg: msg}
+				}
+				if isEncrypted(sf) {
+					msg := fmt.Sprintf("field '%s' is encrypted", k)
+					return nil, &Error{Code: BadRequest, Msg: msg}
+				}
+				key = bsonKey(sf)
+				if isZoned(sf) {
+					key += ".t"
 				}
-				selelem[strings.ToLower(k)] = h.toMgoSelElem(v)
 			}
+			scope = nil
+			if sf, ok := typ.FieldByName(k); ok {
+				scope = subdocType(sf.Type)
+			}
+		}
+		toElem := h.toMgoSelElem
+		if key == "ct" || key == "mt" {
+			toElem = h.toMgoDateSelElem
+		}
+		val, err := toElem(v, scope)
+		if err != nil {
+			return nil, err
 		}
+		selelem[key] = val
 	}
-	return selelem
+	return selelem, nil
 }
-func (h *sqHandler) toMgoSelSlice(elem interface{}) (selelem interface{}) {
+func (h *sqHandler) toMgoSelSlice(elem interface{}, typ reflect.Type) (selelem interface{}, err error) {
 	v := reflect.ValueOf(elem)
 	t := v.Type()
 	if t.Elem().Kind() == reflect.Interface {
 		ret := make([]interface{}, v.Len())
 		for i := 0; i < v.Len(); i++ {
-			ret[i] = h.toMgoSelElem(v.Index(i).Interface())
+			ret[i], err = h.toMgoSelElem(v.Index(i).Interface(), typ)
+			if err != nil {
+				return nil, err
+			}
 		}
 		selelem = ret
 	} else {
@@ -2417,36 +4070,92 @@ func (h *sqHandler) toMgoSelSlice(elem interface{}) (selelem interface{}) {
 	}
 	return
 }
-func (h *sqHandler) toMgoSelElem(elem interface{}) (selelem interface{}) {
+func (h *sqHandler) toMgoSelElem(elem interface{}, typ reflect.Type) (selelem interface{}, err error) {
 	v := reflect.ValueOf(elem)
 	t := v.Type()
 	switch t.Kind() {
 	case reflect.Map:
-		selelem = h.toMgoSelMap(elem)
+		selelem, err = h.toMgoSelMap(elem, typ)
 	case reflect.Slice:
-		selelem = h.toMgoSelSlice(elem)
+		selelem, err = h.toMgoSelSlice(elem, typ)
 	default:
 		selelem = h.r.valueToBsonElem(v, t)
 	}
 	return
 }
-func (h *sqHandler) toMgoSelector(sel M) (mgosel map[string]interface{}) {
-	return h.toMgoSelMap(sel)
+
+// toMgoDateSelElem is toMgoSelElem for ct and mt, whose times stay dates
+// with NanoTimes.
+func (h *sqHandler) toMgoDateSelElem(elem interface{}, typ reflect.Type) (interface{}, error) {
+	v := reflect.ValueOf(elem)
+	switch {
+	case v.Type() == timeType:
+		return elem, nil
+	case v.Kind() == reflect.Map:
+		ret := make(map[string]interface{})
+		for _, kv := range v.MapKeys() {
+			k := kv.Interface().(string)
+			if !strings.HasPrefix(k, "$") {
+				msg := fmt.Sprintf("field '%s' not allow in selector of scalar elements", k)
+				return nil, &Error{Code: BadRequest, Msg: msg}
+			}
+			val, err := h.toMgoDateSelElem(v.MapIndex(kv).Interface(), typ)
+			if err != nil {
+				return nil, err
+			}
+			ret[k] = val
+		}
+		return ret, nil
+	case v.Kind() == reflect.Slice:
+		ret := make([]interface{}, v.Len())
+		for i := range ret {
+			val, err := h.toMgoDateSelElem(v.Index(i).Interface(), typ)
+			if err != nil {
+				return nil, err
+			}
+			ret[i] = val
+		}
+		return ret, nil
+	}
+	return h.toMgoSelElem(elem, typ)
+}
+func (h *sqHandler) toMgoSelector(sel M) (mgosel map[string]interface{}, err error) {
+	return h.toMgoSelMap(sel, h.r.types[h.sq.Type])
+}
+
+// subdocType is the struct whose fields a field of type t, or each of its
+// elements, is stored with; nil for scalars, refs and the special structs.
+func subdocType(t reflect.Type) reflect.Type {
+	for t.Kind() == reflect.Ptr || t.Kind() == reflect.Slice {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct || hasBase(t) || t == timeType || t == urlType || t == geoType {
+		return nil
+	}
+	return t
 }
 func (h *sqHandler) Get(req *Req, ctx *Context) (result interface{}, err error) {
+	if h.sq.Allow&GET == 0 {
+		return nil, &Error{Code: MethodNotAllowed}
+	}
 	sel, err := h.sq.SelectorFunc(req, ctx)
 	if err != nil {
 		return nil, err
 	}
-	sel = h.toMgoSelector(sel)
+	sel, err = h.toMgoSelector(sel)
+	if err != nil {
+		return nil, err
+	}
 	sortFields := make([]string, 0)
 	if h.sq.SortFields != nil {
 		sortFields = append(sortFields, h.sq.SortFields...)
+	} else if def, ok := h.r.sorts[h.sq.Type]; ok {
+		sortFields = append(sortFields, def...)
 	}
 	result, err = &selectorIter{
 		r:          h.r,
 		typ:        h.r.types[h.sq.Type],
-		sortFields: h.r.fieldsToKeys(h.r.types[h.sq.Type], sortFields),
+		sortFields: h.r.sortKeys(h.r.types[h.sq.Type], sortFields),
 		hasCount:   h.sq.Count,
 		limit:      h.sq.Limit,
 		pull:       false,
@@ -2456,43 +4165,185 @@ func (h *sqHandler) Get(req *Req, ctx *Context) (result interface{}, err error)
 	}, err
 	return
 }
-func checkPatchFields(fq *FieldResource) {
-	if fq.PatchFields == nil {
+func (h *sqHandler) setStructFields(s interface{}, sel M) {
+	sv := reflect.ValueOf(s).Elem()
+	for k, v := range sel {
+		if k[0] == '$' || k == "Id" || k == "CT" || k == "MT" || v == nil {
+			continue
+		}
+		vv := reflect.ValueOf(v)
+		if vv.Kind() == reflect.Map {
+			continue
+		}
+		fv := sv.FieldByName(k)
+		if !fv.IsValid() {
+			panic(bugf("field '%s' not in '%s'", k, sv.Type().Name()))
+		}
+		ft := fv.Type()
+		if ft.Kind() == reflect.Ptr && vv.Kind() != reflect.Ptr {
+			ft = ft.Elem()
+		}
+		if vv.Type() != ft && vv.Type().ConvertibleTo(ft) {
+			vv = vv.Convert(ft)
+		}
+		setFieldValue(sv, k, vv)
+	}
+}
+func (h *sqHandler) Post(req *Req, ctx *Context) (result interface{}, err error) {
+	if h.sq.Allow&POST == 0 {
+		return nil, &Error{Code: MethodNotAllowed}
+	}
+	sel, err := h.sq.SelectorFunc(req, ctx)
+	if err != nil {
+		return nil, err
+	}
+	body := req.Body
+	h.setStructFields(body, sel)
+	err = h.r.insert(h.sq.Type, body, ctx, h.sq.AllowClientId)
+	if err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+func (h *sqHandler) Delete(req *Req, ctx *Context) (result interface{}, err error) {
+	if h.sq.Allow&DELETE == 0 {
+		return nil, &Error{Code: MethodNotAllowed}
+	}
+	sel, err := h.sq.SelectorFunc(req, ctx)
+	if err != nil {
+		return nil, err
+	}
+	sel, err = h.toMgoSelector(sel)
+	if err != nil {
+		return nil, err
+	}
+	if h.sq.UpdateWhenDelete == nil {
+		_, err = ctx.coll(h.sq.Type).RemoveAll(bson.M(sel))
+		if err != nil {
+			return nil, mgoError(err)
+		}
+	} else {
+		updater := make(map[string]interface{})
+		h.r.toMgoUpdaterSetOp(h.sq.UpdateWhenDelete, updater, h.r.types[h.sq.Type], nil, nil)
+		_, err = h.r.updateAll(ctx.coll(h.sq.Type), bson.M(sel), updater)
+		if err != nil {
+			return nil, mgoError(err)
+		}
+	}
+	return nil, nil
+}
+func (h *sqHandler) Patch(req *Req, ctx *Context) (result interface{}, err error) {
+	if h.sq.Allow&PATCH == 0 {
+		return nil, &Error{Code: MethodNotAllowed}
+	}
+	sel, err := h.sq.SelectorFunc(req, ctx)
+	if err != nil {
+		return nil, err
+	}
+	sel, err = h.toMgoSelector(sel)
+	if err != nil {
+		return nil, err
+	}
+	updater, err := h.r.toMgoUpdater(req.Body.(M), h.r.types[h.sq.Type], h.sq.PatchFields)
+	if err != nil {
+		return nil, err
+	}
+	q, cond := h.r.toMgoPrecondition(bson.M(sel), req.Body.(M), h.r.types[h.sq.Type])
+	if dryrun, err := parseParamBool(req.Params, "dryrun", false); err != nil || dryrun {
+		return nil, err
+	}
+	info, err := h.r.updateAll(ctx.coll(h.sq.Type), q, updater)
+	if err != nil {
+		return nil, mgoError(err)
+	}
+	if cond && info.Updated == 0 {
+		return nil, &Error{Code: PreconditionFailed}
+	}
+	return nil, nil
+}
+func (r *rest) checkSelectorFields(t reflect.Type, fields []string) {
+	for _, f := range fields {
+		switch f {
+		case "Id", "CT", "MT":
+			continue
+		}
+		if sf, ok := t.FieldByName(f); !ok {
+			panic(bugf("field '%s' not in '%v'", f, t))
+		} else if isEncrypted(sf) {
+			panic(bugf("encrypted field '%s' can't be selected", f))
+		}
+	}
+}
+func checkPatchFields(patchFields []string, contextRef map[string]string) {
+	if patchFields == nil {
 		return
 	}
-	for _, v := range fq.PatchFields {
+	for _, v := range patchFields {
 		switch v {
 		case "Id", "CT", "MT":
-			panic(fmt.Sprintf("can't patch field '%s'", v))
+			panic(bugf("can't patch field '%s'", v))
 		default:
-			if fq.ContextRef != nil {
-				if _, ok := fq.ContextRef[v]; ok {
-					panic(fmt.Sprintf("can't patch field '%s' which in contextRef", v))
+			if contextRef != nil {
+				if _, ok := contextRef[v]; ok {
+					panic(bugf("can't patch field '%s' which in contextRef", v))
 				}
 			}
 		}
 	}
 }
 func checkFieldResource(fq *FieldResource) {
-	if fq.Allow&PUT != 0 && !fq.Unique {
-		panic("PUT only support unique field resource")
+	if fq.Allow&PUT != 0 && !fq.Unique && !fq.Sync && !fq.Replace {
+		panic(&Bug{Msg: "PUT only support unique, sync or replace field resource"})
 	}
-	checkPatchFields(fq)
+	if fq.Multi && (len(fq.Fields) == 0 || fq.Unique || fq.Allow&^GET != 0) {
+		panic(&Bug{Msg: "multi field resource needs fields, only allows GET and can't be unique"})
+	}
+	checkPatchFields(fq.PatchFields, fq.ContextRef)
 }
 func (r *rest) defFieldResource(name string, fq FieldResource) {
 	r.checkType(fq.Type)
 	checkFieldResource(&fq)
+	if fq.ExpireAfter > 0 {
+		if fq.ExpireField == "" {
+			fq.ExpireField = "CT"
+		}
+		r.checkExpireField(r.types[fq.Type], fq.ExpireField)
+	}
 	if fq.Pull {
 		r.pull[fq.Type] = true
 	}
-	h := newFQHandler(r, &fq)
-	h.ensureIndex()
-	segtype := r.fieldsToPathSegmentTypes(r.types[fq.Type], fq.Fields)
-	cq := CustomResource{fq.Type, fq.Type, segtype, h}
-	r.defCustomResource(name, cq)
+	h := newFQHandler(r, &fq)
+	h.ensureIndex(name)
+	segtype := r.fieldsToPathSegmentTypes(r.types[fq.Type], fq.Fields)
+	if fq.Multi {
+		segtype[len(segtype)-1] = "[]" + segtype[len(segtype)-1]
+	}
+	cq := CustomResource{fq.Type, fq.Type, segtype, h}
+	r.defCustomResource(name, cq)
+}
+func (r *rest) checkExpireField(t reflect.Type, field string) {
+	switch field {
+	case "CT", "MT":
+		return
+	}
+	f, ok := t.FieldByName(field)
+	if !ok {
+		panic(bugf("field '%s' not found in %v", field, t))
+	}
+	if f.Type != timeType && !(f.Type.Kind() == reflect.Ptr && f.Type.Elem() == timeType) {
+		panic(bugf("expire field '%s' must be time.Time, got %v", field, f.Type))
+	}
+	if r.nanoTimes {
+		panic(bugf("expire field '%s' can not be TTL indexed with NanoTimes", field))
+	}
 }
 func (r *rest) defSelectorResource(name string, sq SelectorResource) {
 	r.checkType(sq.Type)
+	checkPatchFields(sq.PatchFields, nil)
+	r.checkSelectorFields(r.types[sq.Type], sq.SelectorFields)
+	if sq.Allow == 0 {
+		sq.Allow = GET
+	}
 	h := newSQHandler(r, &sq)
 	cq := CustomResource{sq.Type, sq.Type, sq.PathSegmentTypes, h}
 	r.defCustomResource(name, cq)
@@ -2501,20 +4352,41 @@ func (r *rest) defImageResource(name string, iq ImageResource) {
 	if !r.typeDefined("binary") {
 		r.DefType(binary{})
 	}
+	if iq.MaxPixels == 0 {
+		iq.MaxPixels = defaultMaxPixels
+	}
 	h := &imageHandler{r, &iq}
 	cq := CustomResource{"binary", "binary", nil, h}
 	r.defCustomResource(name, cq)
+	r.queueBucketIndex(name, iq.Bucket, "md5")
+	// variants are looked up by name, the newest first
+	r.queueBucketIndex(name, iq.Bucket, "filename", "-uploadDate")
+}
+func (r *rest) defFileResource(name string, fq FileResource) {
+	if !r.typeDefined("binary") {
+		r.DefType(binary{})
+	}
+	for _, mt := range fq.MediaTypes {
+		if mts := strings.Split(mt, "/"); len(mts) != 2 || mts[0] == "" || mts[1] == "" {
+			panic(bugf("invalid media type '%s'", mt))
+		}
+	}
+	h := &fileHandler{r, &fq}
+	cq := CustomResource{"binary", "binary", nil, h}
+	r.defCustomResource(name, cq)
+	r.queueBucketIndex(name, fq.Bucket, "md5")
 }
 func (r *rest) checkPathSegmentTypes(segtype []string) {
 	for _, e := range segtype {
+		e = strings.TrimPrefix(e, "[]")
 		if r.typeDefined(e) {
 			continue
 		}
 		switch e {
-		case "int", "string", "bool":
+		case "int", "string", "slug", "bool", "float", "time":
 			continue
 		}
-		panic(fmt.Sprintf("type '%s' not support", e))
+		panic(bugf("type '%s' not support", e))
 	}
 }
 func (r *rest) defCustomResource(name string, cq CustomResource) {
@@ -2522,7 +4394,7 @@ func (r *rest) defCustomResource(name string, cq CustomResource) {
 	r.checkType(cq.ResponseType)
 	r.checkPathSegmentTypes(cq.PathSegmentTypes)
 	if cq.Handler == nil {
-		panic("Handler can't be nil")
+		panic(&Bug{Msg: "Handler can't be nil"})
 	}
 	r.registerQuery(name, cq)
 }
@@ -2537,37 +4409,203 @@ func (r *rest) fieldsToKeys(typ reflect.Type, fields []string) []string {
 			f = f[1:]
 		}
 		if inidx[f] {
-			panic(fmt.Sprintf("duplicate field '%s'", f))
+			panic(bugf("duplicate field '%s'", f))
 		}
 		inidx[f] = true
-		_, hf := typ.FieldByName(f)
+		sf, hf := typ.FieldByName(f)
+		if hf && isEncrypted(sf) {
+			panic(bugf("encrypted field '%s' can't be a key", f))
+		}
 		if f == "Id" {
 			ret = append(ret, p+"_id")
 		} else if hf || f == "MT" || f == "CT" {
-			ret = append(ret, p+strings.ToLower(f))
+			ret = append(ret, p+fieldBsonKey(typ, f))
 		} else {
-			panic(fmt.Sprintf("field '%s' not in '%v'", f, typ))
+			panic(bugf("field '%s' not in '%v'", f, typ))
 		}
 	}
 	return ret
 }
+func (r *rest) sortKeys(typ reflect.Type, fields []string) []string {
+	ret := r.fieldsToKeys(typ, fields)
+	if len(ret) == 0 {
+		return ret
+	}
+	for _, k := range ret {
+		if k == "_id" || k == "-_id" {
+			return ret
+		}
+	}
+	return append(ret, "_id")
+}
 func (r *rest) checkHasBase(typ string) {
 	checkHasBase(r.types[typ])
 }
 func (r *rest) Index(typ string, index I) {
+	r.queueIndex("", typ, index)
+}
+func (r *rest) queueIndex(res string, typ string, index I) {
 	r.checkType(typ)
 	r.checkHasBase(typ)
-	c := r.s.DB(r.db).C(strings.ToLower(typ))
-	mgoidx := mgo.Index{
-		Key:         r.fieldsToKeys(r.types[typ], index.Fields),
-		Unique:      index.Unique,
-		Sparse:      index.Sparse,
-		ExpireAfter: index.ExpireAfter,
+	r.fieldsToKeys(r.types[typ], index.Fields)
+	r.idxMu.Lock()
+	defer r.idxMu.Unlock()
+	r.indexes = append(r.indexes, &pendingIndex{res, typ, index, ""})
+	atomic.StoreInt32(&r.idxCount, int32(len(r.indexes)))
+}
+
+// queueBucketIndex indexes the files of a GridFS bucket by keys, once for
+// all the resources sharing the bucket.
+func (r *rest) queueBucketIndex(res string, bucket string, keys ...string) {
+	if bucket == "" {
+		bucket = "fs"
+	}
+	r.idxMu.Lock()
+	defer r.idxMu.Unlock()
+	for _, pi := range r.indexes {
+		if pi.bucket == bucket && reflect.DeepEqual(pi.index.Fields, keys) {
+			return
+		}
 	}
-	err := c.EnsureIndex(mgoidx)
-	if err != nil {
-		panic(err)
+	r.indexes = append(r.indexes, &pendingIndex{res, "", I{Fields: keys}, bucket})
+	atomic.StoreInt32(&r.idxCount, int32(len(r.indexes)))
+}
+
+// ensureIndexes ensures, on the first collection the Context uses, the
+// indexes defined since its database and collection prefix last had
+// them, so each tenant gets them once. Failures are logged and kept for
+// EnsureIndexes to return, not retried per request.
+func (ctx *Context) ensureIndexes() {
+	r := ctx.r
+	db, prefix := ctx.DB(), ctx.collName("")
+	ns := db + "." + prefix
+	if done, ok := r.idxDone.Load(ns); ok && done.(int) >= int(atomic.LoadInt32(&r.idxCount)) {
+		return
+	}
+	r.idxMu.Lock()
+	defer r.idxMu.Unlock()
+	if err := r.ensureIndexes(ctx.s, db, prefix, false, true); err != nil {
+		r.idxErrs = append(r.idxErrs, err.(IndexErrors)...)
+		log.Printf("mogogo: %v", err)
+	}
+}
+
+// EnsureIndexes ensures the indexes defined so far in Dial's database,
+// unprefixed, e.g. at startup; otherwise the first Context to use a
+// collection ensures them. It also returns the failures of those earlier
+// attempts, in any database or prefix.
+func (r *rest) EnsureIndexes(bestEffort bool) error {
+	r.idxMu.Lock()
+	defer r.idxMu.Unlock()
+	errs := r.idxErrs
+	r.idxErrs = nil
+	if err := r.ensureIndexes(r.s, r.db, "", false, bestEffort); err != nil {
+		errs = append(errs, err.(IndexErrors)...)
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// ensureIndexes ensures the indexes not yet ensured in db with prefix,
+// or all of them if again is set. Without bestEffort it stops at the first
+// failure, to retry it next time. Call it with idxMu held.
+func (r *rest) ensureIndexes(s *mgo.Session, db string, prefix string, again bool, bestEffort bool) error {
+	ns := db + "." + prefix
+	from := 0
+	if done, ok := r.idxDone.Load(ns); ok && !again {
+		from = done.(int)
+	}
+	errs := make(IndexErrors, 0)
+	for i, pi := range r.indexes[from:] {
+		c := s.DB(db).C(prefix + pi.coll())
+		if err := c.EnsureIndex(r.mgoIndex(pi)); err != nil {
+			errs = append(errs, &IndexError{Res: pi.res, Type: pi.typ, Index: pi.index, Err: err})
+			if !bestEffort {
+				r.idxDone.Store(ns, from+i)
+				return errs
+			}
+		}
+	}
+	r.idxDone.Store(ns, len(r.indexes))
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+func (pi *pendingIndex) coll() string {
+	if pi.bucket != "" {
+		return pi.bucket + ".files"
+	}
+	return strings.ToLower(pi.typ)
+}
+func (r *rest) mgoIndex(pi *pendingIndex) mgo.Index {
+	if pi.bucket != "" {
+		return mgo.Index{Key: pi.index.Fields}
+	}
+	return mgo.Index{
+		Key:         r.fieldsToKeys(r.types[pi.typ], pi.index.Fields),
+		Unique:      pi.index.Unique,
+		Sparse:      pi.index.Sparse,
+		ExpireAfter: pi.index.ExpireAfter,
+	}
+}
+
+// SetCollectionPrefix names the collections and the GridFS bucket a
+// Context uses with prefix(ctx) before them, e.g. a tenant read from the
+// Context, for one database shared by tenants. The indexes are ensured
+// in each prefix's collections the first time a Context uses them.
+func (r *rest) SetCollectionPrefix(prefix func(ctx *Context) string) {
+	r.collPrefix = prefix
+}
+
+// EnsureContextIndexes ensures every index defined so far in the
+// collections of ctx, again if already ensured, going on past failures.
+func (r *rest) EnsureContextIndexes(ctx *Context) error {
+	r.idxMu.Lock()
+	defer r.idxMu.Unlock()
+	return r.ensureIndexes(ctx.s, ctx.DB(), ctx.collName(""), true, true)
+}
+func (r *rest) Migrate(ctx *Context, typ string, field string, value interface{}) (n int, err error) {
+	r.checkType(typ)
+	r.checkHasBase(typ)
+	sf, ok := r.types[typ].FieldByName(field)
+	if !ok {
+		panic(bugf("field '%s' not in '%s'", field, typ))
+	}
+	key := bsonKey(sf)
+	sel := bson.M{key: bson.M{"$exists": false}}
+	c := ctx.coll(typ)
+	f, ok := value.(func(doc M) interface{})
+	if !ok && isEncrypted(sf) {
+		// sealed per document
+		f, ok = func(doc M) interface{} { return value }, true
+	}
+	if !ok {
+		elem := r.fieldToBsonElem("", sf, reflect.ValueOf(value), sf.Type)
+		info, err := c.UpdateAll(sel, bson.M{"$set": bson.M{key: elem}})
+		if err != nil {
+			return 0, mgoError(err)
+		}
+		return info.Updated, nil
+	}
+	iter := c.Find(sel).Iter()
+	doc := make(bson.M)
+	for iter.Next(doc) {
+		elem := r.fieldToBsonElem(doc["_id"].(bson.ObjectId), sf, reflect.ValueOf(f(M(doc))), sf.Type)
+		err = c.UpdateId(doc["_id"], bson.M{"$set": bson.M{key: elem}})
+		if err != nil {
+			iter.Close()
+			return n, mgoError(err)
+		}
+		n++
+		doc = make(bson.M)
 	}
+	if err = iter.Close(); err != nil {
+		return n, mgoError(err)
+	}
+	return n, nil
 }
 func (r *rest) newWithObjectId(typ reflect.Type, id bson.ObjectId) (val interface{}, err error) {
 	v := reflect.New(typ)
@@ -2608,16 +4646,28 @@ type resource struct {
 func (res *resource) Id() *ResId {
 	return res.resId
 }
+func (res *resource) Meta() ResourceMeta {
+	return res
+}
 func (res *resource) requestToBody(req interface{}) (body interface{}, err error) {
 	defRequestType := res.r.types[res.cq.RequestType]
 	requestType := reflect.TypeOf(req)
 	if requestType.Kind() == reflect.Ptr && requestType.Elem() == defRequestType {
 		body, err = req, nil
 	} else {
-		panic(fmt.Sprintf("request type want: %v, got %v", reflect.PtrTo(defRequestType), requestType))
+		panic(bugf("request type want: %v, got %v", reflect.PtrTo(defRequestType), requestType))
 	}
 	return
 }
+func requestToUpdater(req interface{}) M {
+	switch m := req.(type) {
+	case M:
+		return m
+	case map[string]interface{}:
+		return M(m)
+	}
+	panic(bugf("updater type want: M, got %T", req))
+}
 func (res *resource) checkResponse(val interface{}, err error) {
 	responseType := res.r.types[res.cq.ResponseType]
 	if val == nil {
@@ -2630,7 +4680,7 @@ func (res *resource) checkResponse(val interface{}, err error) {
 	if _, ok := val.(Iter); ok {
 		return
 	}
-	panic(fmt.Sprintf("not support response type: %v", resultType))
+	panic(bugf("not support response type: %v", resultType))
 }
 func (res *resource) Get() (response interface{}, err error) {
 	getable, ok := res.cq.Handler.(Getable)
@@ -2638,6 +4688,9 @@ func (res *resource) Get() (response interface{}, err error) {
 		return nil, &Error{Code: MethodNotAllowed}
 	}
 	req := &Req{ResId: res.resId, Method: GET}
+	if err = res.r.authorize(req, res.ctx); err != nil {
+		return nil, err
+	}
 	goOn, response, err := res.r.doBefore(GET, res.resId.path[0], req, res.ctx)
 	if !goOn {
 		res.checkResponse(response, err)
@@ -2652,16 +4705,33 @@ func (res *resource) Get() (response interface{}, err error) {
 	return
 }
 
+// readOnly reports whether writes are refused whatever the resource
+// allows.
+func (res *resource) readOnly() bool {
+	if res.r.readOnly {
+		return true
+	}
+	switch h := res.cq.Handler.(type) {
+	case *fqHandler:
+		return h.fq.ReadOnly
+	case *sqHandler:
+		return h.sq.ReadOnly
+	}
+	return false
+}
 func (res *resource) Put(request interface{}) (response interface{}, err error) {
 	putable, ok := res.cq.Handler.(Putable)
-	if !ok {
+	if !ok || res.readOnly() {
 		return nil, &Error{Code: MethodNotAllowed}
 	}
 	body, err := res.requestToBody(request)
 	if err != nil {
 		return nil, err
 	}
-	req := &Req{ResId: res.resId, Method: GET, Body: body}
+	req := &Req{ResId: res.resId, Method: PUT, Body: body}
+	if err = res.r.authorize(req, res.ctx); err != nil {
+		return nil, err
+	}
 	goOn, response, err := res.r.doBefore(PUT, res.resId.path[0], req, res.ctx)
 	if !goOn {
 		res.checkResponse(response, err)
@@ -2676,12 +4746,80 @@ func (res *resource) Put(request interface{}) (response interface{}, err error)
 	return
 }
 
+// PutMany authorizes as a PUT and runs the PUT hooks once per body, each
+// with a Req of that body alone. A Before hook failing a body fails just
+// that item; one stopping without an error keeps the body unwritten and
+// reports it 204. An After hook returning an error fails its item.
+func (res *resource) PutMany(requests []interface{}) (response *SyncResult, err error) {
+	putable, ok := res.cq.Handler.(PutManyable)
+	if !ok || res.readOnly() {
+		return nil, &Error{Code: MethodNotAllowed}
+	}
+	bodies := make([]interface{}, len(requests))
+	for i, request := range requests {
+		if e, ok := request.(*Error); ok {
+			bodies[i] = e
+		} else if bodies[i], err = res.requestToBody(request); err != nil {
+			return nil, err
+		}
+	}
+	req := &Req{ResId: res.resId, Method: PUT, Body: bodies}
+	if err = res.r.authorize(req, res.ctx); err != nil {
+		return nil, err
+	}
+	name := res.resId.path[0]
+	reqs := make([]*Req, len(bodies))
+	skipped := make(map[int]bool)
+	for i, body := range bodies {
+		if _, ok := body.(*Error); ok {
+			continue
+		}
+		reqs[i] = &Req{ResId: res.resId, Method: PUT, Body: body}
+		goOn, _, err := res.r.doBefore(PUT, name, reqs[i], res.ctx)
+		if !goOn && err != nil {
+			bodies[i] = toError(err)
+		} else if !goOn {
+			// a stand-in the handler skips; the item is reported 204 below
+			bodies[i] = &Error{Code: Conflict, Msg: "skipped by hook"}
+			skipped[i] = true
+		}
+	}
+	response, err = putable.PutMany(req, res.ctx)
+	if err != nil {
+		return nil, err
+	}
+	for i := range response.Items {
+		item := &response.Items[i]
+		if skipped[i] {
+			*item = ItemStatus{Status: 204}
+			continue
+		}
+		if reqs[i] == nil || item.Err != nil {
+			continue
+		}
+		goOn, _, newErr := res.r.doAfter(PUT, name, reqs[i], res.ctx, bodies[i], nil)
+		if !goOn && newErr != nil {
+			item.Err = toError(newErr)
+			item.Status = int(item.Err.Code)
+		}
+	}
+	return response, nil
+}
+func toError(err error) *Error {
+	if e, ok := err.(*Error); ok {
+		return e
+	}
+	return &Error{Code: InternalServerError, Err: err}
+}
 func (res *resource) Delete() (response interface{}, err error) {
 	deletable, ok := res.cq.Handler.(Deletable)
-	if !ok {
+	if !ok || res.readOnly() {
 		return nil, &Error{Code: MethodNotAllowed}
 	}
-	req := &Req{ResId: res.resId, Method: GET}
+	req := &Req{ResId: res.resId, Method: DELETE}
+	if err = res.r.authorize(req, res.ctx); err != nil {
+		return nil, err
+	}
 	goOn, response, err := res.r.doBefore(DELETE, res.resId.path[0], req, res.ctx)
 	if !goOn {
 		res.checkResponse(response, err)
@@ -2698,14 +4836,17 @@ func (res *resource) Delete() (response interface{}, err error) {
 
 func (res *resource) Post(request interface{}) (response interface{}, err error) {
 	postable, ok := res.cq.Handler.(Postable)
-	if !ok {
+	if !ok || res.readOnly() {
 		return nil, &Error{Code: MethodNotAllowed}
 	}
 	body, err := res.requestToBody(request)
 	if err != nil {
 		return nil, err
 	}
-	req := &Req{ResId: res.resId, Method: GET, Body: body}
+	req := &Req{ResId: res.resId, Method: POST, Body: body}
+	if err = res.r.authorize(req, res.ctx); err != nil {
+		return nil, err
+	}
 	goOn, response, err := res.r.doBefore(POST, res.resId.path[0], req, res.ctx)
 	if !goOn {
 		res.checkResponse(response, err)
@@ -2722,11 +4863,20 @@ func (res *resource) Post(request interface{}) (response interface{}, err error)
 
 func (res *resource) Patch(request interface{}) (response interface{}, err error) {
 	patchable, ok := res.cq.Handler.(Patchable)
-	if !ok {
+	if !ok || res.readOnly() {
 		return nil, &Error{Code: MethodNotAllowed}
 	}
 
-	req := &Req{ResId: res.resId, Method: GET, Body: request.(M)}
+	var body interface{}
+	if res.PatchesUpdater() {
+		body = requestToUpdater(request)
+	} else if body, err = res.requestToBody(request); err != nil {
+		return nil, err
+	}
+	req := &Req{ResId: res.resId, Method: PATCH, Body: body}
+	if err = res.r.authorize(req, res.ctx); err != nil {
+		return nil, err
+	}
 	goOn, response, err := res.r.doBefore(PATCH, res.resId.path[0], req, res.ctx)
 	if !goOn {
 		res.checkResponse(response, err)
@@ -2748,7 +4898,7 @@ func (res *resource) CanBinary() bool {
 }
 func (res *resource) NewBinary(reader io.Reader, mediaType string) Binary {
 	if !res.CanBinary() {
-		panic("can't binary")
+		panic(&Bug{Msg: "can't binary"})
 	}
 	return &binary{
 		readerFunc: func(self *binary) (io.ReadCloser, error) {
@@ -2756,6 +4906,7 @@ func (res *resource) NewBinary(reader io.Reader, mediaType string) Binary {
 		},
 		location:  nil,
 		mediaType: mediaType,
+		length:    -1,
 	}
 }
 func (res *resource) RequestType() reflect.Type {
@@ -2776,7 +4927,41 @@ func (res *resource) MapToRequest(m map[string]interface{}, base *url.URL) (inte
 func (res *resource) MapToUpdater(m map[string]interface{}, base *url.URL) (M, error) {
 	return res.r.mapToUpdater(m, base, res.RequestType())
 }
+
+// PatchesUpdater reports whether PATCH takes an M updater, as field and
+// selector resources do, rather than a request like custom handlers.
+func (res *resource) PatchesUpdater() bool {
+	switch res.cq.Handler.(type) {
+	case *fqHandler, *sqHandler:
+		return true
+	}
+	return false
+}
+
+// Parent is the document the resource's collection belongs to, as the
+// children of HasMany do: the first path segment whose type has a self
+// resource.
+func (res *resource) Parent() (parent *ResId, ok bool) {
+	for i, typ := range res.cq.PathSegmentTypes {
+		t, isType := res.r.types[typ]
+		if !isType || !hasBase(t) {
+			continue
+		}
+		if _, ok = res.r.queries[typeNameToQueryName(typ)]; !ok {
+			continue
+		}
+		seg, err := res.resId.Segment(i)
+		if err != nil {
+			return nil, false
+		}
+		return getBase(reflect.ValueOf(seg).Elem()).Self(), true
+	}
+	return nil, false
+}
 func (res *resource) ResponseToMap(resp interface{}, base *url.URL) map[string]interface{} {
+	if idx, ok := resp.(*index); ok {
+		return idx.toMap(base)
+	}
 	return res.r.structToMap(resp, base)
 }
 func (r *rest) queryRes(cq *CustomResource, resId *ResId, ctx *Context) (res Resource, err error) {
@@ -2784,6 +4969,9 @@ func (r *rest) queryRes(cq *CustomResource, resId *ResId, ctx *Context) (res Res
 }
 func (r *rest) R(resId *ResId, ctx *Context) (res Resource, err error) {
 	resId.r = r
+	if n := len(resId.path); n > r.maxSegments {
+		return nil, &Error{Code: BadRequest, Msg: fmt.Sprintf("path has %d segments, max %d", n, r.maxSegments)}
+	}
 	name := resId.path[0]
 	if qry, ok := r.queries[name]; ok {
 		if resId.IsSys() && !ctx.IsSys() {
@@ -2797,6 +4985,7 @@ func (r *rest) R(resId *ResId, ctx *Context) (res Resource, err error) {
 func init() {
 	image.RegisterFormat("png", "pngdecoder", png.Decode, png.DecodeConfig)
 	image.RegisterFormat("jpeg", "jpegdecoder", jpeg.Decode, jpeg.DecodeConfig)
+	image.RegisterFormat("gif", "gifdecoder", gif.Decode, gif.DecodeConfig)
 }
 
 var imageEncoder = map[string]func(w io.Writer, m image.Image) error{
@@ -2804,6 +4993,9 @@ var imageEncoder = map[string]func(w io.Writer, m image.Image) error{
 	"jpeg": func(w io.Writer, m image.Image) error {
 		return jpeg.Encode(w, m, &jpeg.Options{90})
 	},
+	"gif": func(w io.Writer, m image.Image) error {
+		return gif.Encode(w, m, nil)
+	},
 }
 
 type peekReader struct {
@@ -2820,6 +5012,8 @@ func newPeekReader(r io.Reader) *peekReader {
 	return &peekReader{bufio.NewReader(r)}
 }
 
+const defaultMaxPixels = 50000000
+
 type imageHandler struct {
 	r  *rest
 	iq *ImageResource
@@ -2846,19 +5040,29 @@ func adjustSize(size image.Point, b *Bound) (w, h int) {
 	}
 	return
 }
-func resize(r io.Reader, b *Bound) (io.ReadCloser, error) {
+
+var resizeImage = resize
+
+// resize scales the image to b, if any, and encodes it as format, or as
+// it was when format is "".
+func resize(r io.Reader, b *Bound, format string) (*bytes.Buffer, error) {
 	var buf bytes.Buffer
 	img, name, err := image.Decode(r)
 	if err != nil {
 		return nil, err
 	}
-	w, h := adjustSize(img.Bounds().Size(), b)
-	img = Resize(img, img.Bounds(), w, h)
-	err = imageEncoder[name](&buf, img)
+	if b != nil {
+		w, h := adjustSize(img.Bounds().Size(), b)
+		img = Resize(img, img.Bounds(), w, h)
+	}
+	if format == "" {
+		format = name
+	}
+	err = imageEncoder[format](&buf, img)
 	if err != nil {
 		return nil, err
 	}
-	return &fakeCloser{bytes.NewBuffer(buf.Bytes())}, nil
+	return &buf, nil
 }
 func (h *imageHandler) validSize() string {
 	keys := make([]string, 0, len(h.iq.Bounds))
@@ -2884,6 +5088,17 @@ func (h *imageHandler) validSize() string {
 	return strings.Join(pairs, ", ")
 
 }
+func validFormat() string {
+	formats := make([]string, 0, len(imageEncoder))
+	for k := range imageEncoder {
+		formats = append(formats, k)
+	}
+	sort.Strings(formats)
+	return strings.Join(formats, ", ")
+}
+
+// Get serves the image scaled to the bound the size param names, and
+// encoded as the format param says, e.g. ?size=s&format=jpeg.
 func (h *imageHandler) Get(req *Req, ctx *Context) (result interface{}, err error) {
 	var bound *Bound = nil
 	size, ok := req.Params["size"]
@@ -2896,38 +5111,76 @@ func (h *imageHandler) Get(req *Req, ctx *Context) (result interface{}, err erro
 			}
 		}
 	}
-	if len(req.path) < 2 {
-		return nil, &Error{Code: NotFound}
-	}
-	fn := req.path[1]
-	fns := strings.Split(fn, ".")
-	if len(fns) < 2 {
-		return nil, &Error{Code: BadRequest, Msg: "filename format error"}
+	format, ok := req.Params["format"]
+	if _, valid := imageEncoder[format]; ok && !valid {
+		return nil, &Error{
+			Code: BadRequest,
+			Msg:  fmt.Sprintf("invalid value for format:'%s', ALLOW: %s", format, validFormat()),
+		}
 	}
-	id, err := parseObjectId(fns[0])
+	id, err := fileId(req)
 	if err != nil {
-		return nil, &Error{Code: BadRequest, Msg: "filename format error", Err: err}
+		return nil, err
+	}
+	key := ""
+	if bound != nil {
+		key += "_" + size
 	}
+	if format != "" {
+		key += "." + format
+	}
+	etag := id.Hex() + key
 	ret := &binary{
 		readerFunc: func(self *binary) (io.ReadCloser, error) {
-			f, err := ctx.fs().OpenId(id)
-			if err == mgo.ErrNotFound {
-				return nil, &Error{Code: NotFound}
-			} else if err != nil {
-				return nil, err
+			if key != "" {
+				return h.variant(ctx, id, key, bound, format, self)
 			}
-			self.mediaType = f.ContentType()
-			if bound != nil {
-				defer f.Close()
-				return resize(f, bound)
-			}
-			return f, nil
+			return openFile(ctx, h.iq.Bucket, id, self)
 		},
+		length: -1,
+		etag:   strconv.Quote(etag),
 	}
 	return ret, nil
 }
+func (h *imageHandler) variant(ctx *Context, id bson.ObjectId, key string, bound *Bound, format string, self *binary) (io.ReadCloser, error) {
+	name := id.Hex() + key
+	f, err := ctx.fs(h.iq.Bucket).Open(name)
+	if err == nil {
+		self.mediaType = f.ContentType()
+		self.length = f.Size()
+		return f, nil
+	} else if err != mgo.ErrNotFound {
+		return nil, mgoError(err)
+	}
+	f, err = openFile(ctx, h.iq.Bucket, id, self)
+	if err != nil {
+		return nil, err
+	}
+	if bound == nil && self.mediaType == "image/"+format {
+		return f, nil
+	}
+	defer f.Close()
+	buf, err := resizeImage(f, bound, format)
+	if err != nil {
+		return nil, err
+	}
+	if format != "" {
+		self.mediaType = "image/" + format
+	}
+	self.length = int64(buf.Len())
+	// a failed cache store only costs a resize on the next request
+	storeFile(ctx, h.iq.Bucket, name, bytes.NewReader(buf.Bytes()), self.mediaType, 0)
+	return &fakeCloser{buf}, nil
+}
 func (h *imageHandler) parseMediaType(pr *peekReader) (name string, err error) {
-	_, name, err = image.DecodeConfig(pr)
+	cfg, name, err := image.DecodeConfig(pr)
+	if err != nil {
+		return
+	}
+	if cfg.Width*cfg.Height > h.iq.MaxPixels {
+		msg := fmt.Sprintf("image too large: %dx%d, max %d pixels", cfg.Width, cfg.Height, h.iq.MaxPixels)
+		return "", &Error{Code: BadRequest, Msg: msg}
+	}
 	return
 }
 func (h *imageHandler) Post(req *Req, ctx *Context) (result interface{}, err error) {
@@ -2958,29 +5211,181 @@ func (h *imageHandler) Post(req *Req, ctx *Context) (result interface{}, err err
 	}
 	pr := newPeekReader(r)
 	mts[1], err = h.parseMediaType(pr)
-	if err != nil {
+	if e, ok := err.(*Error); ok {
+		return nil, e
+	} else if err != nil {
 		return nil, &Error{
 			Code: BadRequest,
 			Msg:  "parse image file error",
 			Err:  err,
 		}
 	}
-	f, err := ctx.fs().Create("")
-	fn := f.Id().(bson.ObjectId).Hex() + "." + mts[1]
+	var body io.Reader = pr.r
+	if mts[1] == "jpeg" {
+		b, err := ioutil.ReadAll(pr.r)
+		if err != nil {
+			return nil, err
+		}
+		b, err = autoOrient(b)
+		if err != nil {
+			return nil, &Error{
+				Code: BadRequest,
+				Msg:  "parse image file error",
+				Err:  err,
+			}
+		}
+		body = bytes.NewReader(b)
+	}
+	id, err := storeFile(ctx, h.iq.Bucket, "", body, strings.Join(mts, "/"), 0)
+	if err != nil {
+		return nil, err
+	}
+	fn := h.r.idString(id) + "." + mts[1]
+	return &binary{location: NewResId(req.Name(), fn), length: -1}, nil
+}
+
+type fileHandler struct {
+	r  *rest
+	fq *FileResource
+}
+
+func (h *fileHandler) allowMediaType(mt string) bool {
+	if len(h.fq.MediaTypes) == 0 {
+		return true
+	}
+	for _, allow := range h.fq.MediaTypes {
+		if allow == mt || (strings.HasSuffix(allow, "/*") && strings.HasPrefix(mt, allow[:len(allow)-1])) {
+			return true
+		}
+	}
+	return false
+}
+func (h *fileHandler) Get(req *Req, ctx *Context) (result interface{}, err error) {
+	id, err := fileId(req)
+	if err != nil {
+		return nil, err
+	}
+	ret := &binary{
+		readerFunc: func(self *binary) (io.ReadCloser, error) {
+			return openFile(ctx, h.fq.Bucket, id, self)
+		},
+		length: -1,
+		etag:   strconv.Quote(id.Hex()),
+	}
+	return ret, nil
+}
+func (h *fileHandler) Post(req *Req, ctx *Context) (result interface{}, err error) {
+	bin := req.Body.(*binary)
+	r, err := bin.Reader()
+	if err != nil {
+		return nil, &Error{
+			Code: InternalServerError,
+			Msg:  "get reader from request",
+			Err:  err,
+		}
+	}
+	defer r.Close()
+	mt, _, err := mime.ParseMediaType(bin.MediaType())
 	if err != nil {
 		return nil, &Error{
+			Code: BadRequest,
+			Msg:  fmt.Sprintf("media type format error '%s'", bin.MediaType()),
+			Err:  err,
+		}
+	}
+	mts := strings.Split(mt, "/")
+	if len(mts) != 2 || !h.allowMediaType(mt) {
+		return nil, &Error{
+			Code: UnsupportedMediaType,
+			Msg:  fmt.Sprintf("unsupported media type '%s'", bin.MediaType()),
+		}
+	}
+	id, err := storeFile(ctx, h.fq.Bucket, "", r, mt, h.fq.MaxSize)
+	if err != nil {
+		return nil, err
+	}
+	fn := h.r.idString(id) + "." + mts[1]
+	return &binary{location: NewResId(req.Name(), fn), length: -1}, nil
+}
+func fileId(req *Req) (id bson.ObjectId, err error) {
+	if len(req.path) < 2 {
+		return "", &Error{Code: NotFound}
+	}
+	fn := req.path[1]
+	fns := strings.Split(fn, ".")
+	if len(fns) < 2 {
+		return "", &Error{Code: BadRequest, Msg: "filename format error"}
+	}
+	id, err = parseObjectId(fns[0])
+	if err != nil {
+		return "", &Error{Code: BadRequest, Msg: "filename format error", Err: err}
+	}
+	return
+}
+func openFile(ctx *Context, bucket string, id bson.ObjectId, self *binary) (*mgo.GridFile, error) {
+	f, err := ctx.fs(bucket).OpenId(id)
+	if err == mgo.ErrNotFound {
+		return nil, &Error{Code: NotFound}
+	} else if err != nil {
+		return nil, err
+	}
+	self.mediaType = f.ContentType()
+	self.length = f.Size()
+	return f, nil
+}
+
+// storeFile stores an upload, or a cached variant when name is set. An
+// upload byte-identical to an older stored file, per GridFS's md5, is
+// removed again and the older file's id returned, so both share one file;
+// of two identical uploads at once only the newer goes.
+func storeFile(ctx *Context, bucket string, name string, r io.Reader, mediaType string, maxSize int64) (id bson.ObjectId, err error) {
+	fs := ctx.fs(bucket)
+	f, err := fs.Create(name)
+	if err != nil {
+		return "", &Error{
 			Code: InternalServerError,
 			Msg:  "create file",
 			Err:  err,
 		}
 	}
-	defer f.Close()
-	f.SetContentType(strings.Join(mts, "/"))
-	_, err = io.Copy(f, pr.r)
+	id = f.Id().(bson.ObjectId)
+	f.SetContentType(mediaType)
+	if maxSize > 0 {
+		r = io.LimitReader(r, maxSize+1)
+	}
+	n, err := io.Copy(f, r)
+	if err == nil && maxSize > 0 && n > maxSize {
+		err = &Error{
+			Code: RequestEntityTooLarge,
+			Msg:  fmt.Sprintf("file size exceeds %d bytes", maxSize),
+		}
+	}
 	if err != nil {
-		return nil, err
+		f.Abort()
+		f.Close()
+		return "", err
+	}
+	err = f.Close()
+	if err != nil {
+		return "", mgoError(err)
+	}
+	if name == "" {
+		return dedupFile(fs, f, id, n, mediaType), nil
+	}
+	return
+}
+func dedupFile(fs *mgo.GridFS, f *mgo.GridFile, id bson.ObjectId, n int64, mediaType string) bson.ObjectId {
+	var dup struct {
+		Id bson.ObjectId `bson:"_id"`
 	}
-	return &binary{location: NewResId(req.Name(), fn)}, nil
+	sel := bson.M{"md5": f.MD5(), "length": n, "contentType": mediaType, "_id": bson.M{"$lt": id}}
+	if err := fs.Files.Find(sel).Select(bson.M{"_id": 1}).Sort("_id").One(&dup); err != nil {
+		return id
+	}
+	if err := fs.RemoveId(id); err != nil {
+		return id
+	}
+	return dup.Id
 }
 
 type fakeCloser struct {
@@ -3000,6 +5405,8 @@ type binary struct {
 	readerFunc func(self *binary) (io.ReadCloser, error)
 	location   *ResId
 	mediaType  string
+	length     int64
+	etag       string
 }
 
 func (b *binary) HasReader() bool {
@@ -3007,7 +5414,7 @@ func (b *binary) HasReader() bool {
 }
 func (b *binary) Reader() (io.ReadCloser, error) {
 	if !b.HasReader() {
-		panic("no reader")
+		panic(&Bug{Msg: "no reader"})
 	}
 	var err error
 	b.reader, err = b.readerFunc(b)
@@ -3018,10 +5425,16 @@ func (b *binary) Location() (*ResId, bool) {
 }
 func (b *binary) MediaType() string {
 	if !b.HasReader() {
-		panic("no reader")
+		panic(&Bug{Msg: "no reader"})
 	}
 	if b.reader == nil {
-		panic("call Reader() first")
+		panic(&Bug{Msg: "call Reader() first"})
 	}
 	return b.mediaType
 }
+func (b *binary) ContentLength() int64 {
+	return b.length
+}
+func (b *binary) Etag() string {
+	return b.etag
+}
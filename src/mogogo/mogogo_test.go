@@ -1,11 +1,23 @@
 package mogogo
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/png"
+	"io"
+	"io/ioutil"
 	"labix.org/v2/mgo"
 	"labix.org/v2/mgo/bson"
+	"log"
 	"net/url"
+	"os"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 )
@@ -60,6 +72,26 @@ func ExampleResId2() {
 	fmt.Println(uri.URLWithBase(u))
 	//Output:http://www.liudian.com/%E4%BD%A0%E5%A5%BD/hello?a=1
 }
+func TestParamsEncode(t *testing.T) {
+	uri := NewResId("ss")
+	uri.Params["b"] = "x y"
+	uri.Params["a"] = "1&2"
+	uri.Params["刘"] = "典"
+	if enc := uri.Params.Encode(); enc != uri.URL().RawQuery {
+		t.Errorf("want %q, got %q", uri.URL().RawQuery, enc)
+	}
+	if enc := uri.Params.Encode(); enc != "a=1%262&b=x+y&%E5%88%98=%E5%85%B8" {
+		t.Errorf("unexpected encoding %q", enc)
+	}
+}
+func TestMethodStringInvalid(t *testing.T) {
+	defer func() {
+		if b, ok := recover().(*Bug); !ok || b.Msg != "invalid method: 0x3(11)" {
+			t.Errorf("want invalid method bug, got %v", b)
+		}
+	}()
+	_ = (GET | PUT).String()
+}
 func TestREST1(t *testing.T) {
 	ms, err := mgo.Dial("localhost")
 	if err != nil {
@@ -274,9 +306,9 @@ func ExampleMapToStruct1() {
 		Base
 		F int
 	}
-	err = rest.mapToStruct(map[string]interface{}{"f": 1.1}, &s, baseURL1)
+	err = rest.mapToStruct(map[string]interface{}{"f": json.Number("1.1")}, &s, baseURL1)
 	fmt.Println(err)
-	//Output:field 'f' want type 'int' but 'float64'
+	//Output:field 'f' want type 'int' but 'number'
 }
 
 func ExampleMapToStruct2() {
@@ -689,7 +721,10 @@ func ExampleFieldResourceGet2() {
 		panic(err)
 	}
 	iter := resp.(Iter)
-	n := iter.Count()
+	n, err := iter.Count()
+	if err != nil {
+		panic(err)
+	}
 	fmt.Println(n)
 	for {
 		resp, ok := iter.Next()
@@ -700,7 +735,10 @@ func ExampleFieldResourceGet2() {
 		fmt.Println(ss.S1)
 	}
 	var s1set []string
-	iter.Extract("S1", &s1set)
+	err = iter.Extract("S1", &s1set)
+	if err != nil {
+		panic(err)
+	}
 	fmt.Println(len(s1set))
 	//Output:5
 	//Hello 4
@@ -745,7 +783,10 @@ func ExampleBaseLoad() {
 	}
 	ss := rest.newStruct("SS").(*SS)
 	ss.id = resp.(*SS).id
-	ok := ss.Load(ctx)
+	ok, err := ss.Load(ctx)
+	if err != nil {
+		panic(err)
+	}
 	if !ok {
 		panic("not found")
 	}
@@ -815,8 +856,11 @@ func ExampleBind() {
 	if err != nil {
 		panic(err)
 	}
-	iter := resp.(Iter)
-	fmt.Println(iter.Count())
+	n, err := resp.(Iter).Count()
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(n)
 	//Output:Hello Child
 	//true
 	//true
@@ -847,7 +891,10 @@ func ExampleToMgoSelector() {
 		"G1":  M{"$within": M{"$centerSphere": A{Geo{La: 1.2, Lo: 3.4}, 100 / 6378.137}}},
 		"$or": A{M{"S1": "Bye"}},
 	}
-	sel := h.toMgoSelector(m)
+	sel, err := h.toMgoSelector(m)
+	if err != nil {
+		panic(err)
+	}
 	fmt.Println(sel["s1"])
 	fmt.Println(sel["_id"])
 	fmt.Println(sel["a1"])
@@ -918,7 +965,10 @@ func ExampleSelectorResource() {
 		panic(err)
 	}
 	iter := resp.(Iter)
-	n := iter.Count()
+	n, err := iter.Count()
+	if err != nil {
+		panic(err)
+	}
 	fmt.Println(n)
 	for {
 		resp, ok := iter.Next()
@@ -1114,7 +1164,10 @@ func ExampleToMgoUpdater() {
 			"I1": 10,
 		},
 	}
-	sel := h.toMgoUpdater(m)
+	sel, err := h.toMgoUpdater(m)
+	if err != nil {
+		panic(err)
+	}
 	set := sel["$set"].(map[string]interface{})
 	inc := sel["$inc"].(map[string]interface{})
 	addToSet := sel["$addToSet"].(map[string]interface{})
@@ -1200,7 +1253,10 @@ func ExampleFieldResourcePatch1() {
 		panic(err)
 	}
 	iter := resp.(Iter)
-	n := iter.Count()
+	n, err := iter.Count()
+	if err != nil {
+		panic(err)
+	}
 	fmt.Println(n)
 	for {
 		resp, ok := iter.Next()
@@ -1211,7 +1267,10 @@ func ExampleFieldResourcePatch1() {
 		fmt.Println(ss.S1)
 	}
 	var s1set []string
-	iter.Extract("S1", &s1set)
+	err = iter.Extract("S1", &s1set)
+	if err != nil {
+		panic(err)
+	}
 	fmt.Println(len(s1set))
 	//Output:5
 	//Hello Patch
@@ -1264,7 +1323,10 @@ func ExampleFieldResourceDelete2() {
 		panic(err)
 	}
 	iter := resp.(Iter)
-	n := iter.Count()
+	n, err := iter.Count()
+	if err != nil {
+		panic(err)
+	}
 	fmt.Println(n)
 	for {
 		resp, ok := iter.Next()
@@ -1275,7 +1337,10 @@ func ExampleFieldResourceDelete2() {
 		fmt.Println(ss.S1)
 	}
 	var s1set []string
-	iter.Extract("S1", &s1set)
+	err = iter.Extract("S1", &s1set)
+	if err != nil {
+		panic(err)
+	}
 	fmt.Println(len(s1set))
 	//Output:5
 	//Deleted
@@ -1285,3 +1350,3471 @@ func ExampleFieldResourceDelete2() {
 	//Deleted
 	//1
 }
+
+type CtxUser struct {
+	Name string
+	SS   *SS
+}
+
+func ExampleFieldResourcePost3() {
+	ms, err := mgo.Dial("localhost")
+	if err != nil {
+		panic(err)
+	}
+	defer ms.Close()
+	err = ms.DB("rest_test").C("sss").DropCollection()
+	if err != nil {
+		panic(err)
+	}
+	s := Dial(ms, "rest_test")
+	rest := s.(*rest)
+	s.DefType(SS{})
+	s.DefType(SSS{})
+	s.DefRes("test-sss", FieldResource{
+		Type:  "SSS",
+		Allow: POST,
+		ContextRef: map[string]string{
+			"S1": "CU.Name",
+			"S2": "CU.SS",
+			"S3": "CU.SS",
+		},
+	})
+	ctx := s.NewContext()
+	defer ctx.Close()
+	ss, err := rest.newWithObjectId(reflect.TypeOf(SS{}), bson.ObjectIdHex("513b090869ca940ef500000b"))
+	if err != nil {
+		panic(err)
+	}
+	ctx.Set("CU", &CtxUser{Name: "liudian", SS: ss.(*SS)})
+	r, err := s.R(NewResId("test-sss"), ctx)
+	if err != nil {
+		panic(err)
+	}
+	resp, err := r.Post(&SSS{})
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(resp.(*SSS).S1)
+	fmt.Println(resp.(*SSS).S3.id.Hex())
+	//Output:liudian
+	//513b090869ca940ef500000b
+}
+func TestContextRef(t *testing.T) {
+	ctx := &Context{values: make(map[string]interface{})}
+	ctx.Set("CU", &CtxUser{Name: "liudian"})
+	v, err := ctx.ref("CU.Name")
+	if err != nil || v.Interface() != "liudian" {
+		t.Errorf("v: %v, err: %v", v, err)
+	}
+	_, err = ctx.ref("CU.SS")
+	if err == nil || err.(*Error).Code != Unauthorized {
+		t.Errorf("want unauthorized, got %v", err)
+	}
+	_, err = ctx.ref("CU.SS.S1")
+	if err == nil || err.(*Error).Code != Unauthorized {
+		t.Errorf("want unauthorized, got %v", err)
+	}
+	_, err = ctx.ref("CU.Age")
+	if err == nil || err.(*Error).Code != BadRequest {
+		t.Errorf("want bad request, got %v", err)
+	}
+	_, err = ctx.ref("CX.Name")
+	if err == nil || err.(*Error).Code != Unauthorized {
+		t.Errorf("want unauthorized, got %v", err)
+	}
+}
+func ExampleBindFn() {
+	ms, err := mgo.Dial("localhost")
+	if err != nil {
+		panic(err)
+	}
+	defer ms.Close()
+	s := Dial(ms, "rest_test")
+	rest := s.(*rest)
+	s.DefType(SS{})
+	s.DefType(SSChild{})
+	s.DefRes("ss-child", FieldResource{
+		Type:   "SSChild",
+		Allow:  GET | POST,
+		Fields: []string{"P", "S1"},
+	})
+	s.Bind("child", "SS", "ss-child", []interface{}{F("Id"), Fn{
+		Type: "string",
+		Func: func(self interface{}) interface{} {
+			return strings.ToLower(self.(*SS).S1)
+		},
+	}})
+	ss, err := rest.newWithId("SS", "513063ef69ca944b1000000a")
+	if err != nil {
+		panic(err)
+	}
+	ss.(*SS).S1 = "Hello"
+	fmt.Println(ss.(*SS).Rel("child"))
+	//Output:/ss-child/513063ef69ca944b1000000a/hello
+}
+func ExampleBaseReverseRels() {
+	ms, err := mgo.Dial("localhost")
+	if err != nil {
+		panic(err)
+	}
+	defer ms.Close()
+	s := Dial(ms, "rest_test")
+	rest := s.(*rest)
+	s.DefType(SS{})
+	s.DefType(SSChild{})
+	s.DefRes("ss-child", FieldResource{
+		Type:   "SSChild",
+		Allow:  GET | POST,
+		Fields: []string{"P"},
+	})
+	s.Bind("parent", "SSChild", "ss", []interface{}{F("P")})
+	ss, err := rest.newWithId("SS", "513063ef69ca944b1000000a")
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(ss.(*SS).ReverseRels())
+	//Output:map[ss-child:/ss-child/513063ef69ca944b1000000a]
+}
+func ExampleHasMany() {
+	ms, err := mgo.Dial("localhost")
+	if err != nil {
+		panic(err)
+	}
+	defer ms.Close()
+	err = ms.DB("rest_test").C("sschild").DropCollection()
+	if err != nil {
+		panic(err)
+	}
+	s := Dial(ms, "rest_test")
+	rest := s.(*rest)
+	s.DefType(SS{})
+	s.DefType(SSChild{})
+	s.DefRes("ss-child", FieldResource{
+		Type:   "SSChild",
+		Allow:  POST,
+		Fields: []string{"P"},
+	})
+	s.HasMany("SS", "SSChild", "P")
+	ctx := s.NewContext()
+	defer ctx.Close()
+	ss, err := rest.newWithId("SS", "513063ef69ca944b1000000a")
+	if err != nil {
+		panic(err)
+	}
+	r, err := s.R(NewResId("ss-child", ss), ctx)
+	if err != nil {
+		panic(err)
+	}
+	for i := 0; i < 2; i++ {
+		_, err = r.Post(&SSChild{S1: fmt.Sprintf("Hello %d", i)})
+		if err != nil {
+			panic(err)
+		}
+	}
+	fmt.Println(ss.(*SS).Rel("sschild"))
+	resp, err := ss.(*SS).R("sschild", ctx).Get()
+	if err != nil {
+		panic(err)
+	}
+	iter := resp.(Iter)
+	for {
+		resp, ok := iter.Next()
+		if !ok {
+			break
+		}
+		fmt.Println(resp.(*SSChild).S1)
+	}
+	//Output:/ss-sschild/513063ef69ca944b1000000a
+	//Hello 1
+	//Hello 0
+}
+func ExampleSelectorResourcePatch() {
+	ms, err := mgo.Dial("localhost")
+	if err != nil {
+		panic(err)
+	}
+	defer ms.Close()
+	err = ms.DB("rest_test").C("ss").DropCollection()
+	if err != nil {
+		panic(err)
+	}
+	s := Dial(ms, "rest_test")
+	s.DefType(SS{})
+	s.DefRes("test-ss", FieldResource{
+		Type:  "SS",
+		Allow: GET | POST,
+	})
+	s.DefRes("test-ss-sel", SelectorResource{
+		Type:  "SS",
+		Allow: GET | PATCH,
+		SelectorFunc: func(req *Req, ctx *Context) (M, error) {
+			return M{
+				"S1": M{"$gt": "Hello 2"},
+			}, nil
+		},
+		PatchFields: []string{"S1"},
+	})
+	ctx := s.NewContext()
+	defer ctx.Close()
+	r, err := s.R(NewResId("test-ss"), ctx)
+	if err != nil {
+		panic(err)
+	}
+	for i := 0; i < 5; i++ {
+		data := SS{S1: fmt.Sprintf("Hello %d", i)}
+		_, err := r.Post(&data)
+		if err != nil {
+			panic(err)
+		}
+	}
+	sr, err := s.R(NewResId("test-ss-sel"), ctx)
+	if err != nil {
+		panic(err)
+	}
+	_, err = sr.Patch(M{"Set": M{"S1": "Hello Patch"}})
+	if err != nil {
+		panic(err)
+	}
+	resp, err := r.Get()
+	if err != nil {
+		panic(err)
+	}
+	iter := resp.(Iter)
+	for {
+		resp, ok := iter.Next()
+		if !ok {
+			break
+		}
+		fmt.Println(resp.(*SS).S1)
+	}
+	//Output:Hello Patch
+	//Hello Patch
+	//Hello 2
+	//Hello 1
+	//Hello 0
+}
+func ExampleSelectorResourceDelete() {
+	ms, err := mgo.Dial("localhost")
+	if err != nil {
+		panic(err)
+	}
+	defer ms.Close()
+	err = ms.DB("rest_test").C("ss").DropCollection()
+	if err != nil {
+		panic(err)
+	}
+	s := Dial(ms, "rest_test")
+	s.DefType(SS{})
+	s.DefRes("test-ss", FieldResource{
+		Type:  "SS",
+		Allow: GET | POST,
+	})
+	s.DefRes("test-ss-sel", SelectorResource{
+		Type:  "SS",
+		Allow: GET | DELETE,
+		SelectorFunc: func(req *Req, ctx *Context) (M, error) {
+			return M{
+				"S1": M{"$gt": "Hello 2"},
+			}, nil
+		},
+	})
+	ctx := s.NewContext()
+	defer ctx.Close()
+	r, err := s.R(NewResId("test-ss"), ctx)
+	if err != nil {
+		panic(err)
+	}
+	for i := 0; i < 5; i++ {
+		data := SS{S1: fmt.Sprintf("Hello %d", i)}
+		_, err := r.Post(&data)
+		if err != nil {
+			panic(err)
+		}
+	}
+	sr, err := s.R(NewResId("test-ss-sel"), ctx)
+	if err != nil {
+		panic(err)
+	}
+	resp, err := sr.Delete()
+	fmt.Println(resp, err)
+	resp, err = r.Get()
+	if err != nil {
+		panic(err)
+	}
+	iter := resp.(Iter)
+	for {
+		resp, ok := iter.Next()
+		if !ok {
+			break
+		}
+		fmt.Println(resp.(*SS).S1)
+	}
+	//Output:<nil> <nil>
+	//Hello 2
+	//Hello 1
+	//Hello 0
+}
+
+type NoBase struct {
+	S1 string
+}
+
+func TestSelectorResourceAllow(t *testing.T) {
+	s := Dial(nil, "rest_test")
+	s.DefType(NoBase{})
+	s.DefRes("test-nobase-sel", SelectorResource{
+		Type: "NoBase",
+		SelectorFunc: func(req *Req, ctx *Context) (M, error) {
+			return M{}, nil
+		},
+	})
+	ctx := &Context{values: make(map[string]interface{})}
+	r, err := s.R(NewResId("test-nobase-sel"), ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = r.Delete()
+	if e, ok := err.(*Error); !ok || e.Code != MethodNotAllowed {
+		t.Errorf("want method not allowed, got %v", err)
+	}
+	_, err = r.Patch(M{})
+	if e, ok := err.(*Error); !ok || e.Code != MethodNotAllowed {
+		t.Errorf("want method not allowed, got %v", err)
+	}
+}
+func ExampleSelectorResourcePost() {
+	ms, err := mgo.Dial("localhost")
+	if err != nil {
+		panic(err)
+	}
+	defer ms.Close()
+	err = ms.DB("rest_test").C("sschild").DropCollection()
+	if err != nil {
+		panic(err)
+	}
+	s := Dial(ms, "rest_test")
+	rest := s.(*rest)
+	s.DefType(SS{})
+	s.DefType(SSChild{})
+	s.DefRes("test-sschild-sel", SelectorResource{
+		Type:  "SSChild",
+		Allow: GET | POST,
+		SelectorFunc: func(req *Req, ctx *Context) (M, error) {
+			p, _ := ctx.Get("P")
+			return M{
+				"P":  p,
+				"B1": true,
+				"S1": M{"$ne": ""},
+			}, nil
+		},
+		PathSegmentTypes: []string{},
+	})
+	ctx := s.NewContext()
+	defer ctx.Close()
+	ss, err := rest.newWithId("SS", "513063ef69ca944b1000000a")
+	if err != nil {
+		panic(err)
+	}
+	ctx.Set("P", ss)
+	r, err := s.R(NewResId("test-sschild-sel"), ctx)
+	if err != nil {
+		panic(err)
+	}
+	resp, err := r.Post(&SSChild{S1: "Hello Child"})
+	if err != nil {
+		panic(err)
+	}
+	sschild := resp.(*SSChild)
+	fmt.Println(sschild.P.id.Hex(), sschild.B1, sschild.S1)
+	resp, err = r.Get()
+	if err != nil {
+		panic(err)
+	}
+	n, err := resp.(Iter).Count()
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(n)
+	//Output:513063ef69ca944b1000000a true Hello Child
+	//1
+}
+func ExampleDefSort() {
+	ms, err := mgo.Dial("localhost")
+	if err != nil {
+		panic(err)
+	}
+	defer ms.Close()
+	err = ms.DB("rest_test").C("ss").DropCollection()
+	if err != nil {
+		panic(err)
+	}
+	s := Dial(ms, "rest_test")
+	s.DefType(SS{})
+	s.DefSort("SS", []string{"S1"})
+	s.DefRes("test-ss", FieldResource{
+		Type:  "SS",
+		Allow: GET | POST,
+	})
+	ctx := s.NewContext()
+	defer ctx.Close()
+	r, err := s.R(NewResId("test-ss"), ctx)
+	if err != nil {
+		panic(err)
+	}
+	for _, v := range []string{"b", "c", "a"} {
+		_, err := r.Post(&SS{S1: v})
+		if err != nil {
+			panic(err)
+		}
+	}
+	resp, err := r.Get()
+	if err != nil {
+		panic(err)
+	}
+	iter := resp.(Iter)
+	for {
+		resp, ok := iter.Next()
+		if !ok {
+			break
+		}
+		fmt.Println(resp.(*SS).S1)
+	}
+	//Output:a
+	//b
+	//c
+}
+func ExampleSortTieBreak() {
+	ms, err := mgo.Dial("localhost")
+	if err != nil {
+		panic(err)
+	}
+	defer ms.Close()
+	err = ms.DB("rest_test").C("ss").DropCollection()
+	if err != nil {
+		panic(err)
+	}
+	s := Dial(ms, "rest_test")
+	s.DefType(SS{})
+	s.DefRes("test-ss", FieldResource{
+		Type:       "SS",
+		Allow:      GET | POST,
+		SortFields: []string{"S1"},
+	})
+	ctx := s.NewContext()
+	defer ctx.Close()
+	r, err := s.R(NewResId("test-ss"), ctx)
+	if err != nil {
+		panic(err)
+	}
+	ids := make([]bson.ObjectId, 0)
+	for i := 0; i < 20; i++ {
+		data := &SS{S1: "Same"}
+		_, err := r.Post(data)
+		if err != nil {
+			panic(err)
+		}
+		ids = append(ids, data.id)
+	}
+	uri, err := ResIdParse("/test-ss?n=3")
+	if err != nil {
+		panic(err)
+	}
+	paged := make([]bson.ObjectId, 0)
+	for uri != nil {
+		r, err = s.R(uri, ctx)
+		if err != nil {
+			panic(err)
+		}
+		resp, err := r.Get()
+		if err != nil {
+			panic(err)
+		}
+		slice, err := resp.(Iter).Slice()
+		if err != nil {
+			panic(err)
+		}
+		for _, i := range slice.Items() {
+			paged = append(paged, i.(*SS).id)
+		}
+		uri = nil
+		if len(slice.Items()) > 0 {
+			uri = slice.Next()
+		}
+	}
+	fmt.Println(reflect.DeepEqual(ids, paged))
+	//Output:true
+}
+func TestSortKeys(t *testing.T) {
+	r := Dial(nil, "rest_test").(*rest)
+	typ := reflect.TypeOf(SS{})
+	keys := r.sortKeys(typ, []string{"-S1"})
+	if !reflect.DeepEqual(keys, []string{"-s1", "_id"}) {
+		t.Error(keys)
+	}
+	keys = r.sortKeys(typ, []string{"S1", "-Id"})
+	if !reflect.DeepEqual(keys, []string{"s1", "-_id"}) {
+		t.Error(keys)
+	}
+	keys = r.sortKeys(typ, []string{})
+	if len(keys) != 0 {
+		t.Error(keys)
+	}
+}
+
+type SSE struct {
+	Base
+	S1    string
+	Upper *string
+}
+
+func (s *SSE) AfterInsert(ctx *Context) error {
+	upper := strings.ToUpper(s.S1)
+	s.Upper = &upper
+	return nil
+}
+func ExampleAfterInsertable() {
+	ms, err := mgo.Dial("localhost")
+	if err != nil {
+		panic(err)
+	}
+	defer ms.Close()
+	err = ms.DB("rest_test").C("sse").DropCollection()
+	if err != nil {
+		panic(err)
+	}
+	s := Dial(ms, "rest_test")
+	s.DefType(SSE{})
+	s.DefRes("test-sse", FieldResource{
+		Type:  "SSE",
+		Allow: GET | POST,
+	})
+	ctx := s.NewContext()
+	defer ctx.Close()
+	r, err := s.R(NewResId("test-sse"), ctx)
+	if err != nil {
+		panic(err)
+	}
+	resp, err := r.Post(&SSE{S1: "Hello"})
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(*resp.(*SSE).Upper)
+	r, err = s.R(resp.(*SSE).Self(), ctx)
+	if err != nil {
+		panic(err)
+	}
+	resp, err = r.Get()
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(resp.(*SSE).Upper)
+	//Output:HELLO
+	//<nil>
+}
+func ExampleExists() {
+	ms, err := mgo.Dial("localhost")
+	if err != nil {
+		panic(err)
+	}
+	defer ms.Close()
+	err = ms.DB("rest_test").C("sss").DropCollection()
+	if err != nil {
+		panic(err)
+	}
+	s := Dial(ms, "rest_test")
+	rest := s.(*rest)
+	s.DefType(SS{})
+	s.DefType(SSS{})
+	s.DefRes("test-sss", FieldResource{
+		Type:  "SSS",
+		Allow: POST,
+	})
+	s.DefRes("test-sss-noi1", SelectorResource{
+		Type: "SSS",
+		SelectorFunc: func(req *Req, ctx *Context) (M, error) {
+			return Exists("I1", false), nil
+		},
+	})
+	ctx := s.NewContext()
+	defer ctx.Close()
+	ss, err := rest.newWithId("SS", "513063ef69ca944b1000000a")
+	if err != nil {
+		panic(err)
+	}
+	r, err := s.R(NewResId("test-sss"), ctx)
+	if err != nil {
+		panic(err)
+	}
+	i1 := 1
+	for _, data := range []*SSS{{S1: "With I1", I1: &i1}, {S1: "Without I1"}} {
+		data.S2 = *ss.(*SS)
+		_, err = r.Post(data)
+		if err != nil {
+			panic(err)
+		}
+	}
+	r, err = s.R(NewResId("test-sss-noi1"), ctx)
+	if err != nil {
+		panic(err)
+	}
+	resp, err := r.Get()
+	if err != nil {
+		panic(err)
+	}
+	iter := resp.(Iter)
+	for {
+		resp, ok := iter.Next()
+		if !ok {
+			break
+		}
+		fmt.Println(resp.(*SSS).S1)
+	}
+	//Output:Without I1
+}
+func TestSelectorResourceUnknownField(t *testing.T) {
+	s := Dial(nil, "rest_test")
+	s.DefType(NoBase{})
+	s.DefRes("test-nobase-sel", SelectorResource{
+		Type: "NoBase",
+		SelectorFunc: func(req *Req, ctx *Context) (M, error) {
+			return M{"$or": A{M{"S1": "a"}, M{"S2": "b"}}}, nil
+		},
+	})
+	s.DefRes("test-nobase-sel2", SelectorResource{
+		Type: "NoBase",
+		SelectorFunc: func(req *Req, ctx *Context) (M, error) {
+			return M{"S1": "a"}, nil
+		},
+		SelectorFields: []string{"Id"},
+	})
+	s.DefRes("test-nobase-sel-empty", SelectorResource{
+		Type: "NoBase",
+		SelectorFunc: func(req *Req, ctx *Context) (M, error) {
+			return M{"": "a"}, nil
+		},
+	})
+	ctx := &Context{values: make(map[string]interface{})}
+	for _, name := range []string{"test-nobase-sel", "test-nobase-sel2", "test-nobase-sel-empty"} {
+		r, err := s.R(NewResId(name), ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = r.Get()
+		if e, ok := err.(*Error); !ok || e.Code != BadRequest {
+			t.Errorf("%s: want bad request, got %v", name, err)
+		}
+	}
+	defer func() {
+		if r := recover(); r == nil {
+			t.Error("want panic at DefRes")
+		}
+	}()
+	s.DefRes("test-nobase-sel3", SelectorResource{
+		Type:           "NoBase",
+		SelectorFunc:   func(req *Req, ctx *Context) (M, error) { return M{}, nil },
+		SelectorFields: []string{"S2"},
+	})
+}
+func ExampleIterErr() {
+	ms, err := mgo.Dial("localhost")
+	if err != nil {
+		panic(err)
+	}
+	defer ms.Close()
+	err = ms.DB("rest_test").C("ss").DropCollection()
+	if err != nil {
+		panic(err)
+	}
+	s := Dial(ms, "rest_test")
+	s.DefType(SS{})
+	s.DefRes("test-ss", FieldResource{
+		Type:  "SS",
+		Allow: POST,
+	})
+	s.DefRes("test-ss-bad", SelectorResource{
+		Type: "SS",
+		SelectorFunc: func(req *Req, ctx *Context) (M, error) {
+			return M{"S1": M{"$badop": 1}}, nil
+		},
+	})
+	ctx := s.NewContext()
+	defer ctx.Close()
+	r, err := s.R(NewResId("test-ss"), ctx)
+	if err != nil {
+		panic(err)
+	}
+	_, err = r.Post(&SS{S1: "Hello"})
+	if err != nil {
+		panic(err)
+	}
+	r, err = s.R(NewResId("test-ss-bad"), ctx)
+	if err != nil {
+		panic(err)
+	}
+	resp, err := r.Get()
+	if err != nil {
+		panic(err)
+	}
+	iter := resp.(Iter)
+	_, ok := iter.Next()
+	fmt.Println(ok)
+	fmt.Println(iter.Err().(*Error).Code == InternalServerError)
+	_, err = iter.Count()
+	fmt.Println(err != nil)
+	//Output:false
+	//true
+	//true
+}
+func ExampleFileResource() {
+	ms, err := mgo.Dial("localhost")
+	if err != nil {
+		panic(err)
+	}
+	defer ms.Close()
+	s := Dial(ms, "rest_test")
+	s.DefRes("test-file", FileResource{
+		MediaTypes: []string{"text/*", "application/pdf"},
+		MaxSize:    1024,
+	})
+	ctx := s.NewContext()
+	defer ctx.Close()
+	r, err := s.R(NewResId("test-file"), ctx)
+	if err != nil {
+		panic(err)
+	}
+	rm := r.Meta()
+	_, err = r.Post(rm.NewBinary(strings.NewReader("x"), "image/png"))
+	fmt.Println(err)
+	_, err = r.Post(rm.NewBinary(strings.NewReader(strings.Repeat("x", 1025)), "text/plain"))
+	fmt.Println(err)
+	resp, err := r.Post(rm.NewBinary(strings.NewReader("Hello File"), "text/plain; charset=utf-8"))
+	if err != nil {
+		panic(err)
+	}
+	loc, _ := resp.(Binary).Location()
+	r, err = s.R(loc, ctx)
+	if err != nil {
+		panic(err)
+	}
+	resp, err = r.Get()
+	if err != nil {
+		panic(err)
+	}
+	bin := resp.(Binary)
+	rc, err := bin.Reader()
+	if err != nil {
+		panic(err)
+	}
+	defer rc.Close()
+	b, err := ioutil.ReadAll(rc)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(bin.MediaType(), bin.ContentLength(), string(b))
+	//Output:unsupported media type 'image/png'
+	//file size exceeds 1024 bytes
+	//text/plain 10 Hello File
+}
+func ExampleImageResourceCache() {
+	ms, err := mgo.Dial("localhost")
+	if err != nil {
+		panic(err)
+	}
+	defer ms.Close()
+	s := Dial(ms, "rest_test")
+	s.DefRes("test-img", ImageResource{
+		Bounds: map[string]*Bound{"s": {Square, 4}},
+	})
+	resized := 0
+	defer func(f func(r io.Reader, b *Bound, format string) (*bytes.Buffer, error)) { resizeImage = f }(resizeImage)
+	resizeImage = func(r io.Reader, b *Bound, format string) (*bytes.Buffer, error) {
+		resized++
+		return resize(r, b, format)
+	}
+	var buf bytes.Buffer
+	err = png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 16, 8)))
+	if err != nil {
+		panic(err)
+	}
+	ctx := s.NewContext()
+	defer ctx.Close()
+	r, err := s.R(NewResId("test-img"), ctx)
+	if err != nil {
+		panic(err)
+	}
+	resp, err := r.Post(r.Meta().NewBinary(&buf, "image/png"))
+	if err != nil {
+		panic(err)
+	}
+	loc, _ := resp.(Binary).Location()
+	loc.Params["size"] = "s"
+	for i := 0; i < 2; i++ {
+		r, err = s.R(loc, ctx)
+		if err != nil {
+			panic(err)
+		}
+		resp, err = r.Get()
+		if err != nil {
+			panic(err)
+		}
+		rc, err := resp.(Binary).Reader()
+		if err != nil {
+			panic(err)
+		}
+		img, err := png.Decode(rc)
+		if err != nil {
+			panic(err)
+		}
+		rc.Close()
+		fmt.Println(img.Bounds().Size(), resized)
+	}
+	//Output:(4,2) 1
+	//(4,2) 1
+}
+func ExampleImageResourceGif() {
+	ms, err := mgo.Dial("localhost")
+	if err != nil {
+		panic(err)
+	}
+	defer ms.Close()
+	s := Dial(ms, "rest_test")
+	s.DefRes("test-img", ImageResource{
+		Bounds: map[string]*Bound{"s": {Square, 4}},
+	})
+	anim := &gif.GIF{}
+	for _, c := range []color.Color{color.Black, color.White} {
+		frame := image.NewPaletted(image.Rect(0, 0, 16, 8), color.Palette{color.Black, color.White})
+		draw.Draw(frame, frame.Bounds(), image.NewUniform(c), image.ZP, draw.Src)
+		anim.Image = append(anim.Image, frame)
+		anim.Delay = append(anim.Delay, 10)
+	}
+	var buf bytes.Buffer
+	err = gif.EncodeAll(&buf, anim)
+	if err != nil {
+		panic(err)
+	}
+	ctx := s.NewContext()
+	defer ctx.Close()
+	r, err := s.R(NewResId("test-img"), ctx)
+	if err != nil {
+		panic(err)
+	}
+	resp, err := r.Post(r.Meta().NewBinary(&buf, "image/gif"))
+	if err != nil {
+		panic(err)
+	}
+	loc, _ := resp.(Binary).Location()
+	for _, size := range []string{"", "s"} {
+		if size != "" {
+			loc.Params["size"] = size
+		}
+		r, err = s.R(loc, ctx)
+		if err != nil {
+			panic(err)
+		}
+		resp, err = r.Get()
+		if err != nil {
+			panic(err)
+		}
+		rc, err := resp.(Binary).Reader()
+		if err != nil {
+			panic(err)
+		}
+		g, err := gif.DecodeAll(rc)
+		if err != nil {
+			panic(err)
+		}
+		rc.Close()
+		fmt.Println(resp.(Binary).MediaType(), len(g.Image), g.Image[0].Bounds().Size())
+	}
+	//Output:image/gif 2 (16,8)
+	//image/gif 1 (4,2)
+}
+func TestImageResourceMaxPixels(t *testing.T) {
+	s := Dial(nil, "rest_test")
+	s.DefRes("test-img", ImageResource{MaxPixels: 100 * 100})
+	ctx := &Context{values: make(map[string]interface{})}
+	r, err := s.R(NewResId("test-img"), ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := []byte("GIF89a\xff\xff\xff\xff\x00\x00\x00")
+	_, err = r.Post(r.Meta().NewBinary(bytes.NewReader(header), "image/gif"))
+	if e, ok := err.(*Error); !ok || e.Code != BadRequest || !strings.HasPrefix(e.Msg, "image too large") {
+		t.Errorf("want BadRequest for image too large, got %v", err)
+	}
+}
+func TestAuthorize(t *testing.T) {
+	s := Dial(nil, "rest_test")
+	s.DefType(NoBase{})
+	s.DefRes("test-nobase-sel", SelectorResource{
+		Type:  "NoBase",
+		Allow: GET | DELETE,
+		SelectorFunc: func(req *Req, ctx *Context) (M, error) {
+			return M{}, nil
+		},
+	})
+	s.Authorize("", func(req *Req, ctx *Context) error {
+		if !ctx.IsSys() {
+			return &Error{Code: Forbidden}
+		}
+		return nil
+	})
+	ctx := &Context{values: make(map[string]interface{})}
+	r, err := s.R(NewResId("test-nobase-sel"), ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = r.Delete()
+	if e, ok := err.(*Error); !ok || e.Code != Forbidden {
+		t.Errorf("want forbidden, got %v", err)
+	}
+	ctx.SetSys(true)
+	_, err = r.Get()
+	if err != nil {
+		t.Errorf("want get allowed, got %v", err)
+	}
+}
+func TestContextPrincipal(t *testing.T) {
+	s := Dial(nil, "rest_test")
+	s.DefType(NoBase{})
+	s.DefRes("test-nobase-sel", SelectorResource{
+		Type: "NoBase",
+		SelectorFunc: func(req *Req, ctx *Context) (M, error) {
+			return M{}, nil
+		},
+	})
+	var seen interface{}
+	s.Before(GET, "test-nobase-sel", func(req *Req, ctx *Context) (bool, interface{}, error) {
+		if !ctx.IsAuthenticated() {
+			return false, nil, &Error{Code: Unauthorized}
+		}
+		seen = ctx.Principal()
+		return true, nil, nil
+	})
+	ctx := &Context{values: make(map[string]interface{})}
+	r, err := s.R(NewResId("test-nobase-sel"), ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = r.Get()
+	if e, ok := err.(*Error); !ok || e.Code != Unauthorized {
+		t.Errorf("want unauthorized, got %v", err)
+	}
+	user := &NoBase{S1: "liudian"}
+	ctx.SetPrincipal(user)
+	_, err = r.Get()
+	if err != nil || seen != user {
+		t.Errorf("want principal %v in hook, got %v, %v", user, seen, err)
+	}
+	v, err := ctx.ref("principal.S1")
+	if err != nil || v.Interface() != "liudian" {
+		t.Errorf("want principal.S1 'liudian', got %v, %v", v, err)
+	}
+}
+func TestMapElemToIntPrecision(t *testing.T) {
+	r := Dial(nil, "rest_test").(*rest)
+	typ := reflect.TypeOf(int64(0))
+	for _, in := range []interface{}{json.Number("1152921504606846976"), "1152921504606846976"} {
+		i, err := r.mapElemToInt(reflect.ValueOf(in), typ, "i")
+		if err != nil || i != 1<<60 {
+			t.Errorf("%#v: want %d, got %d, %v", in, int64(1<<60), i, err)
+		}
+	}
+	_, err := r.mapElemToInt(reflect.ValueOf(float64(1<<60)), typ, "i")
+	if e, ok := err.(*Error); !ok || e.Code != BadRequest {
+		t.Errorf("want bad request, got %v", err)
+	}
+}
+func TestMapToStructNull(t *testing.T) {
+	r := Dial(nil, "rest_test").(*rest)
+	str := "set"
+	s := struct {
+		P *string
+		N int
+	}{P: &str}
+	err := r.mapToStruct(map[string]interface{}{"p": nil, "n": json.Number("1")}, &s, baseURL1)
+	if err != nil || s.P != nil || s.N != 1 {
+		t.Errorf("want P nil and N 1, got %v, %d, %v", s.P, s.N, err)
+	}
+	v, err := r.mapElemToValue(reflect.ValueOf(nil), reflect.TypeOf(&str), "p", nil, 0)
+	if err != nil || !v.IsValid() || !v.IsNil() {
+		t.Errorf("want valid nil pointer for null, got %v, %v", v, err)
+	}
+	err = r.mapToStruct(map[string]interface{}{"n": nil}, &s, baseURL1)
+	if e, ok := err.(*Error); !ok || e.Msg != "field 'n' can not be null" {
+		t.Errorf("want null error, got %v", err)
+	}
+}
+func TestMapToStructRefArray(t *testing.T) {
+	r := Dial(nil, "rest_test").(*rest)
+	r.DefType(SS{})
+	var s struct {
+		A2 []SS
+	}
+	a2 := []interface{}{
+		map[string]interface{}{"id": "513063ef69ca944b1000000a"},
+		map[string]interface{}{"id": "513063ef69ca944b1000000b"},
+		map[string]interface{}{"id": "bad"},
+	}
+	err := r.mapToStruct(map[string]interface{}{"a2": a2}, &s, baseURL1)
+	if e, ok := err.(*Error); !ok || e.Msg != "field 'a2[2].id' parse error" {
+		t.Errorf("want error at 'a2[2].id', got %v", err)
+	}
+	a2[2] = map[string]interface{}{"id": "513063ef69ca944b1000000c"}
+	err = r.mapToStruct(map[string]interface{}{"a2": a2}, &s, baseURL1)
+	if err != nil || len(s.A2) != 3 || s.A2[2].id.Hex() != "513063ef69ca944b1000000c" {
+		t.Errorf("want 3 refs, got %v, %v", s.A2, err)
+	}
+}
+
+type nested []nested
+
+func TestMapToStructMaxDepth(t *testing.T) {
+	s := Dial(nil, "rest_test")
+	s.SetMaxDepth(8)
+	r := s.(*rest)
+	var v struct {
+		N nested
+	}
+	deep := func(n int) interface{} {
+		var a interface{} = []interface{}{}
+		for i := 0; i < n; i++ {
+			a = []interface{}{a}
+		}
+		return a
+	}
+	err := r.mapToStruct(map[string]interface{}{"n": deep(7)}, &v, baseURL1)
+	if err != nil {
+		t.Errorf("want depth 7 accepted, got %v", err)
+	}
+	err = r.mapToStruct(map[string]interface{}{"n": deep(100)}, &v, baseURL1)
+	if e, ok := err.(*Error); !ok || e.Code != BadRequest {
+		t.Errorf("want bad request, got %v", err)
+	}
+	s.SetMaxDepth(2)
+	ref := map[string]interface{}{"id": "513063ef69ca944b1000000a"}
+	var refs struct {
+		R []SS
+	}
+	if err = r.mapToStruct(map[string]interface{}{"r": []interface{}{ref}}, &refs, baseURL1); err != nil {
+		t.Errorf("want object at depth 2 accepted, got %v", err)
+	}
+	var deepRefs struct {
+		R [][]SS
+	}
+	err = r.mapToStruct(map[string]interface{}{"r": []interface{}{[]interface{}{ref}}}, &deepRefs, baseURL1)
+	if e, ok := err.(*Error); !ok || e.Code != BadRequest {
+		t.Errorf("want object at depth 3 refused, got %v", err)
+	}
+}
+func TestMapToStructIdOnly(t *testing.T) {
+	s := Dial(nil, "rest_test")
+	s.DefType(SS{})
+	r := s.(*rest)
+	var ss SS
+	err := r.mapToStruct(map[string]interface{}{"id": "513063ef69ca944b1000000a", "s1": "a"}, &ss, baseURL1)
+	if err != nil || ss.id.Hex() != "513063ef69ca944b1000000a" || !ss.ct.IsZero() {
+		t.Errorf("want id kept without ct and mt, got %v %v %v", err, ss.id, ss.ct)
+	}
+	err = r.mapToStruct(map[string]interface{}{"id": "513063ef69ca944b1000000a", "ct": "x", "s1": "a"}, &ss, baseURL1)
+	if e, ok := err.(*Error); !ok || e.Code != BadRequest {
+		t.Errorf("want a bad ct refused, got %v", err)
+	}
+}
+func TestMapToStructStrict(t *testing.T) {
+	s := Dial(nil, "rest_test")
+	r := s.(*rest)
+	var v struct {
+		S1 string
+	}
+	m := map[string]interface{}{"s1": "Hello", "foo": "bar"}
+	err := r.mapToStruct(m, &v, baseURL1)
+	if err != nil || v.S1 != "Hello" {
+		t.Fatalf("want unknown keys ignored, got %v", err)
+	}
+	s.SetStrict(true)
+	err = r.mapToStruct(m, &v, baseURL1)
+	e, ok := err.(*Error)
+	if !ok || e.Code != BadRequest || len(e.Fields) != 1 || e.Fields["foo"] != "unknown" {
+		t.Errorf("want foo reported unknown, got %v", err)
+	}
+}
+
+type CaseCollide struct {
+	Name string
+	NAME string
+}
+
+func TestDefTypeCaseCollide(t *testing.T) {
+	s := Dial(nil, "rest_test")
+	s.DefType(NoBase{})
+	if got := s.(*rest).fieldNames(reflect.TypeOf(NoBase{}))["s1"]; got != "S1" {
+		t.Errorf("want 's1' mapped to 'S1', got %q", got)
+	}
+	defer func() {
+		if _, ok := recover().(*Bug); !ok {
+			t.Error("want bug panic at DefType")
+		}
+	}()
+	s.DefType(CaseCollide{})
+}
+func TestSetIdCursor(t *testing.T) {
+	from := time.Date(2013, 1, 2, 0, 0, 0, 0, time.UTC)
+	to := from.AddDate(0, 0, 2)
+	sel := bson.M{"_id": idRange(from, to)}
+	next := bson.NewObjectIdWithTime(from.AddDate(0, 0, 1))
+	setIdCursor(sel, "$lt", next)
+	want := bson.M{"$gte": bson.NewObjectIdWithTime(from), "$lt": next}
+	if !reflect.DeepEqual(sel["_id"], want) {
+		t.Errorf("want %v, got %v", want, sel["_id"])
+	}
+	if got := CreatedBetween(time.Time{}, time.Time{}); len(got) != 0 {
+		t.Errorf("want empty selector, got %v", got)
+	}
+}
+func TestSlugSegment(t *testing.T) {
+	s := Dial(nil, "rest_test")
+	s.DefType(NoBase{})
+	s.DefRes("test-nobase-slug", SelectorResource{
+		Type:             "NoBase",
+		PathSegmentTypes: []string{"slug"},
+		SelectorFunc: func(req *Req, ctx *Context) (M, error) {
+			return M{}, nil
+		},
+	})
+	ctx := &Context{values: make(map[string]interface{})}
+	tests := []struct {
+		seg string
+		ok  bool
+	}{
+		{"hello-world-2013", true},
+		{"Hello-World", false},
+		{"hello world", false},
+		{"-hello", false},
+	}
+	for _, test := range tests {
+		r, err := s.R(NewResId("test-nobase-slug", test.seg), ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		seg, err := r.Id().Segment(0)
+		if test.ok && (err != nil || seg != test.seg) {
+			t.Errorf("%s: want slug accepted, got %v, %v", test.seg, seg, err)
+		} else if e, ok := err.(*Error); !test.ok && (!ok || e.Code != BadRequest) {
+			t.Errorf("%s: want bad request, got %v", test.seg, err)
+		}
+	}
+}
+
+type Price struct {
+	Base
+	Amount float64
+	Day    time.Time
+}
+
+func TestFloatTimeSegment(t *testing.T) {
+	s := Dial(nil, "rest_test")
+	s.DefType(NoBase{})
+	s.DefType(Price{})
+	s.DefRes("test-nobase-ft", SelectorResource{
+		Type:             "NoBase",
+		PathSegmentTypes: []string{"float", "time"},
+		SelectorFunc: func(req *Req, ctx *Context) (M, error) {
+			return M{}, nil
+		},
+	})
+	segTypes := s.(*rest).fieldsToPathSegmentTypes(reflect.TypeOf(Price{}), []string{"Amount", "Day", "CT"})
+	if !reflect.DeepEqual(segTypes, []string{"float", "time", "time"}) {
+		t.Errorf("want [float time time], got %v", segTypes)
+	}
+	day := time.Date(2013, 3, 1, 8, 16, 47, 0, time.UTC)
+	resId := NewResId("test-nobase-ft", 19.99, day)
+	if resId.String() != "/test-nobase-ft/19.99/2013-03-01T08:16:47Z" {
+		t.Errorf("unexpected path %s", resId)
+	}
+	ctx := &Context{values: make(map[string]interface{})}
+	r, err := s.R(resId, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := r.Id().Segment(0)
+	if err != nil || f != 19.99 {
+		t.Errorf("want 19.99, got %v, %v", f, err)
+	}
+	tm, err := r.Id().Segment(1)
+	if err != nil || !tm.(time.Time).Equal(day) {
+		t.Errorf("want %v, got %v, %v", day, tm, err)
+	}
+	r, err = s.R(NewResId("test-nobase-ft", "cheap", "yesterday"), ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := r.Id().Segment(i); err == nil {
+			t.Errorf("segment %d: want parse error", i)
+		}
+	}
+}
+func TestBase64Ids(t *testing.T) {
+	s := Dial(nil, "rest_test")
+	s.DefType(SS{})
+	s.SetBase64Ids(true)
+	r := s.(*rest)
+	id := bson.ObjectIdHex("513063ef69ca944b1000000a")
+	v, err := r.newWithId("SS", id.Hex())
+	if err != nil {
+		t.Fatal(err)
+	}
+	self := v.(*SS).Self()
+	if len(self.path[1]) != 16 || self.String() != NewResId("ss", v).String() {
+		t.Fatalf("want 16 char base64url id, got %s", self)
+	}
+	v, err = r.newWithId("SS", self.path[1])
+	if err != nil || getBase(reflect.ValueOf(v).Elem()).id != id {
+		t.Errorf("want id %s round-tripped, got %v, %v", id.Hex(), v, err)
+	}
+}
+func TestSlowQueryLog(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	s := Dial(nil, "rest_test")
+	r := s.(*rest)
+	r.timeOp("find", "SS", bson.M{"s1": "Hello"})()
+	if buf.Len() != 0 {
+		t.Fatalf("want no log when disabled, got %s", buf.String())
+	}
+	s.SetSlowQuery(time.Nanosecond)
+	done := r.timeOp("find", "SS", bson.M{"s1": "Hello"})
+	time.Sleep(time.Millisecond)
+	done()
+	if !strings.Contains(buf.String(), "slow find on 'ss' map[s1:Hello]") {
+		t.Errorf("want slow query logged, got %q", buf.String())
+	}
+}
+func ExampleDialWithOptions() {
+	ms, err := mgo.Dial("localhost")
+	if err != nil {
+		panic(err)
+	}
+	defer ms.Close()
+	s := DialWithOptions(ms, "rest_test", DialOptions{
+		SocketTimeout: 5 * time.Second,
+		Mode:          Monotonic,
+	})
+	ctx := s.NewContext()
+	fmt.Println(ctx.s.Mode() == mgo.Monotonic, ms.Mode() == mgo.Strong)
+	ctx.Close()
+	s.Close()
+	fmt.Println(ms.Ping() == nil)
+	//Output:
+	//true true
+	//true
+}
+func TestSessionClose(t *testing.T) {
+	s := Dial(nil, "rest_test")
+	s.Close()
+	s.Close()
+	defer func() {
+		if b, ok := recover().(*Bug); !ok || b.Msg != "session closed" {
+			t.Errorf("want session closed bug, got %v", b)
+		}
+	}()
+	s.NewContext()
+}
+func TestReadOnly(t *testing.T) {
+	s := Dial(nil, "rest_test")
+	s.DefType(NoBase{})
+	s.DefRes("test-nobase-ro", SelectorResource{
+		Type:     "NoBase",
+		Allow:    GET | POST | PATCH | DELETE,
+		ReadOnly: true,
+		SelectorFunc: func(req *Req, ctx *Context) (M, error) {
+			return M{}, nil
+		},
+	})
+	ctx := &Context{values: make(map[string]interface{})}
+	r, err := s.R(NewResId("test-nobase-ro"), ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writes := map[string]func() (interface{}, error){
+		"post":   func() (interface{}, error) { return r.Post(&NoBase{}) },
+		"patch":  func() (interface{}, error) { return r.Patch(M{"S1": "x"}) },
+		"delete": r.Delete,
+	}
+	for name, write := range writes {
+		_, err := write()
+		if e, ok := err.(*Error); !ok || e.Code != MethodNotAllowed {
+			t.Errorf("%s: want method not allowed, got %v", name, err)
+		}
+	}
+	if _, err := r.Get(); err != nil {
+		t.Errorf("want get allowed, got %v", err)
+	}
+	s = DialWithOptions(nil, "rest_test", DialOptions{ReadOnly: true})
+	s.DefType(NoBase{})
+	s.DefRes("test-nobase-sel", SelectorResource{
+		Type:  "NoBase",
+		Allow: GET | DELETE,
+		SelectorFunc: func(req *Req, ctx *Context) (M, error) {
+			return M{}, nil
+		},
+	})
+	r, err = s.R(NewResId("test-nobase-sel"), ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Delete(); err == nil || err.(*Error).Code != MethodNotAllowed {
+		t.Errorf("want method not allowed on read-only session, got %v", err)
+	}
+}
+func TestMapElemToValueNumber(t *testing.T) {
+	r := Dial(nil, "rest_test").(*rest)
+	tests := []struct {
+		in   json.Number
+		typ  reflect.Type
+		want interface{}
+		msg  string
+	}{
+		{"42", reflect.TypeOf(0), 42, ""},
+		{"-7", reflect.TypeOf(int8(0)), int8(-7), ""},
+		{"1e3", reflect.TypeOf(0), 1000, ""},
+		{"1.5", reflect.TypeOf(0.0), 1.5, ""},
+		{"3", reflect.TypeOf(float32(0)), float32(3), ""},
+		{"1.1", reflect.TypeOf(0), nil, "field 'f' want type 'int' but 'number'"},
+		{"128", reflect.TypeOf(int8(0)), nil, "field 'f' overflows type 'int8'"},
+		{"99999999999999999999", reflect.TypeOf(int64(0)), nil, "field 'f' overflows type 'int64'"},
+		{"1e39", reflect.TypeOf(float32(0)), nil, "field 'f' overflows type 'float32'"},
+	}
+	for _, test := range tests {
+		v, err := r.mapElemToValue(reflect.ValueOf(test.in), test.typ, "f", nil, 0)
+		if test.msg != "" {
+			if e, ok := err.(*Error); !ok || e.Msg != test.msg {
+				t.Errorf("%s: want error %q, got %v", test.in, test.msg, err)
+			}
+			continue
+		}
+		if err != nil || v.Interface() != test.want {
+			t.Errorf("%s: want %v, got %v, %v", test.in, test.want, v, err)
+		}
+	}
+}
+func ExampleDefTypeIndex() {
+	ms, err := mgo.Dial("localhost")
+	if err != nil {
+		panic(err)
+	}
+	defer ms.Close()
+	err = ms.DB("rest_test").C("ss").DropCollection()
+	if err != nil {
+		panic(err)
+	}
+	s := Dial(ms, "rest_test")
+	s.DefType(SS{})
+	err = s.EnsureIndexes(false)
+	if err != nil {
+		panic(err)
+	}
+	indexes, err := ms.DB("rest_test").C("ss").Indexes()
+	if err != nil {
+		panic(err)
+	}
+	for _, index := range indexes {
+		if len(index.Key) == 1 && index.Key[0] == "mt" {
+			fmt.Println(index.Key)
+		}
+	}
+	//Output:[mt]
+}
+func ExampleFieldResourceExpireAfter() {
+	ms, err := mgo.Dial("localhost")
+	if err != nil {
+		panic(err)
+	}
+	defer ms.Close()
+	err = ms.DB("rest_test").C("ss").DropCollection()
+	if err != nil {
+		panic(err)
+	}
+	s := Dial(ms, "rest_test")
+	s.DefType(SS{})
+	s.DefRes("test-ss-ephemeral", FieldResource{
+		Type:        "SS",
+		Allow:       GET | POST,
+		ExpireAfter: time.Hour,
+	})
+	err = s.EnsureIndexes(false)
+	if err != nil {
+		panic(err)
+	}
+	indexes, err := ms.DB("rest_test").C("ss").Indexes()
+	if err != nil {
+		panic(err)
+	}
+	for _, index := range indexes {
+		if index.ExpireAfter > 0 {
+			fmt.Println(index.Key, index.ExpireAfter)
+		}
+	}
+	//Output:[ct] 1h0m0s
+}
+func ExampleEnsureIndexes() {
+	ms, err := mgo.Dial("localhost")
+	if err != nil {
+		panic(err)
+	}
+	defer ms.Close()
+	err = ms.DB("rest_test").C("ss").DropCollection()
+	if err != nil {
+		panic(err)
+	}
+	s := Dial(ms, "rest_test")
+	s.DefType(SS{})
+	s.DefRes("test-ss-hour", FieldResource{
+		Type:        "SS",
+		Allow:       GET,
+		ExpireAfter: time.Hour,
+	})
+	s.DefRes("test-ss-minute", FieldResource{
+		Type:        "SS",
+		Allow:       GET,
+		ExpireAfter: time.Minute,
+	})
+	s.DefRes("test-ss-s1", FieldResource{
+		Type:   "SS",
+		Allow:  GET,
+		Fields: []string{"S1"},
+		Unique: true,
+	})
+	err = s.EnsureIndexes(true)
+	for _, e := range err.(IndexErrors) {
+		fmt.Println(e.Res, e.Index.Fields)
+	}
+	indexes, err := ms.DB("rest_test").C("ss").Indexes()
+	if err != nil {
+		panic(err)
+	}
+	for _, index := range indexes {
+		if index.Unique {
+			fmt.Println(index.Key)
+		}
+	}
+	//Output:test-ss-minute [CT]
+	//[s1]
+}
+
+type SSM struct {
+	Base
+	S1 string
+	I1 int
+	I2 int
+}
+
+func ExampleMigrate() {
+	ms, err := mgo.Dial("localhost")
+	if err != nil {
+		panic(err)
+	}
+	defer ms.Close()
+	c := ms.DB("rest_test").C("ssm")
+	err = c.DropCollection()
+	if err != nil && err.Error() != "ns not found" {
+		panic(err)
+	}
+	s := Dial(ms, "rest_test")
+	s.DefType(SSM{})
+	ids := []bson.ObjectId{bson.NewObjectId(), bson.NewObjectId()}
+	for i, id := range ids {
+		err = c.Insert(bson.M{"_id": id, "ct": time.Now(), "mt": time.Now(), "s1": fmt.Sprint("Hello", i)})
+		if err != nil {
+			panic(err)
+		}
+	}
+	ctx := s.NewContext()
+	defer ctx.Close()
+	n, err := s.Migrate(ctx, "SSM", "I1", 7)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(n)
+	n, err = s.Migrate(ctx, "SSM", "I2", func(doc M) interface{} {
+		return len(doc["s1"].(string))
+	})
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(n)
+	for _, id := range ids {
+		r, err := s.R(NewResId("ssm", id.Hex()), ctx)
+		if err != nil {
+			panic(err)
+		}
+		resp, err := r.Get()
+		if err != nil {
+			panic(err)
+		}
+		ssm := resp.(*SSM)
+		fmt.Println(ssm.S1, ssm.I1, ssm.I2)
+	}
+	//Output:2
+	//2
+	//Hello0 7 6
+	//Hello1 7 6
+}
+func ExampleCreatedBetween() {
+	ms, err := mgo.Dial("localhost")
+	if err != nil {
+		panic(err)
+	}
+	defer ms.Close()
+	c := ms.DB("rest_test").C("ss")
+	err = c.DropCollection()
+	if err != nil && err.Error() != "ns not found" {
+		panic(err)
+	}
+	s := Dial(ms, "rest_test")
+	s.DefType(SS{})
+	s.DefRes("test-ss-timeline", FieldResource{
+		Type:  "SS",
+		Allow: GET,
+	})
+	s.DefRes("test-ss-since", SelectorResource{
+		Type:  "SS",
+		Allow: GET,
+		SelectorFunc: func(req *Req, ctx *Context) (M, error) {
+			from, _ := time.Parse(time.RFC3339, req.Params["since"])
+			return CreatedBetween(from, time.Time{}), nil
+		},
+	})
+	day := time.Date(2013, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 4; i++ {
+		ct := day.AddDate(0, 0, i)
+		id := bson.NewObjectIdWithTime(ct)
+		err = c.Insert(bson.M{"_id": id, "ct": ct, "mt": ct, "s1": fmt.Sprint("Hello", i)})
+		if err != nil {
+			panic(err)
+		}
+	}
+	ctx := s.NewContext()
+	defer ctx.Close()
+	resId := NewResId("test-ss-timeline")
+	resId.Params["from"] = "2013-01-02T00:00:00Z"
+	resId.Params["to"] = "2013-01-04T00:00:00Z"
+	resId.Params["n"] = "1"
+	for {
+		r, err := s.R(resId, ctx)
+		if err != nil {
+			panic(err)
+		}
+		resp, err := r.Get()
+		if err != nil {
+			panic(err)
+		}
+		slice, err := resp.(Iter).Slice()
+		if err != nil {
+			panic(err)
+		}
+		if len(slice.Items()) == 0 {
+			break
+		}
+		for _, i := range slice.Items() {
+			fmt.Println(i.(*SS).S1)
+		}
+		resId = slice.Next()
+	}
+	resId = NewResId("test-ss-since")
+	resId.Params["since"] = "2013-01-03T00:00:00Z"
+	r, err := s.R(resId, ctx)
+	if err != nil {
+		panic(err)
+	}
+	resp, err := r.Get()
+	if err != nil {
+		panic(err)
+	}
+	iter := resp.(Iter)
+	for {
+		resp, ok := iter.Next()
+		if !ok {
+			break
+		}
+		fmt.Println(resp.(*SS).S1)
+	}
+	//Output:Hello2
+	//Hello1
+	//Hello3
+	//Hello2
+}
+func ExampleSetMaxAllItems() {
+	ms, err := mgo.Dial("localhost")
+	if err != nil {
+		panic(err)
+	}
+	defer ms.Close()
+	c := ms.DB("rest_test").C("ss")
+	err = c.DropCollection()
+	if err != nil && err.Error() != "ns not found" {
+		panic(err)
+	}
+	s := Dial(ms, "rest_test")
+	s.DefType(SS{})
+	s.DefRes("test-ss-all", FieldResource{
+		Type:  "SS",
+		Allow: GET,
+	})
+	s.SetMaxAllItems(3)
+	for i := 0; i < 5; i++ {
+		err = c.Insert(bson.M{"_id": bson.NewObjectId(), "ct": time.Now(), "mt": time.Now(), "s1": fmt.Sprint("Hello", i)})
+		if err != nil {
+			panic(err)
+		}
+	}
+	ctx := s.NewContext()
+	defer ctx.Close()
+	resId := NewResId("test-ss-all")
+	resId.Params["all"] = "true"
+	r, err := s.R(resId, ctx)
+	if err != nil {
+		panic(err)
+	}
+	resp, err := r.Get()
+	if err != nil {
+		panic(err)
+	}
+	slice, err := resp.(Iter).Slice()
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(len(slice.Items()), slice.More())
+	//Output:3 true
+}
+func ExampleDialWithOptionsClone() {
+	ms, err := mgo.Dial("localhost")
+	if err != nil {
+		panic(err)
+	}
+	defer ms.Close()
+	s := DialWithOptions(ms, "rest_test", DialOptions{Clone: true})
+	s.DefType(SS{})
+	s.DefRes("test-ss-clone", FieldResource{
+		Type:  "SS",
+		Allow: GET,
+	})
+	for i := 0; i < 1000; i++ {
+		ctx := s.NewContext()
+		r, err := s.R(NewResId("test-ss-clone"), ctx)
+		if err != nil {
+			panic(err)
+		}
+		resp, err := r.Get()
+		if err != nil {
+			panic(err)
+		}
+		_, err = resp.(Iter).Count()
+		if err != nil {
+			panic(err)
+		}
+		ctx.Close()
+	}
+	fmt.Println("ok")
+	//Output:ok
+}
+
+type Password string
+
+func (p Password) Verify() (ok bool, msg string) {
+	return false, "'" + string(p) + "' too short"
+}
+
+type Login struct {
+	Name     string
+	Password Password   `mogogo:"sensitive"`
+	Expire   *time.Time `mogogo:"sensitive"`
+}
+
+func TestSensitiveRedact(t *testing.T) {
+	s := Dial(nil, "rest_test")
+	s.DefType(Login{})
+	r := s.(*rest)
+	var l Login
+	err := r.mapToStruct(map[string]interface{}{"name": "n", "password": "hunter2", "expire": "hunter2"}, &l, nil)
+	if err == nil || strings.Contains(err.Error(), "hunter2") || !strings.Contains(err.Error(), redacted) {
+		t.Errorf("want value masked in type error, got %v", err)
+	}
+	err = r.mapToStruct(map[string]interface{}{"name": "n", "password": "hunter2"}, &l, nil)
+	if e, ok := err.(*Error); !ok || e.Fields["Password"] != redacted {
+		t.Errorf("want value masked in fields, got %v", err)
+	}
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	s.SetSlowQuery(time.Nanosecond)
+	done := r.timeOp("find", "Login", bson.M{"$or": []interface{}{bson.M{"password": "hunter2"}, bson.M{"name": "n"}}})
+	time.Sleep(time.Millisecond)
+	done()
+	if strings.Contains(buf.String(), "hunter2") || !strings.Contains(buf.String(), "password:"+redacted) {
+		t.Errorf("want value masked in log, got %q", buf.String())
+	}
+}
+
+type Event struct {
+	At time.Time
+}
+
+func TestTimeFormat(t *testing.T) {
+	s := Dial(nil, "rest_test")
+	s.DefType(Event{})
+	r := s.(*rest)
+	at := time.Date(2013, 3, 1, 8, 16, 47, 123456789, time.UTC)
+	s.SetTimeFormat(time.RFC3339Nano)
+	m := r.structToMap(&Event{At: at}, nil)
+	if m["at"] != "2013-03-01T08:16:47.123456789Z" {
+		t.Errorf("want RFC3339Nano, got %v", m["at"])
+	}
+	var e Event
+	if err := r.mapToStruct(m, &e, nil); err != nil || !e.At.Equal(at) {
+		t.Errorf("want %v back, got %v %v", at, e.At, err)
+	}
+	s.SetTimeFormat(UnixTime)
+	m = r.structToMap(&Event{At: at}, nil)
+	if m["at"] != at.Unix() {
+		t.Errorf("want unix seconds, got %v", m["at"])
+	}
+	for _, v := range []interface{}{json.Number("1362125807.5"), 1362125807.5, "2013-03-01T08:16:47.5Z"} {
+		err := r.mapToStruct(map[string]interface{}{"at": v}, &e, nil)
+		if want := at.Truncate(time.Second).Add(500 * time.Millisecond); err != nil || !e.At.Equal(want) {
+			t.Errorf("%v: want %v, got %v %v", v, want, e.At, err)
+		}
+	}
+	s.SetTimeFormat("2006-01-02")
+	m = r.structToMapLayout(&Event{At: at}, nil, time.RFC3339Nano)
+	if m["at"] != "2013-03-01T08:16:47.123456789Z" {
+		t.Errorf("want RFC3339Nano whatever the format, got %v", m["at"])
+	}
+	if err := r.mapToStruct(m, &e, nil); err != nil || !e.At.Equal(at) {
+		t.Errorf("want RFC3339Nano accepted with any format, got %v %v", e.At, err)
+	}
+}
+
+type Meeting struct {
+	Base
+	At  time.Time  `mogogo:"zone"`
+	End *time.Time `mogogo:"zone"`
+}
+
+func TestZonedTime(t *testing.T) {
+	s := Dial(nil, "rest_test")
+	s.DefType(Meeting{})
+	r := s.(*rest)
+	now := time.Now()
+	v, _ := r.newWithObjectId(r.types["Meeting"], bson.NewObjectId())
+	mt := v.(*Meeting)
+	mt.ct, mt.mt, mt.loaded = now, now, true
+	err := r.mapToStruct(map[string]interface{}{"at": "2013-03-01T08:16:47+08:00", "end": "2013-03-01T09:16:47-05:00"}, mt, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := bson.Marshal(r.structToBson(mt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bson.M
+	if err := bson.Unmarshal(data, &b); err != nil {
+		t.Fatal(err)
+	}
+	var got Meeting
+	r.bsonToStruct(b, &got)
+	m := r.structToMap(&got, &url.URL{Scheme: "http", Host: "localhost"})
+	if m["at"] != "2013-03-01T08:16:47+08:00" || m["end"] != "2013-03-01T09:16:47-05:00" {
+		t.Errorf("want offsets kept, got %v %v", m["at"], m["end"])
+	}
+	if m["ct"] != now.UTC().Format(time.RFC3339) {
+		t.Errorf("want ct in UTC, got %v", m["ct"])
+	}
+	h := newSQHandler(r, &SelectorResource{Type: "Meeting"})
+	sel, err := h.toMgoSelector(M{"At": M{"$gt": mt.At}})
+	if _, ok := sel["at.t"]; err != nil || !ok {
+		t.Errorf("want selector on at.t, got %v %v", sel, err)
+	}
+}
+
+type Stamp struct {
+	Base
+	At time.Time
+}
+
+func TestNanoTimes(t *testing.T) {
+	s := DialWithOptions(nil, "rest_test", DialOptions{NanoTimes: true})
+	s.DefType(Stamp{})
+	r := s.(*rest)
+	at := time.Date(2013, 3, 1, 8, 16, 47, 123456789, time.UTC)
+	v, _ := r.newWithObjectId(r.types["Stamp"], bson.NewObjectId())
+	st := v.(*Stamp)
+	st.At, st.ct, st.mt, st.loaded = at, at, at, true
+	data, err := bson.Marshal(r.structToBson(st))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bson.M
+	if err := bson.Unmarshal(data, &b); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := b["at"].(int64); !ok {
+		t.Errorf("want int64 stored, got %T", b["at"])
+	}
+	var got Stamp
+	r.bsonToStruct(b, &got)
+	if !got.At.Equal(at) {
+		t.Errorf("want %v, got %v", at, got.At)
+	}
+	h := &sqHandler{r, &SelectorResource{Type: "Stamp"}}
+	sel, err := h.toMgoSelector(M{"CT": M{"$gt": at}, "MT": []interface{}{at}, "At": M{"$gt": at}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ct, _ := sel["ct"].(map[string]interface{}); ct == nil || ct["$gt"] != at {
+		t.Errorf("want ct compared as a date, got %v", sel["ct"])
+	}
+	if mt, _ := sel["mt"].([]interface{}); len(mt) != 1 || mt[0] != at {
+		t.Errorf("want mt compared as a date, got %v", sel["mt"])
+	}
+	if a, _ := sel["at"].(map[string]interface{}); a == nil || a["$gt"] != at.UnixNano() {
+		t.Errorf("want at compared as nanoseconds, got %v", sel["at"])
+	}
+	if _, err := zonedTime(bson.M{"z": 3600}); err == nil {
+		t.Error("want an error for a zoned time without t")
+	}
+}
+func ExampleIterReset() {
+	ms, err := mgo.Dial("localhost")
+	if err != nil {
+		panic(err)
+	}
+	defer ms.Close()
+	c := ms.DB("rest_test").C("ss")
+	err = c.DropCollection()
+	if err != nil && err.Error() != "ns not found" {
+		panic(err)
+	}
+	s := Dial(ms, "rest_test")
+	s.DefType(SS{})
+	s.DefRes("test-ss-reset", FieldResource{
+		Type:  "SS",
+		Allow: GET,
+	})
+	for i := 0; i < 3; i++ {
+		err = c.Insert(bson.M{"_id": bson.NewObjectId(), "ct": time.Now(), "mt": time.Now(), "s1": fmt.Sprint("Hello", i)})
+		if err != nil {
+			panic(err)
+		}
+	}
+	ctx := s.NewContext()
+	defer ctx.Close()
+	r, err := s.R(NewResId("test-ss-reset"), ctx)
+	if err != nil {
+		panic(err)
+	}
+	resp, err := r.Get()
+	if err != nil {
+		panic(err)
+	}
+	iter := resp.(Iter)
+	for pass := 0; pass < 2; pass++ {
+		var s1 []string
+		for {
+			item, ok := iter.Next()
+			if !ok {
+				break
+			}
+			s1 = append(s1, item.(*SS).S1)
+		}
+		fmt.Println(strings.Join(s1, " "))
+		iter.Reset()
+	}
+	//Output:
+	//Hello2 Hello1 Hello0
+	//Hello2 Hello1 Hello0
+}
+func ExampleIterPeek() {
+	ms, err := mgo.Dial("localhost")
+	if err != nil {
+		panic(err)
+	}
+	defer ms.Close()
+	c := ms.DB("rest_test").C("ss")
+	err = c.DropCollection()
+	if err != nil && err.Error() != "ns not found" {
+		panic(err)
+	}
+	s := Dial(ms, "rest_test")
+	s.DefType(SS{})
+	s.DefRes("test-ss-peek", FieldResource{
+		Type:  "SS",
+		Allow: GET,
+	})
+	for i := 0; i < 2; i++ {
+		err = c.Insert(bson.M{"_id": bson.NewObjectId(), "ct": time.Now(), "mt": time.Now(), "s1": fmt.Sprint("Hello", i)})
+		if err != nil {
+			panic(err)
+		}
+	}
+	ctx := s.NewContext()
+	defer ctx.Close()
+	r, err := s.R(NewResId("test-ss-peek"), ctx)
+	if err != nil {
+		panic(err)
+	}
+	resp, err := r.Get()
+	if err != nil {
+		panic(err)
+	}
+	iter := resp.(Iter)
+	for {
+		peek, ok := iter.Peek()
+		item, _ := iter.Next()
+		if !ok {
+			break
+		}
+		fmt.Println(peek.(*SS).S1, peek == item)
+	}
+	//Output:
+	//Hello1 true
+	//Hello0 true
+}
+
+type Person struct {
+	Base
+	First string
+	Last  string
+}
+
+func (p *Person) Virtual() M {
+	return M{"fullname": p.First + " " + p.Last}
+}
+
+type Shadow struct {
+	Base
+	First string
+}
+
+func (s *Shadow) Virtual() M {
+	return M{"first": s.First}
+}
+
+func TestVirtual(t *testing.T) {
+	s := Dial(nil, "rest_test")
+	s.DefType(Person{})
+	r := s.(*rest)
+	now := time.Now()
+	v, _ := r.newWithObjectId(r.types["Person"], bson.NewObjectId())
+	p := v.(*Person)
+	p.First, p.Last = "Ada", "Lovelace"
+	p.ct, p.mt, p.loaded = now, now, true
+	m := r.structToMap(p, &url.URL{Scheme: "http", Host: "localhost"})
+	if m["fullname"] != "Ada Lovelace" {
+		t.Errorf("want fullname in response, got %v", m)
+	}
+	if _, ok := r.structToBson(p)["fullname"]; ok {
+		t.Error("want fullname not stored")
+	}
+	s.SetStrict(true)
+	var got Person
+	if err := r.mapToStruct(m, &got, nil); err != nil || got.First != "Ada" {
+		t.Errorf("want echoed response accepted, got %v %v", got, err)
+	}
+	defer func() {
+		if b, ok := recover().(*Bug); !ok || !strings.Contains(b.Msg, "collides") {
+			t.Errorf("want collision refused by DefType, got %v", b)
+		}
+	}()
+	s.DefType(Shadow{})
+}
+
+func TestRefShape(t *testing.T) {
+	s := Dial(nil, "rest_test")
+	s.DefType(SS{})
+	r := s.(*rest)
+	id := bson.ObjectIdHex("513063ef69ca944b1000000a")
+	p, _ := r.newWithObjectId(r.types["SS"], id)
+	type ref struct {
+		P *SS
+	}
+	href := "http://abc.com/ss/513063ef69ca944b1000000a"
+	tests := []struct {
+		shape RefShape
+		want  interface{}
+	}{
+		{RefObject, map[string]interface{}{"id": id.Hex(), "type": "ss", "href": href}},
+		{RefId, id.Hex()},
+		{RefHref, href},
+	}
+	for _, test := range tests {
+		s.SetRefShape(test.shape)
+		m := r.structToMap(&ref{p.(*SS)}, baseURL1)
+		if !reflect.DeepEqual(m["p"], test.want) {
+			t.Errorf("shape %d: want %v, got %v", test.shape, test.want, m["p"])
+		}
+		var got ref
+		if err := r.mapToStruct(m, &got, baseURL1); err != nil || got.P == nil || got.P.id != id {
+			t.Errorf("shape %d: want ref read back, got %v %v", test.shape, got.P, err)
+		}
+	}
+	s.SetRefShape(RefHref)
+	for _, h := range []string{href + "/", href + "?a=1", "/ss/513063ef69ca944b1000000a"} {
+		var got ref
+		if err := r.mapToStruct(map[string]interface{}{"p": h}, &got, baseURL1); err != nil || got.P == nil || got.P.id != id {
+			t.Errorf("want href %s read, got %v %v", h, got.P, err)
+		}
+	}
+	for _, h := range []string{"http://abc.com/nobase/513063ef69ca944b1000000a", "http://other.com/ss/513063ef69ca944b1000000a", "http://abc.com/ss/513063ef69ca944b1000000a/x", "513063ef69ca944b1000000a"} {
+		err := r.mapToStruct(map[string]interface{}{"p": h}, &ref{}, baseURL1)
+		if e, ok := err.(*Error); !ok || e.Code != BadRequest || !strings.Contains(e.Msg, "want href") {
+			t.Errorf("want href %s rejected, got %v", h, err)
+		}
+	}
+	s.SetRefShape(RefObject)
+	err := r.mapToStruct(map[string]interface{}{"p": id.Hex()}, &ref{}, baseURL1)
+	if e, ok := err.(*Error); !ok || e.Msg != "field 'p' want {id: objectId}" {
+		t.Errorf("want bare id rejected with RefObject, got %v", err)
+	}
+}
+func ExampleFieldResourcePutIsNew() {
+	ms, err := mgo.Dial("localhost")
+	if err != nil {
+		panic(err)
+	}
+	defer ms.Close()
+	err = ms.DB("rest_test").C("ss").DropCollection()
+	if err != nil && err.Error() != "ns not found" {
+		panic(err)
+	}
+	s := Dial(ms, "rest_test")
+	s.DefType(SS{})
+	s.DefRes("test-ss-put", FieldResource{
+		Type:   "SS",
+		Allow:  PUT,
+		Fields: []string{"S1"},
+		Unique: true,
+	})
+	ctx := s.NewContext()
+	defer ctx.Close()
+	uri, err := ResIdParse("/test-ss-put/hello")
+	if err != nil {
+		panic(err)
+	}
+	r, err := s.R(uri, ctx)
+	if err != nil {
+		panic(err)
+	}
+	resp, err := r.Put(&SS{})
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(resp.(*SS).IsNew())
+	resp, err = r.Put(resp)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(resp.(*SS).IsNew())
+	//Output:
+	//true
+	//false
+}
+
+func TestBeforeHookMethod(t *testing.T) {
+	s := Dial(nil, "rest_test")
+	s.DefType(NoBase{})
+	s.DefType(SS{})
+	s.DefRes("test-nobase-method", SelectorResource{
+		Type:  "NoBase",
+		Allow: GET | POST | PATCH | DELETE,
+		SelectorFunc: func(req *Req, ctx *Context) (M, error) {
+			return M{}, nil
+		},
+	})
+	s.DefRes("test-ss-method", FieldResource{
+		Type:   "SS",
+		Allow:  PUT,
+		Fields: []string{"S1"},
+		Unique: true,
+	})
+	var got Method
+	hook := func(req *Req, ctx *Context) (bool, interface{}, error) {
+		got = req.Method
+		return false, nil, nil
+	}
+	for _, m := range []Method{GET, POST, PATCH, DELETE} {
+		s.Before(m, "test-nobase-method", hook)
+	}
+	s.Before(PUT, "test-ss-method", hook)
+	ctx := &Context{values: make(map[string]interface{})}
+	r, err := s.R(NewResId("test-nobase-method"), ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fr, err := s.R(NewResId("test-ss-method", "x"), ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	calls := map[Method]func() (interface{}, error){
+		GET:    r.Get,
+		PUT:    func() (interface{}, error) { return fr.Put(&SS{}) },
+		POST:   func() (interface{}, error) { return r.Post(&NoBase{}) },
+		PATCH:  func() (interface{}, error) { return r.Patch(M{"S1": "x"}) },
+		DELETE: r.Delete,
+	}
+	for m, call := range calls {
+		got = 0
+		if _, err := call(); err != nil {
+			t.Fatal(err)
+		}
+		if got != m {
+			t.Errorf("want req.Method %v in hook, got %v", m, got)
+		}
+	}
+}
+
+func TestBeforeHookBody(t *testing.T) {
+	s := Dial(nil, "rest_test")
+	s.DefType(NoBase{})
+	s.DefRes("test-nobase-body", SelectorResource{
+		Type:  "NoBase",
+		Allow: POST | PATCH,
+		SelectorFunc: func(req *Req, ctx *Context) (M, error) {
+			return M{}, nil
+		},
+	})
+	var s1 interface{}
+	reject := &Error{Code: BadRequest, Msg: "rejected"}
+	s.Before(POST, "test-nobase-body", func(req *Req, ctx *Context) (bool, interface{}, error) {
+		s1 = req.Body.(*NoBase).S1
+		return false, nil, reject
+	})
+	s.Before(PATCH, "test-nobase-body", func(req *Req, ctx *Context) (bool, interface{}, error) {
+		s1 = req.Body.(M)["Set"].(M)["S1"]
+		return false, nil, reject
+	})
+	ctx := &Context{values: make(map[string]interface{})}
+	r, err := s.R(NewResId("test-nobase-body"), ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Post(&NoBase{S1: "post"}); err != reject || s1 != "post" {
+		t.Errorf("want post body in hook, got %v %v", s1, err)
+	}
+	if _, err := r.Patch(map[string]interface{}{"Set": M{"S1": "patch"}}); err != reject || s1 != "patch" {
+		t.Errorf("want patch updater in hook, got %v %v", s1, err)
+	}
+}
+func ExampleWrapIter() {
+	ms, err := mgo.Dial("localhost")
+	if err != nil {
+		panic(err)
+	}
+	defer ms.Close()
+	c := ms.DB("rest_test").C("ss")
+	err = c.DropCollection()
+	if err != nil && err.Error() != "ns not found" {
+		panic(err)
+	}
+	s := Dial(ms, "rest_test")
+	s.DefType(SS{})
+	s.DefRes("test-ss-wrap", FieldResource{
+		Type:  "SS",
+		Allow: GET,
+	})
+	s.After(GET, "test-ss-wrap", func(req *Req, ctx *Context, resp interface{}, err error) (bool, interface{}, error) {
+		iter, ok := resp.(Iter)
+		if !ok {
+			return true, nil, nil
+		}
+		return false, WrapIter(iter, func(item interface{}) (interface{}, bool) {
+			return item, item.(*SS).S1 != "Hello1"
+		}), err
+	})
+	for i := 0; i < 3; i++ {
+		err = c.Insert(bson.M{"_id": bson.NewObjectId(), "ct": time.Now(), "mt": time.Now(), "s1": fmt.Sprint("Hello", i)})
+		if err != nil {
+			panic(err)
+		}
+	}
+	ctx := s.NewContext()
+	defer ctx.Close()
+	r, err := s.R(NewResId("test-ss-wrap"), ctx)
+	if err != nil {
+		panic(err)
+	}
+	resp, err := r.Get()
+	if err != nil {
+		panic(err)
+	}
+	slice, err := resp.(Iter).Slice()
+	if err != nil {
+		panic(err)
+	}
+	for _, item := range slice.Items() {
+		fmt.Println(item.(*SS).S1)
+	}
+	//Output:
+	//Hello2
+	//Hello0
+}
+
+type listIter struct {
+	Iter
+	items []interface{}
+	i     int
+}
+
+func (li *listIter) Next() (interface{}, bool) {
+	if li.i == len(li.items) {
+		return nil, false
+	}
+	li.i++
+	return li.items[li.i-1], true
+}
+func (li *listIter) Reset() { li.i = 0 }
+
+func TestWrapIter(t *testing.T) {
+	odd := func(item interface{}) (interface{}, bool) { return item, item.(int)%2 == 1 }
+	double := func(item interface{}) (interface{}, bool) { return item.(int) * 2, true }
+	iter := WrapIter(WrapIter(&listIter{items: []interface{}{1, 2, 3, 4, 5}}, odd), double)
+	for pass := 0; pass < 2; pass++ {
+		if item, ok := iter.Peek(); !ok || item != 2 {
+			t.Fatalf("want peek 2, got %v", item)
+		}
+		var got []interface{}
+		for item, ok := iter.Next(); ok; item, ok = iter.Next() {
+			got = append(got, item)
+		}
+		if !reflect.DeepEqual(got, []interface{}{2, 6, 10}) {
+			t.Errorf("want [2 6 10], got %v", got)
+		}
+		iter.Reset()
+	}
+}
+
+func TestPatchPrecondition(t *testing.T) {
+	s := Dial(nil, "rest_test")
+	s.DefType(SS{})
+	r := s.(*rest)
+	typ := r.types["SS"]
+	updater, err := r.mapToUpdater(map[string]interface{}{
+		"set": map[string]interface{}{"s1": "done"},
+		"if":  map[string]interface{}{"s1": "pending"},
+	}, baseURL1, typ)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sel := bson.M{"_id": bson.ObjectIdHex("513063ef69ca944b1000000a")}
+	q, ok := r.toMgoPrecondition(sel, updater, typ)
+	want := bson.M{"$and": []interface{}{sel, bson.M{"s1": "pending"}}}
+	if !ok || !reflect.DeepEqual(q, want) {
+		t.Errorf("want %v, got %v", want, q)
+	}
+	if u, _ := r.toMgoUpdater(updater, typ, []string{"S1"}); u["$set"].(map[string]interface{})["s1"] == nil {
+		t.Errorf("want set kept beside if")
+	}
+	if q, ok := r.toMgoPrecondition(sel, M{"Set": M{"S1": "done"}}, typ); ok || !reflect.DeepEqual(q, sel) {
+		t.Errorf("want selector untouched without if, got %v", q)
+	}
+}
+func ExamplePatchPrecondition() {
+	ms, err := mgo.Dial("localhost")
+	if err != nil {
+		panic(err)
+	}
+	defer ms.Close()
+	c := ms.DB("rest_test").C("ss")
+	err = c.DropCollection()
+	if err != nil && err.Error() != "ns not found" {
+		panic(err)
+	}
+	s := Dial(ms, "rest_test")
+	s.DefType(SS{})
+	s.DefRes("test-ss-if", FieldResource{
+		Type:        "SS",
+		Allow:       PATCH,
+		Fields:      []string{"Id"},
+		Unique:      true,
+		PatchFields: []string{"S1"},
+	})
+	id := bson.NewObjectId()
+	err = c.Insert(bson.M{"_id": id, "ct": time.Now(), "mt": time.Now(), "s1": "pending"})
+	if err != nil {
+		panic(err)
+	}
+	ctx := s.NewContext()
+	defer ctx.Close()
+	r, err := s.R(NewResId("test-ss-if", id.Hex()), ctx)
+	if err != nil {
+		panic(err)
+	}
+	_, err = r.Patch(M{"Set": M{"S1": "done"}, "If": M{"S1": "draft"}})
+	fmt.Println(err)
+	_, err = r.Patch(M{"Set": M{"S1": "done"}, "If": M{"S1": "pending"}})
+	fmt.Println(err)
+	//Output:
+	//precondition failed
+	//<nil>
+}
+
+func ExamplePutMany() {
+	ms, err := mgo.Dial("localhost")
+	if err != nil {
+		panic(err)
+	}
+	defer ms.Close()
+	c := ms.DB("rest_test").C("ss")
+	err = c.DropCollection()
+	if err != nil && err.Error() != "ns not found" {
+		panic(err)
+	}
+	s := Dial(ms, "rest_test")
+	s.DefType(SS{})
+	s.DefRes("test-ss-sync", FieldResource{
+		Type:  "SS",
+		Allow: PUT | GET,
+		Sync:  true,
+	})
+	old := bson.NewObjectId()
+	err = c.Insert(bson.M{"_id": old, "ct": time.Now(), "mt": time.Now(), "s1": "old"})
+	if err != nil {
+		panic(err)
+	}
+	ctx := s.NewContext()
+	defer ctx.Close()
+	r, err := s.R(NewResId("test-ss-sync"), ctx)
+	if err != nil {
+		panic(err)
+	}
+	rs := s.(*rest)
+	bodies := make([]interface{}, 0, 3)
+	for _, id := range []bson.ObjectId{old, bson.NewObjectId(), bson.NewObjectId()} {
+		v, _ := rs.newWithObjectId(rs.types["SS"], id)
+		v.(*SS).S1 = "synced"
+		bodies = append(bodies, v)
+	}
+	result, err := r.PutMany(bodies)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(result.Inserted, result.Modified, len(result.Conflicts))
+	n, err := c.Find(bson.M{"s1": "synced"}).Count()
+	fmt.Println(n, err)
+	//Output:
+	//2 1 0
+	//3 <nil>
+}
+
+func ExamplePostClientId() {
+	ms, err := mgo.Dial("localhost")
+	if err != nil {
+		panic(err)
+	}
+	defer ms.Close()
+	c := ms.DB("rest_test").C("ss")
+	err = c.DropCollection()
+	if err != nil && err.Error() != "ns not found" {
+		panic(err)
+	}
+	s := Dial(ms, "rest_test")
+	s.DefType(SS{})
+	s.DefRes("test-ss-import", FieldResource{
+		Type:          "SS",
+		Allow:         POST,
+		AllowClientId: true,
+	})
+	ctx := s.NewContext()
+	defer ctx.Close()
+	r, err := s.R(NewResId("test-ss-import"), ctx)
+	if err != nil {
+		panic(err)
+	}
+	id := bson.NewObjectId()
+	m := map[string]interface{}{"id": id.Hex(), "s1": "imported"}
+	for i := 0; i < 2; i++ {
+		body, err := r.Meta().MapToRequest(m, nil)
+		if err != nil {
+			panic(err)
+		}
+		_, err = r.Post(body)
+		fmt.Println(err)
+	}
+	var got bson.M
+	err = c.FindId(id).One(&got)
+	fmt.Println(got["s1"], err)
+	//Output:
+	//<nil>
+	//conflict
+	//imported <nil>
+}
+
+func ExampleExportImport() {
+	ms, err := mgo.Dial("localhost")
+	if err != nil {
+		panic(err)
+	}
+	defer ms.Close()
+	c := ms.DB("rest_test").C("ss")
+	err = c.DropCollection()
+	if err != nil && err.Error() != "ns not found" {
+		panic(err)
+	}
+	s := Dial(ms, "rest_test")
+	s.DefType(SS{})
+	s.SetTimeFormat(UnixTime)
+	ct := time.Date(2013, 3, 1, 8, 0, 0, 123000000, time.UTC)
+	ids := []bson.ObjectId{bson.NewObjectId(), bson.NewObjectId()}
+	for i, id := range ids {
+		err = c.Insert(bson.M{"_id": id, "ct": ct, "mt": ct, "s1": fmt.Sprint("s", i)})
+		if err != nil {
+			panic(err)
+		}
+	}
+	ctx := s.NewContext()
+	defer ctx.Close()
+	var buf bytes.Buffer
+	n, err := s.Export(ctx, "SS", &buf)
+	fmt.Println(n, err)
+	err = c.DropCollection()
+	if err != nil {
+		panic(err)
+	}
+	n, err = s.Import(ctx, "SS", &buf)
+	fmt.Println(n, err)
+	for _, id := range ids {
+		var got bson.M
+		err = c.FindId(id).One(&got)
+		fmt.Println(got["s1"], got["ct"].(time.Time).Equal(ct), err)
+	}
+	//Output:
+	//2 <nil>
+	//2 <nil>
+	//s0 true <nil>
+	//s1 true <nil>
+}
+func TestPatchDryRun(t *testing.T) {
+	s := Dial(nil, "rest_test")
+	s.DefType(S{})
+	s.DefRes("test-s-dry", FieldResource{
+		Type:        "S",
+		Allow:       PATCH,
+		Fields:      []string{"Id"},
+		Unique:      true,
+		PatchFields: []string{"S1"},
+	})
+	ctx := &Context{values: make(map[string]interface{})}
+	resId, err := ResIdParse("/test-s-dry/513063ef69ca944b1000000a?dryrun=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := s.R(resId, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Patch(M{"Set": M{"S1": "ok"}}); err != nil {
+		t.Errorf("want dry patch accepted without touching the db, got %v", err)
+	}
+	_, err = r.Patch(M{"Set": M{"S1": "ok", "S2": "no"}})
+	if e, ok := err.(*Error); !ok || e.Code != BadRequest || e.Fields["S2"] != "not_allowed" || len(e.Fields) != 1 {
+		t.Errorf("want S2 reported not allowed, got %v", err)
+	}
+}
+func TestPatchBadField(t *testing.T) {
+	s := Dial(nil, "rest_test")
+	s.DefType(S{})
+	s.DefRes("test-s-bad", FieldResource{
+		Type:        "S",
+		Allow:       PATCH,
+		Fields:      []string{"Id"},
+		Unique:      true,
+		PatchFields: []string{"S1"},
+	})
+	ctx := &Context{values: make(map[string]interface{})}
+	r, err := s.R(NewResId("test-s-bad", "513063ef69ca944b1000000a"), ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for field, updater := range map[string]M{
+		"Nope": {"Set": M{"Nope": 1}},
+		"S2":   {"Add": M{"S2": 1}},
+		"If":   {"Set": M{"S1": "x"}, "If": M{"If": 1}},
+	} {
+		_, err := r.Patch(updater)
+		if e, ok := err.(*Error); !ok || e.Code != BadRequest || e.Fields[field] == "" {
+			t.Errorf("want 400 naming %s, got %v", field, err)
+		}
+	}
+	if _, err := r.Patch(M{"Unset": M{}}); err == nil || err.(*Error).Code != BadRequest {
+		t.Errorf("want 400 for unknown op, got %v", err)
+	}
+}
+
+type Scored struct {
+	Base
+	S1     string
+	Scores []int
+	Refs   []SS
+}
+
+func TestSelectorElemMatch(t *testing.T) {
+	s := Dial(nil, "rest_test")
+	s.DefType(SS{})
+	s.DefType(Scored{})
+	r := s.(*rest)
+	h := newSQHandler(r, &SelectorResource{Type: "Scored", SelectorFields: []string{"S1", "Scores", "Refs"}})
+	sel, err := h.toMgoSelector(M{"Scores": M{"$elemMatch": M{"$gte": 80, "$lt": 85}}})
+	want := map[string]interface{}{"scores": map[string]interface{}{"$elemMatch": map[string]interface{}{"$gte": 80, "$lt": 85}}}
+	if err != nil || !reflect.DeepEqual(sel, want) {
+		t.Errorf("want %v, got %v %v", want, sel, err)
+	}
+	id := bson.ObjectIdHex("513063ef69ca944b1000000a")
+	ref, _ := r.newWithObjectId(r.types["SS"], id)
+	sel, err = h.toMgoSelector(M{"Refs": M{"$elemMatch": M{"$in": A{ref}}}})
+	want = map[string]interface{}{"refs": map[string]interface{}{"$elemMatch": map[string]interface{}{"$in": []interface{}{id}}}}
+	if err != nil || !reflect.DeepEqual(sel, want) {
+		t.Errorf("want %v, got %v %v", want, sel, err)
+	}
+	_, err = h.toMgoSelector(M{"Scores": M{"$elemMatch": M{"S1": "a"}}})
+	if e, ok := err.(*Error); !ok || e.Code != BadRequest {
+		t.Errorf("want field name inside scalar $elemMatch refused, got %v", err)
+	}
+}
+
+type ctxHandler struct {
+	get func(req *Req, ctx *Context) (interface{}, error)
+}
+
+func (h ctxHandler) Get(req *Req, ctx *Context) (interface{}, error) {
+	return h.get(req, ctx)
+}
+func TestNestedRSharesContext(t *testing.T) {
+	s := Dial(nil, "rest_test")
+	s.DefType(NoBase{})
+	var inner []*Context
+	s.DefRes("test-ctx-inner", CustomResource{
+		RequestType:  "NoBase",
+		ResponseType: "NoBase",
+		Handler: ctxHandler{func(req *Req, ctx *Context) (interface{}, error) {
+			inner = append(inner, ctx)
+			return &NoBase{}, nil
+		}},
+	})
+	s.DefRes("test-ctx-outer", CustomResource{
+		RequestType:  "NoBase",
+		ResponseType: "NoBase",
+		Handler: ctxHandler{func(req *Req, ctx *Context) (interface{}, error) {
+			for i := 0; i < 2; i++ {
+				r, err := s.R(NewResId("test-ctx-inner"), ctx)
+				if err != nil {
+					return nil, err
+				}
+				if _, err = r.Get(); err != nil {
+					return nil, err
+				}
+			}
+			return &NoBase{}, nil
+		}},
+	})
+	// Dial(nil) has no session to copy, so a nested copy would panic.
+	ctx := &Context{r: s.(*rest), values: make(map[string]interface{})}
+	r, err := s.R(NewResId("test-ctx-outer"), ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = r.Get(); err != nil {
+		t.Fatal(err)
+	}
+	if len(inner) != 2 || inner[0] != ctx || inner[1] != ctx || ctx.s != nil {
+		t.Errorf("want nested R calls to share the request's Context, got %v", inner)
+	}
+}
+
+type patchHandler struct {
+	body *interface{}
+}
+
+func (h patchHandler) Patch(req *Req, ctx *Context) (interface{}, error) {
+	*h.body = req.Body
+	return nil, nil
+}
+func TestCustomPatchTypedBody(t *testing.T) {
+	s := Dial(nil, "rest_test")
+	s.DefType(NoBase{})
+	var body interface{}
+	s.DefRes("test-nobase-patch", CustomResource{
+		RequestType:  "NoBase",
+		ResponseType: "NoBase",
+		Handler:      patchHandler{&body},
+	})
+	ctx := &Context{values: make(map[string]interface{})}
+	r, err := s.R(NewResId("test-nobase-patch"), ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Meta().PatchesUpdater() {
+		t.Error("want custom resource patched with its request type")
+	}
+	req, err := r.Meta().MapToRequest(map[string]interface{}{"s1": "patched"}, baseURL1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = r.Patch(req); err != nil {
+		t.Fatal(err)
+	}
+	if nb, ok := body.(*NoBase); !ok || nb.S1 != "patched" {
+		t.Errorf("want typed body in handler, got %#v", body)
+	}
+}
+func TestEmptyPath(t *testing.T) {
+	s := Dial(nil, "rest_test")
+	s.DefRes("test-img-path", ImageResource{})
+	ctx := &Context{values: make(map[string]interface{})}
+	for _, u := range []string{"", "http://abc.com"} {
+		if _, err := ResIdParse(u); err == nil {
+			t.Errorf("want '%s' refused", u)
+		}
+	}
+	root, err := ResIdParse("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = root.Segment(0); err == nil || err.(*Error).Code != InternalServerError {
+		t.Errorf("want InternalServerError segment before R, got %v", err)
+	}
+	if _, err = s.R(root, ctx); err != nil {
+		t.Errorf("want the index at root, got %v", err)
+	}
+	nope, err := ResIdParse("/nope")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.R(nope, ctx); err == nil || err.(*Error).Code != NotFound {
+		t.Errorf("want NotFound for unknown resource, got %v", err)
+	}
+	if _, err = nope.Segment(0); err == nil || err.(*Error).Code != NotFound {
+		t.Errorf("want NotFound segment of unknown resource, got %v", err)
+	}
+	img, err := ResIdParse("/test-img-path")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := s.R(img, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = r.Get(); err == nil || err.(*Error).Code != NotFound {
+		t.Errorf("want NotFound for image without file name, got %v", err)
+	}
+}
+func TestRootIndex(t *testing.T) {
+	s := Dial(nil, "rest_test")
+	s.DefType(NoBase{})
+	sel := SelectorResource{
+		Type: "NoBase",
+		SelectorFunc: func(req *Req, ctx *Context) (M, error) {
+			return M{}, nil
+		},
+	}
+	s.DefRes("test-nobase-index", sel)
+	s.DefRes("-test-nobase-sys", sel)
+	for _, sys := range []bool{false, true} {
+		ctx := &Context{sys: sys, values: make(map[string]interface{})}
+		root, err := ResIdParse("/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := s.R(root, ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := r.Get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := r.Meta().ResponseToMap(resp, baseURL1)
+		want := []interface{}{map[string]interface{}{"name": "test-nobase-index", "href": "http://abc.com/test-nobase-index"}}
+		if sys {
+			want = append([]interface{}{map[string]interface{}{"name": "-test-nobase-sys", "href": "http://abc.com/-test-nobase-sys"}}, want...)
+		}
+		if !reflect.DeepEqual(m["resources"], want) {
+			t.Errorf("sys %v: want %v, got %v", sys, want, m["resources"])
+		}
+	}
+}
+
+func ExampleFieldResourcePutReplace() {
+	ms, err := mgo.Dial("localhost")
+	if err != nil {
+		panic(err)
+	}
+	defer ms.Close()
+	c := ms.DB("rest_test").C("ss")
+	err = c.DropCollection()
+	if err != nil && err.Error() != "ns not found" {
+		panic(err)
+	}
+	s := Dial(ms, "rest_test")
+	s.DefType(SS{})
+	s.DefRes("test-ss-replace", FieldResource{
+		Type:    "SS",
+		Allow:   PUT,
+		Fields:  []string{"S1"},
+		Replace: true,
+	})
+	for _, s1 := range []string{"a", "a", "b"} {
+		err = c.Insert(bson.M{"_id": bson.NewObjectId(), "ct": time.Now(), "mt": time.Now(), "s1": s1})
+		if err != nil {
+			panic(err)
+		}
+	}
+	ctx := s.NewContext()
+	defer ctx.Close()
+	r, err := s.R(NewResId("test-ss-replace", "a"), ctx)
+	if err != nil {
+		panic(err)
+	}
+	resp, err := r.Put(&SS{})
+	if err != nil {
+		panic(err)
+	}
+	na, _ := c.Find(bson.M{"s1": "a"}).Count()
+	nb, _ := c.Find(bson.M{"s1": "b"}).Count()
+	ss := resp.(*SS)
+	fmt.Println(ss.S1, ss.IsNew(), na, nb)
+	//Output:
+	//a true 1 1
+}
+func TestMaxPathSegments(t *testing.T) {
+	s := Dial(nil, "rest_test")
+	s.DefRes("test-img-segs", ImageResource{})
+	ctx := &Context{values: make(map[string]interface{})}
+	r := func(n int) error {
+		resId, err := ResIdParse("/test-img-segs" + strings.Repeat("/b", n-1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = s.R(resId, ctx)
+		return err
+	}
+	if err := r(defaultMaxSegments); err != nil {
+		t.Errorf("want %d segments accepted, got %v", defaultMaxSegments, err)
+	}
+	if e, ok := r(defaultMaxSegments + 1).(*Error); !ok || e.Code != BadRequest {
+		t.Errorf("want over-long path refused, got %v", e)
+	}
+	s.SetMaxPathSegments(3)
+	if err := r(3); err != nil {
+		t.Errorf("want 3 segments accepted, got %v", err)
+	}
+	if e, ok := r(4).(*Error); !ok || e.Code != BadRequest {
+		t.Errorf("want 4 segments refused, got %v", e)
+	}
+}
+func TestSegmentEscape(t *testing.T) {
+	seg := "a/b?c d"
+	u := NewResId("test-ss", seg).URL()
+	if s := u.String(); s != "/test-ss/a%2Fb%3Fc%20d" {
+		t.Errorf("want segment escaped, got %s", s)
+	}
+	resId, err := ResIdParse(u.String() + "?n=1")
+	if err != nil || resId.NumSegment() != 1 || resId.path[1] != seg || resId.Params["n"] != "1" {
+		t.Errorf("want %q back, got %v %v", seg, resId, err)
+	}
+}
+
+func ExamplePutManyConflict() {
+	ms, err := mgo.Dial("localhost")
+	if err != nil {
+		panic(err)
+	}
+	defer ms.Close()
+	c := ms.DB("rest_test").C("ss")
+	err = c.DropCollection()
+	if err != nil && err.Error() != "ns not found" {
+		panic(err)
+	}
+	s := Dial(ms, "rest_test")
+	s.DefType(SS{})
+	s.DefRes("test-ss-sync", FieldResource{
+		Type:  "SS",
+		Allow: PUT,
+		Sync:  true,
+	})
+	s.Index("SS", I{Fields: []string{"S1"}, Unique: true})
+	err = c.Insert(bson.M{"_id": bson.NewObjectId(), "ct": time.Now(), "mt": time.Now(), "s1": "taken"})
+	if err != nil {
+		panic(err)
+	}
+	ctx := s.NewContext()
+	defer ctx.Close()
+	r, err := s.R(NewResId("test-ss-sync"), ctx)
+	if err != nil {
+		panic(err)
+	}
+	result, err := r.PutMany([]interface{}{&SS{S1: "a"}, &SS{S1: "taken"}, &SS{S1: "b"}})
+	if err != nil {
+		panic(err)
+	}
+	for _, item := range result.Items {
+		fmt.Println(item.Status)
+	}
+	fmt.Println(result.Inserted, result.Conflicts, result.Failed())
+	//Output:
+	//201
+	//409
+	//201
+	//2 [1] true
+}
+func ExamplePutManyScope() {
+	ms, err := mgo.Dial("localhost")
+	if err != nil {
+		panic(err)
+	}
+	defer ms.Close()
+	c := ms.DB("rest_test").C("ss")
+	err = c.DropCollection()
+	if err != nil && err.Error() != "ns not found" {
+		panic(err)
+	}
+	s := Dial(ms, "rest_test")
+	s.DefType(SS{})
+	s.DefRes("test-ss-owned", FieldResource{
+		Type:   "SS",
+		Fields: []string{"S1"},
+		Allow:  PUT,
+		Sync:   true,
+	})
+	s.Before(PUT, "test-ss-owned", func(req *Req, ctx *Context) (bool, interface{}, error) {
+		if getBase(reflect.ValueOf(req.Body).Elem()).id == "" {
+			return false, nil, &Error{Code: Forbidden}
+		}
+		return true, nil, nil
+	})
+	bobs := bson.NewObjectId()
+	err = c.Insert(bson.M{"_id": bobs, "ct": time.Now(), "mt": time.Now(), "s1": "bob"})
+	if err != nil {
+		panic(err)
+	}
+	ctx := s.NewContext()
+	defer ctx.Close()
+	r, err := s.R(NewResId("test-ss-owned", "alice"), ctx)
+	if err != nil {
+		panic(err)
+	}
+	rs := s.(*rest)
+	bodies := make([]interface{}, 0, 3)
+	for _, id := range []bson.ObjectId{bobs, bson.NewObjectId()} {
+		v, _ := rs.newWithObjectId(rs.types["SS"], id)
+		bodies = append(bodies, v)
+	}
+	bodies = append(bodies, &SS{})
+	result, err := r.PutMany(bodies)
+	if err != nil {
+		panic(err)
+	}
+	for _, item := range result.Items {
+		fmt.Println(item.Status)
+	}
+	var bob bson.M
+	err = c.FindId(bobs).One(&bob)
+	fmt.Println(bob["s1"], err)
+	//Output:
+	//409
+	//201
+	//403
+	//bob <nil>
+}
+
+type Profile struct {
+	Base
+	FirstName string
+	URLPath   string
+	S1        string
+}
+
+func TestFieldNaming(t *testing.T) {
+	for _, c := range []struct {
+		name, camel, snake string
+	}{
+		{"FirstName", "firstName", "first_name"},
+		{"URLPath", "urlPath", "url_path"},
+		{"URL", "url", "url"},
+		{"S1", "s1", "s1"},
+		{"ID2", "id2", "id2"},
+	} {
+		if got := CamelCase.key(c.name); got != c.camel {
+			t.Errorf("camel %s: want %s, got %s", c.name, c.camel, got)
+		}
+		if got := SnakeCase.key(c.name); got != c.snake {
+			t.Errorf("snake %s: want %s, got %s", c.name, c.snake, got)
+		}
+	}
+	s := Dial(nil, "rest_test")
+	s.DefType(Profile{})
+	s.SetStrict(true)
+	r := s.(*rest)
+	for naming, key := range map[FieldNaming]string{CamelCase: "firstName", SnakeCase: "first_name", LowerCase: "firstname"} {
+		s.SetFieldNaming(naming)
+		v, _ := r.newWithObjectId(r.types["Profile"], bson.ObjectIdHex("513063ef69ca944b1000000a"))
+		p := v.(*Profile)
+		p.FirstName, p.URLPath, p.S1 = "Ada", "/a", "x"
+		p.ct, p.mt, p.loaded = time.Now(), time.Now(), true
+		m := r.structToMap(p, baseURL1)
+		if m[key] != "Ada" {
+			t.Errorf("naming %d: want %s in %v", naming, key, m)
+		}
+		var got Profile
+		if err := r.mapToStruct(m, &got, baseURL1); err != nil || got.FirstName != "Ada" || got.URLPath != "/a" {
+			t.Errorf("naming %d: want round trip, got %+v %v", naming, got, err)
+		}
+		b := r.structToBson(p)
+		if b["firstname"] != "Ada" {
+			t.Errorf("naming %d: want storage key firstname, got %v", naming, b)
+		}
+	}
+}
+
+type Contact struct {
+	Base
+	FirstName string `bson:"fn" json:"firstName"`
+	Phone     string `bson:"ph"`
+	Email     string `json:"mail,omitempty"`
+}
+
+func TestFieldTags(t *testing.T) {
+	s := Dial(nil, "rest_test")
+	s.DefType(Contact{})
+	s.SetStrict(true)
+	r := s.(*rest)
+	v, _ := r.newWithObjectId(r.types["Contact"], bson.ObjectIdHex("513063ef69ca944b1000000b"))
+	c := v.(*Contact)
+	c.FirstName, c.Phone, c.Email = "Ada", "123", "ada@example.com"
+	c.ct, c.mt, c.loaded = time.Now(), time.Now(), true
+	m := r.structToMap(c, baseURL1)
+	if m["firstName"] != "Ada" || m["phone"] != "123" || m["mail"] != "ada@example.com" {
+		t.Errorf("want json keys, got %v", m)
+	}
+	b := r.structToBson(c)
+	if b["fn"] != "Ada" || b["ph"] != "123" || b["email"] != "ada@example.com" {
+		t.Errorf("want bson keys, got %v", b)
+	}
+	var got Contact
+	r.bsonToStruct(b, &got)
+	if got.FirstName != "Ada" || got.Phone != "123" {
+		t.Errorf("want bson round trip, got %+v", got)
+	}
+	got = Contact{}
+	if err := r.mapToStruct(m, &got, baseURL1); err != nil || got.FirstName != "Ada" || got.Email != "ada@example.com" {
+		t.Errorf("want json round trip, got %+v %v", got, err)
+	}
+	u, err := r.toMgoUpdater(M{"Set": M{"FirstName": "Bo"}}, r.types["Contact"], []string{"FirstName"})
+	if set, _ := u["$set"].(map[string]interface{}); err != nil || set == nil || set["fn"] != "Bo" {
+		t.Errorf("want $set of fn, got %v %v", u, err)
+	}
+	if keys := r.fieldsToKeys(r.types["Contact"], []string{"-FirstName"}); keys[0] != "-fn" {
+		t.Errorf("want sort key -fn, got %v", keys)
+	}
+	for want, typ := range map[string]interface{}{
+		"field 'S' of '': json tag '-' not supported": struct {
+			Base
+			S string `json:"-"`
+		}{},
+		"field 'S' of '': bson tag '-' not supported": struct {
+			Base
+			S string `bson:"-"`
+		}{},
+		"field 'Created' of '': bson tag 'ct' is reserved": struct {
+			Base
+			Created time.Time `bson:"ct"`
+		}{},
+		"field 'Ref' of '': json tag 'id' is reserved": struct {
+			Base
+			Ref string `json:"id"`
+		}{},
+	} {
+		func() {
+			defer func() {
+				if b, ok := recover().(*Bug); !ok || b.Msg != want {
+					t.Errorf("want %q at DefType, got %v", want, b)
+				}
+			}()
+			checkTags(reflect.TypeOf(typ))
+		}()
+	}
+}
+func TestResourceMeta(t *testing.T) {
+	s := Dial(nil, "rest_test")
+	s.DefType(NoBase{})
+	s.DefRes("test-nobase-meta", CustomResource{
+		RequestType:  "NoBase",
+		ResponseType: "NoBase",
+		Handler:      patchHandler{new(interface{})},
+	})
+	r, err := s.R(NewResId("test-nobase-meta"), &Context{values: make(map[string]interface{})})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rm := r.Meta()
+	if rm == nil || rm.RequestType() != reflect.TypeOf(NoBase{}) || rm.ResponseType() != reflect.TypeOf(NoBase{}) {
+		t.Fatalf("want NoBase meta, got %v", rm)
+	}
+	if _, ok := rm.NewRequest().(*NoBase); !ok {
+		t.Errorf("want *NoBase request, got %T", rm.NewRequest())
+	}
+}
+func TestBindParams(t *testing.T) {
+	s := Dial(nil, "rest_test")
+	s.DefType(SS{})
+	s.DefRes("test-ss-children", SelectorResource{
+		Type:             "SS",
+		PathSegmentTypes: []string{"SS"},
+		SelectorFunc: func(req *Req, ctx *Context) (M, error) {
+			return M{}, nil
+		},
+	})
+	s.BindParams("children", "SS", "test-ss-children", []interface{}{F("Id")}, Params{"n": "10"})
+	r := s.(*rest)
+	v, _ := r.newWithObjectId(r.types["SS"], bson.ObjectIdHex("513063ef69ca944b1000000a"))
+	ss := v.(*SS)
+	want := "/test-ss-children/513063ef69ca944b1000000a?n=10"
+	if u := ss.Rel("children").URL().String(); u != want {
+		t.Errorf("want %s, got %s", want, u)
+	}
+	if u := ss.AllRels()["children"].URL().String(); u != want {
+		t.Errorf("want %s in AllRels, got %s", want, u)
+	}
+	ss.Rel("children").Params["n"] = "20"
+	if u := ss.Rel("children").URL().String(); u != want {
+		t.Errorf("want default params unchanged, got %s", u)
+	}
+}
+func TestBindFunc(t *testing.T) {
+	s := Dial(nil, "rest_test")
+	s.DefType(SS{})
+	s.DefRes("test-ss-similar", CustomResource{
+		RequestType:      "SS",
+		ResponseType:     "SS",
+		PathSegmentTypes: []string{"SS"},
+		Handler:          patchHandler{new(interface{})},
+	})
+	s.BindFunc("similar", "SS", func(self interface{}) *ResId {
+		return NewResId("test-ss-similar", self)
+	})
+	r := s.(*rest)
+	v, _ := r.newWithObjectId(r.types["SS"], bson.ObjectIdHex("513063ef69ca944b1000000a"))
+	rels := v.(*SS).AllRels()
+	want := "/test-ss-similar/513063ef69ca944b1000000a"
+	if rel, ok := rels["similar"]; !ok || rel.URL().String() != want {
+		t.Errorf("want similar %s in AllRels, got %v", want, rels)
+	}
+}
+func TestDefTypeNoSelf(t *testing.T) {
+	s := Dial(nil, "rest_test")
+	s.DefTypeWithOptions(SS{}, TypeOptions{NoSelf: true})
+	_, err := s.R(NewResId("ss", "513063ef69ca944b1000000a"), &Context{values: make(map[string]interface{})})
+	if e, ok := err.(*Error); !ok || e.Code != NotFound {
+		t.Errorf("want NotFound without self resource, got %v", err)
+	}
+	s.DefType(Scored{})
+	if _, err = s.R(NewResId("scored", "513063ef69ca944b1000000a"), &Context{values: make(map[string]interface{})}); err != nil {
+		t.Errorf("want self resource by default, got %v", err)
+	}
+}
+func TestBindUnknownField(t *testing.T) {
+	s := Dial(nil, "rest_test")
+	s.DefType(SS{})
+	s.DefRes("test-ss-by-s1", FieldResource{Type: "SS", Fields: []string{"S1"}, Allow: GET})
+	for _, f := range []F{"S2", "loaded"} {
+		func() {
+			defer func() {
+				want := fmt.Sprintf("field '%s' not in 'mogogo.SS'", f)
+				if b, ok := recover().(*Bug); !ok || b.Msg != want {
+					t.Errorf("want %q at Bind, got %v", want, b)
+				}
+			}()
+			s.Bind("by-"+string(f), "SS", "test-ss-by-s1", []interface{}{f})
+		}()
+	}
+}
+
+type Flagged struct {
+	Base
+	Flag bool
+}
+
+func TestContextRefWrongType(t *testing.T) {
+	s := Dial(nil, "rest_test")
+	s.DefType(Flagged{})
+	s.DefRes("test-flagged", FieldResource{Type: "Flagged", ContextRef: map[string]string{"Flag": "flag"}, Allow: GET | POST})
+	h := s.(*rest).queries["test-flagged"].Handler.(*fqHandler)
+	ctx := &Context{values: make(map[string]interface{})}
+	ctx.Set("flag", "yes")
+	req := &Req{ResId: NewResId("test-flagged")}
+	want := "context 'flag' is string, field 'Flag' wants bool"
+	if _, err := h.query(req, ctx); err == nil || err.(*Error).Code != InternalServerError || err.(*Error).Msg != want {
+		t.Errorf("want %q from query, got %v", want, err)
+	}
+	if err := h.setStructFields(&Flagged{}, req, ctx); err == nil || err.(*Error).Msg != want {
+		t.Errorf("want %q from setStructFields, got %v", want, err)
+	}
+	ctx.Set("flag", true)
+	var f Flagged
+	if err := h.setStructFields(&f, req, ctx); err != nil || !f.Flag {
+		t.Errorf("want flag set, got %v %v", f.Flag, err)
+	}
+}
+func TestFieldResourceMulti(t *testing.T) {
+	s := Dial(nil, "rest_test")
+	s.DefType(SS{})
+	s.DefRes("test-ss-multi", FieldResource{Type: "SS", Fields: []string{"Id"}, Allow: GET, Multi: true})
+	ids := []interface{}{
+		bson.ObjectIdHex("513063ef69ca944b1000000a"),
+		bson.ObjectIdHex("513063ef69ca944b1000000b"),
+		bson.ObjectIdHex("513063ef69ca944b1000000c"),
+	}
+	resId, err := ResIdParse("/test-ss-multi/513063ef69ca944b1000000a,513063ef69ca944b1000000b,513063ef69ca944b1000000c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := s.R(resId, &Context{values: make(map[string]interface{})})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := s.(*rest).queries["test-ss-multi"].Handler.(*fqHandler)
+	q, err := h.query(&Req{ResId: r.Id()}, nil)
+	if want := (bson.M{"_id": bson.M{"$in": ids}}); err != nil || !reflect.DeepEqual(q, want) {
+		t.Errorf("want %v, got %v %v", want, q, err)
+	}
+	seg, err := r.Id().Segment(0)
+	if u := NewResId("test-ss-multi", seg).URL().String(); err != nil || u != resId.URL().String() {
+		t.Errorf("want %s, got %s", resId.URL(), u)
+	}
+	bad, _ := ResIdParse("/test-ss-multi/513063ef69ca944b1000000a,x")
+	if _, err = s.R(bad, nil); err == nil {
+		_, err = h.query(&Req{ResId: bad}, nil)
+	}
+	if e, ok := err.(*Error); !ok || e.Code != BadRequest {
+		t.Errorf("want BadRequest for a bad id in the list, got %v", err)
+	}
+}
+func ExampleCollectionPrefix() {
+	ms, err := mgo.Dial("localhost")
+	if err != nil {
+		panic(err)
+	}
+	defer ms.Close()
+	for _, name := range []string{"t1_ss", "t2_ss"} {
+		err = ms.DB("rest_test").C(name).DropCollection()
+		if err != nil && err.Error() != "ns not found" {
+			panic(err)
+		}
+	}
+	s := Dial(ms, "rest_test")
+	s.DefType(SS{})
+	s.DefRes("test-ss-tenant", FieldResource{Type: "SS", Allow: POST})
+	s.Index("SS", I{Fields: []string{"S1"}, Unique: true})
+	s.SetCollectionPrefix(func(ctx *Context) string {
+		tenant, _ := ctx.Get("tenant")
+		return tenant.(string) + "_"
+	})
+	for _, tenant := range []string{"t1", "t2"} {
+		ctx := s.NewContext()
+		ctx.Set("tenant", tenant)
+		r, err := s.R(NewResId("test-ss-tenant"), ctx)
+		if err != nil {
+			panic(err)
+		}
+		_, err = r.Post(&SS{S1: tenant})
+		ctx.Close()
+		if err != nil {
+			panic(err)
+		}
+	}
+	for _, name := range []string{"t1_ss", "t2_ss"} {
+		var got []bson.M
+		err = ms.DB("rest_test").C(name).Find(nil).All(&got)
+		fmt.Println(name, len(got), got[0]["s1"], err)
+		indexes, err := ms.DB("rest_test").C(name).Indexes()
+		if err != nil {
+			panic(err)
+		}
+		for _, index := range indexes {
+			if index.Unique {
+				fmt.Println(index.Key)
+			}
+		}
+	}
+	//Output:
+	//t1_ss 1 t1 <nil>
+	//[s1]
+	//t2_ss 1 t2 <nil>
+	//[s1]
+}
+func TestCollectionPrefix(t *testing.T) {
+	s := Dial(nil, "rest_test")
+	ctx := &Context{r: s.(*rest), values: make(map[string]interface{})}
+	if name := ctx.collName("ss"); name != "ss" {
+		t.Errorf("want ss without prefix, got %s", name)
+	}
+	s.SetCollectionPrefix(func(ctx *Context) string {
+		tenant, _ := ctx.Get("tenant")
+		return tenant.(string) + "_"
+	})
+	ctx.Set("tenant", "tenant123")
+	if name := ctx.collName("ss"); name != "tenant123_ss" {
+		t.Errorf("want tenant123_ss, got %s", name)
+	}
+}
+func ExampleContextSetDB() {
+	ms, err := mgo.Dial("localhost")
+	if err != nil {
+		panic(err)
+	}
+	defer ms.Close()
+	for _, db := range []string{"rest_test", "rest_test_t1"} {
+		err = ms.DB(db).C("ss").DropCollection()
+		if err != nil && err.Error() != "ns not found" {
+			panic(err)
+		}
+	}
+	s := Dial(ms, "rest_test")
+	s.DefType(SS{})
+	s.DefRes("test-ss-db", FieldResource{Type: "SS", Allow: POST})
+	ctx := s.NewContext()
+	defer ctx.Close()
+	ctx.SetDB("rest_test_t1")
+	r, err := s.R(NewResId("test-ss-db"), ctx)
+	if err != nil {
+		panic(err)
+	}
+	if _, err = r.Post(&SS{S1: "t1"}); err != nil {
+		panic(err)
+	}
+	for _, db := range []string{"rest_test", "rest_test_t1"} {
+		n, err := ms.DB(db).C("ss").Count()
+		fmt.Println(db, n, err)
+	}
+	//Output:
+	//rest_test 0 <nil>
+	//rest_test_t1 1 <nil>
+}
+func TestContextDB(t *testing.T) {
+	s := Dial(nil, "rest_test")
+	ctx := &Context{r: s.(*rest), values: make(map[string]interface{})}
+	if db := ctx.DB(); db != "rest_test" {
+		t.Errorf("want Dial's db, got %s", db)
+	}
+	ctx.SetDB("rest_test_t1")
+	if db := ctx.DB(); db != "rest_test_t1" {
+		t.Errorf("want rest_test_t1, got %s", db)
+	}
+	ctx.SetDB("")
+	if db := ctx.DB(); db != "rest_test" {
+		t.Errorf("want Dial's db restored, got %s", db)
+	}
+}
+func ExampleFileResourceBucket() {
+	ms, err := mgo.Dial("localhost")
+	if err != nil {
+		panic(err)
+	}
+	defer ms.Close()
+	for _, c := range []string{"avatars.files", "avatars.chunks", "attachments.files", "attachments.chunks"} {
+		err = ms.DB("rest_test").C(c).DropCollection()
+		if err != nil && err.Error() != "ns not found" {
+			panic(err)
+		}
+	}
+	s := Dial(ms, "rest_test")
+	s.DefRes("test-avatar", FileResource{Bucket: "avatars"})
+	s.DefRes("test-attachment", FileResource{Bucket: "attachments"})
+	ctx := s.NewContext()
+	defer ctx.Close()
+	r, err := s.R(NewResId("test-avatar"), ctx)
+	if err != nil {
+		panic(err)
+	}
+	resp, err := r.Post(r.Meta().NewBinary(strings.NewReader("avatar"), "text/plain"))
+	if err != nil {
+		panic(err)
+	}
+	loc, _ := resp.(Binary).Location()
+	for _, name := range []string{"test-avatar", "test-attachment"} {
+		r, err = s.R(NewResId(name, loc.path[1]), ctx)
+		if err != nil {
+			panic(err)
+		}
+		resp, err = r.Get()
+		if err != nil {
+			panic(err)
+		}
+		rc, err := resp.(Binary).Reader()
+		if err == nil {
+			rc.Close()
+		}
+		fmt.Println(name, err)
+	}
+	for _, c := range []string{"avatars.files", "attachments.files"} {
+		n, err := ms.DB("rest_test").C(c).Count()
+		fmt.Println(c, n, err)
+	}
+	//Output:
+	//test-avatar <nil>
+	//test-attachment not found
+	//avatars.files 1 <nil>
+	//attachments.files 0 <nil>
+}
+func ExampleImageResourceDedup() {
+	ms, err := mgo.Dial("localhost")
+	if err != nil {
+		panic(err)
+	}
+	defer ms.Close()
+	for _, c := range []string{"dedup.files", "dedup.chunks"} {
+		err = ms.DB("rest_test").C(c).DropCollection()
+		if err != nil && err.Error() != "ns not found" {
+			panic(err)
+		}
+	}
+	s := Dial(ms, "rest_test")
+	s.DefRes("test-dedup", ImageResource{Bucket: "dedup"})
+	ctx := s.NewContext()
+	defer ctx.Close()
+	r, err := s.R(NewResId("test-dedup"), ctx)
+	if err != nil {
+		panic(err)
+	}
+	var buf bytes.Buffer
+	err = png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 8, 8)))
+	if err != nil {
+		panic(err)
+	}
+	var locs []string
+	for i := 0; i < 2; i++ {
+		resp, err := r.Post(r.Meta().NewBinary(bytes.NewReader(buf.Bytes()), "image/png"))
+		if err != nil {
+			panic(err)
+		}
+		loc, _ := resp.(Binary).Location()
+		locs = append(locs, loc.String())
+	}
+	n, err := ms.DB("rest_test").C("dedup.files").Count()
+	fmt.Println(locs[0] == locs[1], n, err)
+	//Output:
+	//true 1 <nil>
+}
+func TestImageFormat(t *testing.T) {
+	var buf bytes.Buffer
+	err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 16, 8)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range []*Bound{nil, {Square, 4}} {
+		out, err := resize(bytes.NewReader(buf.Bytes()), b, "jpeg")
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg, name, err := image.DecodeConfig(out)
+		if err != nil || name != "jpeg" {
+			t.Errorf("want jpeg, got %s %v", name, err)
+		} else if b != nil && (cfg.Width != 4 || cfg.Height != 2) {
+			t.Errorf("want 4x2, got %dx%d", cfg.Width, cfg.Height)
+		}
+	}
+	s := Dial(nil, "rest_test")
+	s.DefRes("test-img-format", ImageResource{})
+	resId, _ := ResIdParse("/test-img-format/513063ef69ca944b1000000a.png?format=bmp")
+	r, err := s.R(resId, &Context{values: make(map[string]interface{})})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = r.Get()
+	if e, ok := err.(*Error); !ok || e.Code != BadRequest || e.Msg != "invalid value for format:'bmp', ALLOW: gif, jpeg, png" {
+		t.Errorf("want BadRequest for bmp, got %v", err)
+	}
+}
+func ExampleImageResourceFormat() {
+	ms, err := mgo.Dial("localhost")
+	if err != nil {
+		panic(err)
+	}
+	defer ms.Close()
+	s := Dial(ms, "rest_test")
+	s.DefRes("test-img-jpeg", ImageResource{})
+	var buf bytes.Buffer
+	err = png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 16, 8)))
+	if err != nil {
+		panic(err)
+	}
+	orig := append([]byte{}, buf.Bytes()...)
+	ctx := s.NewContext()
+	defer ctx.Close()
+	r, err := s.R(NewResId("test-img-jpeg"), ctx)
+	if err != nil {
+		panic(err)
+	}
+	resp, err := r.Post(r.Meta().NewBinary(&buf, "image/png"))
+	if err != nil {
+		panic(err)
+	}
+	loc, _ := resp.(Binary).Location()
+	loc.Params["format"] = "jpeg"
+	r, err = s.R(loc, ctx)
+	if err != nil {
+		panic(err)
+	}
+	resp, err = r.Get()
+	if err != nil {
+		panic(err)
+	}
+	rc, err := resp.(Binary).Reader()
+	if err != nil {
+		panic(err)
+	}
+	defer rc.Close()
+	_, name, err := image.DecodeConfig(rc)
+	fmt.Println(resp.(Binary).MediaType(), name, err)
+	loc.Params["format"] = "png"
+	r, err = s.R(loc, ctx)
+	if err != nil {
+		panic(err)
+	}
+	resp, err = r.Get()
+	if err != nil {
+		panic(err)
+	}
+	rc, err = resp.(Binary).Reader()
+	if err != nil {
+		panic(err)
+	}
+	defer rc.Close()
+	stored, err := ioutil.ReadAll(rc)
+	fmt.Println(resp.(Binary).MediaType(), bytes.Equal(stored, orig), err)
+	//Output:
+	//image/jpeg jpeg <nil>
+	//image/png true <nil>
+}
+func TestBucketIndex(t *testing.T) {
+	s := Dial(nil, "rest_test")
+	s.DefRes("test-bucket-images", ImageResource{Bucket: "media"})
+	s.DefRes("test-bucket-files", FileResource{Bucket: "media"})
+	s.DefRes("test-bucket-default", FileResource{})
+	var got []string
+	for _, pi := range s.(*rest).indexes {
+		if pi.bucket != "" {
+			got = append(got, pi.coll()+" "+pi.res+fmt.Sprint(pi.index.Fields))
+		}
+	}
+	want := []string{
+		"media.files test-bucket-images[md5]",
+		"media.files test-bucket-images[filename -uploadDate]",
+		"fs.files test-bucket-default[md5]",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("want %v, got %v", want, got)
+	}
+}
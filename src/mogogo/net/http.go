@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"compress/flate"
 	"compress/gzip"
+	"crypto/hmac"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -31,10 +32,31 @@ type ContextHandler interface {
 	Load(ctxId string, ctx *mogogo.Context, req *http.Request)
 	Store(ctxId string, ctx *mogogo.Context, req *http.Request)
 }
+
+// APIKey is what an X-Api-Key header names. With a Secret the request
+// also carries X-Api-Timestamp, in Unix seconds within 5 minutes of the
+// server's clock, and X-Api-Signature, the base64url HMAC-SHA256 of
+// "METHOD /request/uri\ntimestamp\n" and the hex SHA-256 of the body.
+type APIKey struct {
+	Principal interface{}
+	Secret    []byte
+	Sys       bool
+}
+type APIKeyHandler interface {
+	APIKey(key string) (apiKey *APIKey, ok bool)
+}
 type HTTPHandler struct {
 	ContextHandler ContextHandler
+	APIKeyHandler  APIKeyHandler
 	PrefetchConfig mogogo.M
-	s              mogogo.Session
+	Debug          bool
+	SignSecret     []byte
+	// NoContent answers a DELETE with 204 and no body instead of 200.
+	NoContent bool
+	// MaxSignedBody caps the bytes of a body read to check an api
+	// signature, 1MB when zero; larger bodies get 413.
+	MaxSignedBody int64
+	s             mogogo.Session
 }
 
 func (h *HTTPHandler) mggErrToMap(err *mogogo.Error) (status int, m map[string]interface{}) {
@@ -47,10 +69,18 @@ func (h *HTTPHandler) mggErrToMap(err *mogogo.Error) (status int, m map[string]i
 	}
 	return
 }
-func (h *HTTPHandler) errToMap(err interface{}) (status int, m map[string]interface{}) {
+
+// errToMap sets Retry-After in header, when not nil, from an *mogogo.Error
+// carrying RetryAfter.
+func (h *HTTPHandler) errToMap(header http.Header, err interface{}) (status int, m map[string]interface{}) {
 	switch t := err.(type) {
 	case *mogogo.Error:
 		status, m = h.mggErrToMap(t)
+		if t.RetryAfter > 0 && header != nil {
+			header.Set("Retry-After", strconv.Itoa(int((t.RetryAfter+time.Second-1)/time.Second)))
+		}
+	case *mogogo.Bug:
+		status, m = h.mggErrToMap(&mogogo.Error{Code: mogogo.InternalServerError, Msg: t.Msg})
 	case error:
 		status, m = h.mggErrToMap(&mogogo.Error{Code: mogogo.InternalServerError, Err: t})
 	default:
@@ -60,19 +90,27 @@ func (h *HTTPHandler) errToMap(err interface{}) (status int, m map[string]interf
 	return
 }
 func (h *HTTPHandler) requestBody(req *http.Request, res mogogo.Resource) (body interface{}, err error) {
-	resMeta := res.(mogogo.ResourceMeta)
+	resMeta := res.Meta()
 	ct := req.Header.Get("Content-Type")
 	if ct != "" && req.Body == nil {
 		return nil, &mogogo.Error{Code: mogogo.BadRequest, Msg:"provide content-type, but body is empty"}
 	}
 	if ct == "application/json" {
-		var m map[string]interface{}
+		var v interface{}
 		dec := json.NewDecoder(req.Body)
-		err = dec.Decode(&m)
+		dec.UseNumber()
+		err = dec.Decode(&v)
 		if err != nil {
 			return nil, &mogogo.Error{Code: mogogo.BadRequest, Msg: "parse json error", Err: err}
 		}
-		if req.Method == "PATCH" {
+		if a, ok := v.([]interface{}); ok && req.Method == "PUT" {
+			return h.requestBodies(req, resMeta, a)
+		}
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, &mogogo.Error{Code: mogogo.BadRequest, Msg: "want json object"}
+		}
+		if req.Method == "PATCH" && resMeta.PatchesUpdater() {
 			body, err = resMeta.MapToUpdater(m, req.URL)
 		} else {
 			body, err = resMeta.MapToRequest(m, req.URL)
@@ -85,12 +123,33 @@ func (h *HTTPHandler) requestBody(req *http.Request, res mogogo.Resource) (body
 	}
 	return
 }
+
+// requestBodies converts the elements of a json array PUT for PutMany;
+// an element that fails to convert is passed on as its *mogogo.Error.
+func (h *HTTPHandler) requestBodies(req *http.Request, resMeta mogogo.ResourceMeta, a []interface{}) (interface{}, error) {
+	bodies := make([]interface{}, len(a))
+	for i, v := range a {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			bodies[i] = &mogogo.Error{Code: mogogo.BadRequest, Msg: "want json object"}
+			continue
+		}
+		body, err := resMeta.MapToRequest(m, req.URL)
+		if e, ok := err.(*mogogo.Error); ok {
+			body = e
+		} else if err != nil {
+			return nil, err
+		}
+		bodies[i] = body
+	}
+	return bodies, nil
+}
 func (h *HTTPHandler) requestForPrefetch(urlStr string, ctx *mogogo.Context, cfg mogogo.M) (ret map[string]interface{}) {
 	req, err := http.NewRequest("GET", urlStr, nil)
 	if err != nil {
 		panic(&mogogo.Error{Code: mogogo.InternalServerError, Err: err})
 	}
-	status, r := h.request(req, ctx, cfg, false)
+	status, r := h.request(nil, req, ctx, cfg, false)
 	m, ok := r.(map[string]interface{})
 	if !ok {
 		panic(&mogogo.Error{
@@ -212,24 +271,38 @@ func (h *HTTPHandler) responseToMap(req *http.Request, ctx *mogogo.Context, rm m
 	h.prefetch(req, ctx, ret, cfg)
 	return ret
 }
-func (h *HTTPHandler) responseIter(req *http.Request, ctx *mogogo.Context, iter mogogo.Iter, rm mogogo.ResourceMeta, cfg mogogo.M, start bool) (status int, resp interface{}) {
+func (h *HTTPHandler) responseIter(header http.Header, req *http.Request, ctx *mogogo.Context, iter mogogo.Iter, rm mogogo.ResourceMeta, cfg mogogo.M, start bool) (status int, resp interface{}) {
 	s, err := iter.Slice()
 	if err != nil {
-		return h.errToMap(err)
+		return h.errToMap(header, err)
 	}
 	m := make(map[string]interface{})
 	resp = m
 	status = 200
 	m["self"] = s.Self().URLWithBase(req.URL).String()
+	links := make([]string, 0, 2)
+	if s.HasNext() {
+		m["next"] = s.Next().URLWithBase(req.URL).String()
+		links = append(links, fmt.Sprintf("<%s>; rel=\"next\"", m["next"]))
+	}
 	if s.HasPrev() {
 		m["prev"] = s.Prev().URLWithBase(req.URL).String()
+		links = append(links, fmt.Sprintf("<%s>; rel=\"prev\"", m["prev"]))
 	}
-	if s.HasNext() {
-		m["next"] = s.Next().URLWithBase(req.URL).String()
+	if rm != nil {
+		if parent, ok := rm.Parent(); ok {
+			m["parent"] = parent.URLWithBase(req.URL).String()
+			links = append(links, fmt.Sprintf("<%s>; rel=\"up\"", m["parent"]))
+		}
+	}
+	if header != nil && len(links) > 0 {
+		header.Set("Link", strings.Join(links, ", "))
 	}
 	if s.HasCount() {
 		m["count"] = s.Count()
 		m["more"] = s.More()
+	} else if s.More() {
+		m["more"] = true
 	}
 	if s.HasItems() {
 		items := make([]interface{}, 0, len(s.Items()))
@@ -238,18 +311,35 @@ func (h *HTTPHandler) responseIter(req *http.Request, ctx *mogogo.Context, iter
 			items = append(items, i)
 		}
 		m["slice"] = items
-		if len(items) == 0 {
-			status = 404
-		}
 	}
 	m["statusCode"] = status
 	return
 }
-func (h *HTTPHandler) responseBody(req *http.Request, ctx *mogogo.Context, r interface{}, res mogogo.Resource, cfg mogogo.M, start bool) (status int, resp interface{}) {
-	resMeta := res.(mogogo.ResourceMeta)
+func (h *HTTPHandler) responseBody(header http.Header, req *http.Request, ctx *mogogo.Context, r interface{}, res mogogo.Resource, cfg mogogo.M, start bool) (status int, resp interface{}) {
+	resMeta := res.Meta()
 	switch t := r.(type) {
 	case mogogo.Iter:
-		status, resp = h.responseIter(req, ctx, t, resMeta, cfg, start)
+		status, resp = h.responseIter(header, req, ctx, t, resMeta, cfg, start)
+	case *mogogo.SyncResult:
+		status = 200
+		if t.Failed() {
+			status = mogogo.MultiStatus
+		}
+		items := make([]interface{}, len(t.Items))
+		for i, item := range t.Items {
+			if item.Err != nil {
+				_, items[i] = h.mggErrToMap(item.Err)
+			} else {
+				items[i] = map[string]interface{}{"statusCode": item.Status}
+			}
+		}
+		resp = map[string]interface{}{
+			"statusCode": status,
+			"inserted":   t.Inserted,
+			"modified":   t.Modified,
+			"conflicts":  t.Conflicts,
+			"items":      items,
+		}
 	case mogogo.Binary:
 		resp = t
 		if _, ok := t.Location(); ok {
@@ -259,13 +349,19 @@ func (h *HTTPHandler) responseBody(req *http.Request, ctx *mogogo.Context, r int
 		}
 
 	default:
-		if r == nil {
+		if r == nil && h.NoContent && req.Method == "DELETE" {
+			status = 204
+			resp = map[string]interface{}(nil)
+		} else if r == nil {
 			status = 200
 			resp = map[string]interface{}{"statusCode": status}
 		} else {
 			m := h.responseToMap(req, ctx, resMeta, r, cfg, start)
 			if base, ok := getBase(r); ok && base.IsNew() {
 				status = 201
+				if header != nil {
+					header.Set("Location", base.Self().URLWithBase(req.URL).String())
+				}
 			} else {
 				status = 200
 			}
@@ -287,21 +383,20 @@ func (h *HTTPHandler) paramsFromConfig(resId *mogogo.ResId, cfg mogogo.M) {
 		resId.Params["noitems"] = fmt.Sprintf("%v", noitems)
 	}
 }
-func (h *HTTPHandler) request(req *http.Request, ctx *mogogo.Context, cfg mogogo.M, start bool) (status int, resp interface{}) {
+func (h *HTTPHandler) request(header http.Header, req *http.Request, ctx *mogogo.Context, cfg mogogo.M, start bool) (status int, resp interface{}) {
 	resId, err := mogogo.ResIdFromURL(req.URL)
 	if err != nil {
-		return h.errToMap(err)
+		return h.errToMap(header, err)
 	}
 	res, err := h.s.R(resId, ctx)
 	if err != nil {
-		return h.errToMap(err)
+		return h.errToMap(header, err)
 	}
 	if start {
 		var ok bool
 		cfg, ok = h.PrefetchConfig[resId.Name()].(mogogo.M)
 		if !ok {
-			rm := res.(mogogo.ResourceMeta)
-			cfg, ok = h.PrefetchConfig[rm.ResponseType().Name()].(mogogo.M)
+			cfg, ok = h.PrefetchConfig[res.Meta().ResponseType().Name()].(mogogo.M)
 		}
 	}
 	h.paramsFromConfig(res.Id(), cfg)
@@ -313,37 +408,37 @@ func (h *HTTPHandler) request(req *http.Request, ctx *mogogo.Context, cfg mogogo
 	case "PUT":
 		body, err = h.requestBody(req, res)
 		if err != nil {
-			return h.errToMap(err)
+			return h.errToMap(header, err)
+		}
+		if bodies, ok := body.([]interface{}); ok {
+			r, err = res.PutMany(bodies)
+		} else {
+			r, err = res.Put(body)
 		}
-		r, err = res.Put(body)
 	case "DELETE":
 		r, err = res.Delete()
 	case "POST":
 		body, err = h.requestBody(req, res)
 		if err != nil {
-			return h.errToMap(err)
+			return h.errToMap(header, err)
 		}
 		r, err = res.Post(body)
 	case "PATCH":
 		body, err = h.requestBody(req, res)
 		if err != nil {
-			return h.errToMap(err)
+			return h.errToMap(header, err)
 		}
 		r, err = res.Patch(body)
 	default:
-		return h.errToMap(&mogogo.Error{Code: mogogo.MethodNotAllowed})
+		return h.errToMap(header, &mogogo.Error{Code: mogogo.MethodNotAllowed})
 	}
 	if err != nil {
-		return h.errToMap(err)
+		return h.errToMap(header, err)
 	}
-	status, resp = h.responseBody(req, ctx, r, res, cfg, start)
+	status, resp = h.responseBody(header, req, ctx, r, res, cfg, start)
 	return
 }
-func (h *HTTPHandler) compress(rw http.ResponseWriter, req *http.Request, m map[string]interface{}) (*bytes.Buffer, error) {
-	buf, err := json.Marshal(m)
-	if err != nil {
-		return nil, err
-	}
+func (h *HTTPHandler) compress(rw http.ResponseWriter, req *http.Request, buf []byte) (*bytes.Buffer, error) {
 	ret := bytes.NewBuffer(make([]byte, 0, 512))
 	var w io.Writer
 	ae := req.Header.Get("Accept-Encoding")
@@ -360,7 +455,7 @@ func (h *HTTPHandler) compress(rw http.ResponseWriter, req *http.Request, m map[
 	} else {
 		w = ret
 	}
-	_, err = w.Write(buf)
+	_, err := w.Write(buf)
 	if err != nil {
 		return nil, err
 	}
@@ -380,7 +475,8 @@ func (h *HTTPHandler) log(w http.ResponseWriter, req *http.Request, status int,
 		s = " - "
 	}
 	elapsed := time.Now().Sub(startTime)
-	log.Printf("%s \"%s\" %d \"%s\" \"%s\" %v%s%s\n", req.Method, req.URL.RequestURI(), status, ctxId, ip, elapsed, s, msg)
+	reqId := req.Header.Get(requestIdHeader)
+	log.Printf("%s \"%s\" %d \"%s\" \"%s\" %s %v%s%s\n", req.Method, req.URL.RequestURI(), status, ctxId, ip, reqId, elapsed, s, msg)
 }
 func (h *HTTPHandler) logMap(w http.ResponseWriter, req *http.Request, status int, m map[string]interface{}, startTime time.Time) {
 	msg := ""
@@ -398,9 +494,10 @@ func (h *HTTPHandler) logMap(w http.ResponseWriter, req *http.Request, status in
 func (h *HTTPHandler) responseBinary(w http.ResponseWriter, req *http.Request, status int, b mogogo.Binary, startTime time.Time) {
 
 	w.Header().Set("Server", "MOGOGO/0.1")
-	if req.Header.Get("If-None-Match") == "1" {
+	et := b.Etag()
+	if et != "" && req.Header.Get("If-None-Match") == et {
 		w.Header().Set("Cache-Control", "public, max-age=31536000")
-		w.Header().Set("Etag", "1")
+		w.Header().Set("Etag", et)
 		status = 304
 		w.WriteHeader(status)
 	} else if b.HasReader() {
@@ -411,10 +508,40 @@ func (h *HTTPHandler) responseBinary(w http.ResponseWriter, req *http.Request, s
 		}
 		defer r.Close()
 		w.Header().Set("Content-Type", b.MediaType())
-		w.Header().Set("Cache-Control", "public, max-age=31536000")
-		w.Header().Set("Etag", "1")
+		var body io.Reader = r
+		n := b.ContentLength()
+		if rs, ok := r.(io.Seeker); ok && n >= 0 && status == 200 {
+			w.Header().Set("Accept-Ranges", "bytes")
+			start, end, rst := parseRange(req.Header.Get("Range"), n)
+			switch rst {
+			case 206:
+				_, err = rs.Seek(start, 0)
+				if err != nil {
+					h.responseError(w, req, err, "", startTime)
+					return
+				}
+				w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, n))
+				n = end - start + 1
+				body = io.LimitReader(r, n)
+				status = 206
+			case 416:
+				w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", n))
+				n = 0
+				body = io.LimitReader(r, 0)
+				status = 416
+			}
+		}
+		if n >= 0 {
+			w.Header().Set("Content-Length", strconv.FormatInt(n, 10))
+		}
+		if et != "" {
+			w.Header().Set("Cache-Control", "public, max-age=31536000")
+			w.Header().Set("Etag", et)
+		} else {
+			w.Header().Set("Cache-Control", "private, max-age=0")
+		}
 		w.WriteHeader(status)
-		_, err = io.Copy(w, r)
+		_, err = io.Copy(w, body)
 		if err != nil {
 			log.Printf("WRITE DATA ERROR: %v\n", err)
 		}
@@ -433,18 +560,48 @@ func (h *HTTPHandler) responseBinary(w http.ResponseWriter, req *http.Request, s
 
 func (h *HTTPHandler) responseJSON(w http.ResponseWriter, req *http.Request, status int, m map[string]interface{}, startTime time.Time) {
 	if m == nil {
+		if id := req.Header.Get(requestIdHeader); id != "" {
+			w.Header().Set(requestIdHeader, id)
+		}
 		w.WriteHeader(status)
+		h.log(w, req, status, "", startTime)
 		return
 	}
+	status, ok := h.writeJSON(w, req, status, m, startTime)
+	if ok {
+		h.logMap(w, req, status, m, startTime)
+	}
+}
+func (h *HTTPHandler) writeJSON(w http.ResponseWriter, req *http.Request, status int, m map[string]interface{}, startTime time.Time) (int, bool) {
 	w.Header().Set("Cache-Control", "private, max-age=0")
 	w.Header().Set("Server", "MOGOGO/0.1")
-	buf, err := h.compress(w, req, m)
+	b, err := json.Marshal(m)
 	if err != nil {
 		h.responseError(w, req, err, "", startTime)
-		return
+		return status, false
+	}
+	// The Etag hashes the body before requestId is added, so it stays
+	// the same across requests for an unchanged resource.
+	et := etag(b)
+	if id := req.Header.Get(requestIdHeader); id != "" {
+		w.Header().Set(requestIdHeader, id)
+		withId := make(map[string]interface{}, len(m)+1)
+		for k, v := range m {
+			withId[k] = v
+		}
+		withId["requestId"] = id
+		b, err = json.Marshal(withId)
+		if err != nil {
+			h.responseError(w, req, err, "", startTime)
+			return status, false
+		}
+	}
+	buf, err := h.compress(w, req, b)
+	if err != nil {
+		h.responseError(w, req, err, "", startTime)
+		return status, false
 	}
 	me := req.Header.Get("If-None-Match")
-	et := etag(buf.Bytes())
 	w.Header().Set("Etag", et)
 	if me == et {
 		w.Header().Del("Content-Encoding")
@@ -458,21 +615,50 @@ func (h *HTTPHandler) responseJSON(w http.ResponseWriter, req *http.Request, sta
 			log.Printf("WRITE DATA ERROR: %v\n", err)
 		}
 	}
-	h.logMap(w, req, status, m, startTime)
+	return status, true
 }
 func (h *HTTPHandler) responseError(w http.ResponseWriter, req *http.Request, err interface{}, stack string, startTime time.Time) {
-	s, m := h.errToMap(err)
-	if stack != "" {
-		m["stackTrace"] = strings.Split(stack, "\n")
+	s, m := h.errToMap(w.Header(), err)
+	if _, ok := err.(*mogogo.Error); ok {
+		stack = ""
+	}
+	if stack == "" {
+		h.responseJSON(w, req, s, m, startTime)
+		return
+	}
+	m["stackTrace"] = strings.Split(stack, "\n")
+	if h.Debug {
+		h.responseJSON(w, req, s, m, startTime)
+		return
+	}
+	resp := map[string]interface{}{
+		"statusCode": s,
+		"statusMsg":  mogogo.ErrorCode(s).String(),
+	}
+	status, ok := h.writeJSON(w, req, s, resp, startTime)
+	if ok {
+		h.logMap(w, req, status, m, startTime)
 	}
-	h.responseJSON(w, req, s, m, startTime)
 }
 
 const (
-	cookieKey     = "MOGOGO_ID"
-	cookieTimeKey = "MOGOGO_TS"
+	cookieKey          = "MOGOGO_ID"
+	cookieTimeKey      = "MOGOGO_TS"
+	requestIdHeader    = "X-Request-Id"
+	apiKeyHeader       = "X-Api-Key"
+	apiSignatureHeader = "X-Api-Signature"
+	apiTimestampHeader = "X-Api-Timestamp"
 )
 
+func (h *HTTPHandler) requestId(req *http.Request) (id string) {
+	id = req.Header.Get(requestIdHeader)
+	if id == "" {
+		id = randId()
+		req.Header.Set(requestIdHeader, id)
+	}
+	return
+}
+
 func (h *HTTPHandler) loadContext(req *http.Request, ctx *mogogo.Context) (ctxId string) {
 	if h.ContextHandler == nil {
 		return
@@ -536,6 +722,56 @@ func (h *HTTPHandler) storeContext(ctxId string, w http.ResponseWriter, req *htt
 	}
 	h.updateCookieExpires(w, req)
 }
+func (h *HTTPHandler) checkSigned(req *http.Request) (signed bool, err error) {
+	if h.SignSecret == nil || req.URL.Query().Get(signSigParam) == "" {
+		return false, nil
+	}
+	// the signature doesn't cover the method, so a link can't be replayed
+	// to change what it names
+	if req.Method != "GET" && req.Method != "HEAD" {
+		return false, &mogogo.Error{Code: mogogo.Forbidden, Msg: "signed URLs allow GET and HEAD only"}
+	}
+	resId, err := mogogo.ResIdFromURL(req.URL)
+	if err != nil {
+		return false, err
+	}
+	err = verifySigned(resId, h.SignSecret, time.Now())
+	if err != nil {
+		return false, err
+	}
+	resId.Params.Del(signExpParam)
+	resId.Params.Del(signSigParam)
+	req.URL.RawQuery = resId.Params.Encode()
+	return true, nil
+}
+func (h *HTTPHandler) checkAPIKey(req *http.Request) (apiKey *APIKey, err error) {
+	key := req.Header.Get(apiKeyHeader)
+	if h.APIKeyHandler == nil || key == "" {
+		return nil, nil
+	}
+	apiKey, ok := h.APIKeyHandler.APIKey(key)
+	if !ok {
+		return nil, &mogogo.Error{Code: mogogo.Unauthorized, Msg: "invalid api key"}
+	}
+	if apiKey.Secret != nil {
+		if err := checkTimestamp(req.Header.Get(apiTimestampHeader), time.Now()); err != nil {
+			return nil, err
+		}
+		max := h.MaxSignedBody
+		if max <= 0 {
+			max = defaultMaxSignedBody
+		}
+		want, err := requestSignature(req, apiKey.Secret, max)
+		if err != nil {
+			return nil, err
+		}
+		sig := req.Header.Get(apiSignatureHeader)
+		if !hmac.Equal([]byte(sig), []byte(want)) {
+			return nil, &mogogo.Error{Code: mogogo.Unauthorized, Msg: "invalid api signature"}
+		}
+	}
+	return apiKey, nil
+}
 func (h *HTTPHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	startTime := time.Now()
 	req.URL.Host = req.Host
@@ -544,17 +780,39 @@ func (h *HTTPHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	} else {
 		req.URL.Scheme = "https"
 	}
+	reqId := h.requestId(req)
 	defer func() {
 		err := recover()
 		if err != nil {
 			h.responseError(w, req, err, string(debug.Stack()), startTime)
 		}
 	}()
+	signed, err := h.checkSigned(req)
+	if err != nil {
+		h.responseError(w, req, err, "", startTime)
+		return
+	}
+	apiKey, err := h.checkAPIKey(req)
+	if err != nil {
+		h.responseError(w, req, err, "", startTime)
+		return
+	}
 	ctx := h.s.NewContext()
 	defer ctx.Close()
-	ctxId := h.loadContext(req, ctx)
-	status, resp := h.request(req, ctx, nil, true)
-	h.storeContext(ctxId, w, req, ctx)
+	ctx.SetRequestId(reqId)
+	ctx.SetSigned(signed)
+	stateless := signed || apiKey != nil
+	var ctxId string
+	if apiKey != nil {
+		ctx.SetSys(apiKey.Sys)
+		ctx.SetPrincipal(apiKey.Principal)
+	} else if !signed {
+		ctxId = h.loadContext(req, ctx)
+	}
+	status, resp := h.request(w.Header(), req, ctx, nil, true)
+	if !stateless {
+		h.storeContext(ctxId, w, req, ctx)
+	}
 	if h.ContextHandler != nil {
 	}
 	switch t := resp.(type) {
@@ -569,7 +827,39 @@ func (h *HTTPHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 }
 func NewHTTPHandler(s mogogo.Session) *HTTPHandler {
 	if s == nil {
-		panic("param 's' is null")
+		panic(&mogogo.Bug{Msg: "param 's' is null"})
 	}
 	return &HTTPHandler{s: s}
 }
+
+// Canonical redirects GET and HEAD requests whose url differs from the
+// form mogogo.ResId.URL gives, params sorted and escaped, to that form so
+// caches and Etags see one url per resource. The redirect is a temporary
+// 307, as the form may change. Param names stay case sensitive. Other
+// methods, signed requests, urls with a repeated param, which the form
+// would drop, and urls that don't parse pass through.
+func Canonical(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if u, ok := canonicalURI(req); ok {
+			http.Redirect(w, req, u, http.StatusTemporaryRedirect)
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+func canonicalURI(req *http.Request) (u string, ok bool) {
+	if req.Method != "GET" && req.Method != "HEAD" || req.Header.Get(apiSignatureHeader) != "" {
+		return "", false
+	}
+	for k, v := range req.URL.Query() {
+		if k == signSigParam || len(v) > 1 {
+			return "", false
+		}
+	}
+	resId, err := mogogo.ResIdFromURL(req.URL)
+	if err != nil {
+		return "", false
+	}
+	u = resId.URL().RequestURI()
+	return u, u != req.URL.RequestURI()
+}
@@ -0,0 +1,591 @@
+package net
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mogogo"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResponseErrorPanic(t *testing.T) {
+	h := &HTTPHandler{Debug: true}
+	tests := []struct {
+		err    interface{}
+		status int
+		stack  bool
+	}{
+		{"something wrong", 500, true},
+		{&mogogo.Bug{Msg: "bug"}, 500, true},
+		{&mogogo.Error{Code: mogogo.NotFound}, 404, false},
+	}
+	for _, test := range tests {
+		req, err := http.NewRequest("GET", "http://localhost/ss", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		h.responseError(w, req, test.err, "goroutine 1\nmain.main()", time.Now())
+		if w.Code != test.status {
+			t.Errorf("%v: want status %d, got %d", test.err, test.status, w.Code)
+		}
+		var m map[string]interface{}
+		err = json.Unmarshal(w.Body.Bytes(), &m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := m["stackTrace"]; ok != test.stack {
+			t.Errorf("%v: want stackTrace %v, got %v", test.err, test.stack, ok)
+		}
+	}
+}
+func TestResponseErrorNoDebug(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	h := &HTTPHandler{}
+	req, err := http.NewRequest("GET", "http://localhost/ss", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	h.responseError(w, req, "secret detail", "goroutine 1\nmain.main()", time.Now())
+	if w.Code != 500 {
+		t.Errorf("want status 500, got %d", w.Code)
+	}
+	if strings.Contains(w.Body.String(), "stackTrace") || strings.Contains(w.Body.String(), "secret detail") {
+		t.Errorf("internals leaked to response: %s", w.Body.String())
+	}
+	if !strings.Contains(buf.String(), "main.main()") {
+		t.Errorf("stack not logged: %s", buf.String())
+	}
+}
+func TestRequestId(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	h := &HTTPHandler{}
+	for _, inbound := range []string{"", "client-id-1"} {
+		buf.Reset()
+		req, err := http.NewRequest("GET", "http://localhost/ss", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if inbound != "" {
+			req.Header.Set("X-Request-Id", inbound)
+		}
+		id := h.requestId(req)
+		if id == "" || (inbound != "" && id != inbound) {
+			t.Fatalf("want request id %q, got %q", inbound, id)
+		}
+		w := httptest.NewRecorder()
+		resp := map[string]interface{}{"statusCode": 200}
+		h.responseJSON(w, req, 200, resp, time.Now())
+		var m map[string]interface{}
+		err = json.Unmarshal(w.Body.Bytes(), &m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m["requestId"] != id || w.Header().Get("X-Request-Id") != id {
+			t.Errorf("want request id %q in response, got %v", id, m["requestId"])
+		}
+		if _, ok := resp["requestId"]; ok {
+			t.Errorf("want response map left alone, got %v", resp)
+		}
+		if et, _ := json.Marshal(resp); w.Header().Get("Etag") != etag(et) {
+			t.Errorf("want Etag of the body without request id, got %s", w.Header().Get("Etag"))
+		}
+		if !strings.Contains(buf.String(), " "+id+" ") {
+			t.Errorf("want request id %q in log, got %s", id, buf.String())
+		}
+	}
+}
+
+type testSlice struct {
+	mogogo.Slice
+	self, next *mogogo.ResId
+	items      []interface{}
+	more       bool
+}
+
+func (s *testSlice) Self() *mogogo.ResId  { return s.self }
+func (s *testSlice) HasPrev() bool        { return false }
+func (s *testSlice) HasNext() bool        { return true }
+func (s *testSlice) Next() *mogogo.ResId  { return s.next }
+func (s *testSlice) HasCount() bool       { return false }
+func (s *testSlice) HasItems() bool       { return s.items != nil }
+func (s *testSlice) Items() []interface{} { return s.items }
+func (s *testSlice) More() bool           { return s.more }
+
+type testIter struct {
+	mogogo.Iter
+	slice mogogo.Slice
+}
+
+func (i *testIter) Slice() (mogogo.Slice, error) { return i.slice, nil }
+
+func TestResponseIterLink(t *testing.T) {
+	h := &HTTPHandler{}
+	req, err := http.NewRequest("GET", "http://localhost/ss?n=3", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := mogogo.NewResId("ss")
+	next.Params["n"] = "3"
+	next.Params["next"] = "513063ef69ca944b1000000a"
+	iter := &testIter{slice: &testSlice{self: mogogo.NewResId("ss"), next: next}}
+	header := make(http.Header)
+	_, resp := h.responseIter(header, req, nil, iter, nil, nil, true)
+	want := fmt.Sprintf("<%s>; rel=\"next\"", resp.(map[string]interface{})["next"])
+	if link := header.Get("Link"); link != want {
+		t.Errorf("want Link %q, got %q", want, link)
+	}
+}
+
+func TestResponseIterEmpty(t *testing.T) {
+	h := &HTTPHandler{}
+	req, err := http.NewRequest("GET", "http://localhost/ss?n=3&next=513063ef69ca944b1000000a", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := mogogo.NewResId("ss")
+	next.Params["next"] = "513063ef69ca944b1000000a"
+	iter := &testIter{slice: &testSlice{self: next, next: next, items: []interface{}{}}}
+	status, resp := h.responseIter(nil, req, nil, iter, nil, nil, true)
+	if status != 200 {
+		t.Errorf("want 200 past the end, got %d", status)
+	}
+	if items, ok := resp.(map[string]interface{})["slice"].([]interface{}); !ok || len(items) != 0 {
+		t.Errorf("want empty slice, got %v", resp)
+	}
+}
+
+func TestResponseIterMore(t *testing.T) {
+	h := &HTTPHandler{}
+	req, err := http.NewRequest("GET", "http://localhost/ss?all=true", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	self := mogogo.NewResId("ss")
+	for _, more := range []bool{false, true} {
+		iter := &testIter{slice: &testSlice{self: self, next: self, more: more}}
+		_, resp := h.responseIter(nil, req, nil, iter, nil, nil, true)
+		if _, ok := resp.(map[string]interface{})["more"]; ok != more {
+			t.Errorf("want more %v in response, got %v", more, resp)
+		}
+	}
+}
+
+type testRes struct {
+	mogogo.Resource
+	mogogo.ResourceMeta
+}
+
+func (r testRes) Meta() mogogo.ResourceMeta {
+	return r.ResourceMeta
+}
+
+func TestResponseNoContent(t *testing.T) {
+	for _, noContent := range []bool{false, true} {
+		h := &HTTPHandler{NoContent: noContent}
+		req, err := http.NewRequest("DELETE", "http://localhost/ss/513063ef69ca944b1000000a", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		status, resp := h.responseBody(nil, req, nil, nil, testRes{}, nil, true)
+		w := httptest.NewRecorder()
+		h.responseJSON(w, req, status, resp.(map[string]interface{}), time.Now())
+		if noContent && (w.Code != 204 || w.Body.Len() != 0) {
+			t.Errorf("want 204 without body, got %d %q", w.Code, w.Body.String())
+		} else if !noContent && w.Code != 200 {
+			t.Errorf("want 200 by default, got %d", w.Code)
+		}
+	}
+}
+
+type SyncDoc struct {
+	mogogo.Base
+	S1 string
+}
+
+func TestResponseIterParent(t *testing.T) {
+	s := mogogo.Dial(nil, "rest_test")
+	s.DefType(SyncDoc{})
+	s.DefRes("test-sync-children", mogogo.SelectorResource{
+		Type:             "SyncDoc",
+		PathSegmentTypes: []string{"SyncDoc"},
+		SelectorFunc: func(req *mogogo.Req, ctx *mogogo.Context) (mogogo.M, error) {
+			return mogogo.M{}, nil
+		},
+	})
+	h := NewHTTPHandler(s)
+	req, err := http.NewRequest("GET", "http://localhost/test-sync-children/513063ef69ca944b1000000a", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resId, err := mogogo.ResIdFromURL(req.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := s.R(resId, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	iter := &testIter{slice: &testSlice{self: resId, next: resId}}
+	header := make(http.Header)
+	_, resp := h.responseIter(header, req, nil, iter, res.Meta(), nil, true)
+	want := "http://localhost/syncdoc/513063ef69ca944b1000000a"
+	if parent := resp.(map[string]interface{})["parent"]; parent != want {
+		t.Errorf("want parent %s, got %v", want, resp)
+	}
+	if link := header.Get("Link"); !strings.Contains(link, "<"+want+">; rel=\"up\"") {
+		t.Errorf("want up link, got %q", link)
+	}
+}
+
+func TestRequestBodyArray(t *testing.T) {
+	s := mogogo.Dial(nil, "rest_test")
+	s.DefType(SyncDoc{})
+	s.DefRes("test-sync", mogogo.FieldResource{Type: "SyncDoc", Allow: mogogo.PUT, Sync: true})
+	h := NewHTTPHandler(s)
+	for _, method := range []string{"PUT", "POST"} {
+		req, err := http.NewRequest(method, "http://localhost/test-sync", strings.NewReader(`[{"s1":"a"},{"s1":"b"}]`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		res, err := s.R(mogogo.NewResId("test-sync"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := h.requestBody(req, res)
+		bodies, ok := body.([]interface{})
+		if method == "POST" {
+			if ok || err == nil {
+				t.Errorf("want array refused for POST, got %v", body)
+			}
+			continue
+		}
+		if !ok || len(bodies) != 2 || bodies[1].(*SyncDoc).S1 != "b" {
+			t.Errorf("want 2 bodies, got %v %v", body, err)
+		}
+	}
+}
+
+type testBinary struct {
+	data []byte
+}
+
+func (b *testBinary) HasReader() bool                 { return true }
+func (b *testBinary) Location() (*mogogo.ResId, bool) { return nil, false }
+func (b *testBinary) MediaType() string               { return "image/png" }
+func (b *testBinary) ContentLength() int64            { return int64(len(b.data)) }
+func (b *testBinary) Etag() string                    { return "\"513063ef69ca944b1000000a\"" }
+func (b *testBinary) Reader() (io.ReadCloser, error) {
+	return readSeekCloser{bytes.NewReader(b.data)}, nil
+}
+
+type readSeekCloser struct {
+	*bytes.Reader
+}
+
+func (readSeekCloser) Close() error { return nil }
+
+func TestResponseBinary(t *testing.T) {
+	h := &HTTPHandler{}
+	b := &testBinary{data: []byte("\x89PNG\r\n\x1a\n")}
+	req, err := http.NewRequest("GET", "http://localhost/img/513063ef69ca944b1000000a.png", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	h.responseBinary(w, req, 200, b, time.Now())
+	if w.Code != 200 || !bytes.Equal(w.Body.Bytes(), b.data) {
+		t.Fatalf("want 200 with image bytes, got %d %q", w.Code, w.Body.Bytes())
+	}
+	want := map[string]string{
+		"Content-Type":   "image/png",
+		"Content-Length": strconv.Itoa(len(b.data)),
+		"Cache-Control":  "public, max-age=31536000",
+		"Etag":           b.Etag(),
+	}
+	for k, v := range want {
+		if got := w.Header().Get(k); got != v {
+			t.Errorf("want %s %q, got %q", k, v, got)
+		}
+	}
+	req.Header.Set("If-None-Match", b.Etag())
+	w = httptest.NewRecorder()
+	h.responseBinary(w, req, 200, b, time.Now())
+	if w.Code != 304 || w.Body.Len() != 0 {
+		t.Errorf("want 304 without body, got %d", w.Code)
+	}
+}
+func TestResponseBinaryRange(t *testing.T) {
+	h := &HTTPHandler{}
+	b := &testBinary{data: make([]byte, 300)}
+	for i := range b.data {
+		b.data[i] = byte(i)
+	}
+	req, err := http.NewRequest("GET", "http://localhost/img/513063ef69ca944b1000000a.png", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Range", "bytes=0-99")
+	w := httptest.NewRecorder()
+	h.responseBinary(w, req, 200, b, time.Now())
+	if w.Code != 206 {
+		t.Fatalf("want 206, got %d", w.Code)
+	}
+	if !bytes.Equal(w.Body.Bytes(), b.data[0:100]) {
+		t.Errorf("want bytes 0-99, got %v", w.Body.Bytes())
+	}
+	if cr := w.Header().Get("Content-Range"); cr != "bytes 0-99/300" {
+		t.Errorf("want Content-Range 'bytes 0-99/300', got %q", cr)
+	}
+	if cl := w.Header().Get("Content-Length"); cl != "100" {
+		t.Errorf("want Content-Length 100, got %q", cl)
+	}
+	for _, c := range []struct {
+		data []byte
+		rng  string
+		code int
+		crng string
+		clen string
+	}{
+		{make([]byte, 300), "bytes=300-", 416, "bytes */300", "0"},
+		{make([]byte, 300), "bytes=-0", 416, "bytes */300", "0"},
+		{make([]byte, 300), "bytes=x-1", 200, "", "300"},
+		{nil, "bytes=-10", 416, "bytes */0", "0"},
+		{nil, "bytes=0-", 416, "bytes */0", "0"},
+	} {
+		req.Header.Set("Range", c.rng)
+		w := httptest.NewRecorder()
+		h.responseBinary(w, req, 200, &testBinary{data: c.data}, time.Now())
+		if w.Code != c.code {
+			t.Errorf("%s of %d bytes: want %d, got %d", c.rng, len(c.data), c.code, w.Code)
+		}
+		if cr := w.Header().Get("Content-Range"); cr != c.crng {
+			t.Errorf("%s of %d bytes: want Content-Range %q, got %q", c.rng, len(c.data), c.crng, cr)
+		}
+		if cl := w.Header().Get("Content-Length"); cl != c.clen {
+			t.Errorf("%s of %d bytes: want Content-Length %s, got %q", c.rng, len(c.data), c.clen, cl)
+		}
+	}
+}
+func TestCheckSigned(t *testing.T) {
+	h := &HTTPHandler{SignSecret: []byte("secret")}
+	resId := mogogo.NewResId("img", "513063ef69ca944b1000000a.png")
+	resId.Params["size"] = "s"
+	valid := SignResId(resId, h.SignSecret, time.Now().Add(time.Hour)).String()
+	expired := SignResId(resId, h.SignSecret, time.Now().Add(-time.Hour)).String()
+	tampered := strings.Replace(valid, "size=s", "size=l", 1)
+	tests := []struct {
+		method string
+		url    string
+		signed bool
+		code   mogogo.ErrorCode
+	}{
+		{"GET", valid, true, 0},
+		{"HEAD", valid, true, 0},
+		{"DELETE", valid, false, mogogo.Forbidden},
+		{"PUT", valid, false, mogogo.Forbidden},
+		{"GET", expired, false, mogogo.Forbidden},
+		{"GET", tampered, false, mogogo.Forbidden},
+		{"GET", resId.String(), false, 0},
+	}
+	for _, test := range tests {
+		req, err := http.NewRequest(test.method, "http://localhost"+test.url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		signed, err := h.checkSigned(req)
+		if signed != test.signed {
+			t.Errorf("%s: want signed %v, got %v", test.url, test.signed, signed)
+		}
+		if test.code == 0 && err != nil {
+			t.Errorf("%s: unexpected error %v", test.url, err)
+		} else if e, ok := err.(*mogogo.Error); test.code != 0 && (!ok || e.Code != test.code) {
+			t.Errorf("%s: want error %d, got %v", test.url, test.code, err)
+		}
+		if signed && req.URL.RawQuery != "size=s" {
+			t.Errorf("%s: want exp and sig stripped, got %q", test.url, req.URL.RawQuery)
+		}
+	}
+}
+
+type testAPIKeyHandler map[string]*APIKey
+
+func (m testAPIKeyHandler) APIKey(key string) (*APIKey, bool) {
+	k, ok := m[key]
+	return k, ok
+}
+
+func TestCheckAPIKey(t *testing.T) {
+	h := &HTTPHandler{APIKeyHandler: testAPIKeyHandler{
+		"key1": {Principal: "service1", Sys: true},
+		"key2": {Principal: "service2", Secret: []byte("secret")},
+	}}
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	stale := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+	newReq := func(key, sig, ts, body string) *http.Request {
+		req, err := http.NewRequest("PUT", "http://localhost/ss/1", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-Api-Key", key)
+		req.Header.Set("X-Api-Timestamp", ts)
+		if sig != "" {
+			req.Header.Set("X-Api-Signature", sig)
+		}
+		return req
+	}
+	sign := func(ts string) string {
+		req := newReq("key2", "", ts, `{"s1":"a"}`)
+		sig, err := requestSignature(req, []byte("secret"), defaultMaxSignedBody)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sig
+	}
+	goodReq := newReq("key2", sign(now), now, `{"s1":"a"}`)
+	tests := []struct {
+		req       *http.Request
+		principal interface{}
+		code      mogogo.ErrorCode
+	}{
+		{newReq("key1", "", "", ""), "service1", 0},
+		{goodReq, "service2", 0},
+		{newReq("key2", "bad", now, `{"s1":"a"}`), nil, mogogo.Unauthorized},
+		{newReq("key2", sign(now), now, `{"s1":"b"}`), nil, mogogo.Unauthorized},
+		{newReq("key2", sign(stale), stale, `{"s1":"a"}`), nil, mogogo.Unauthorized},
+		{newReq("key2", sign(now), "", `{"s1":"a"}`), nil, mogogo.Unauthorized},
+		{newReq("nokey", "", "", ""), nil, mogogo.Unauthorized},
+		{newReq("", "", "", ""), nil, 0},
+	}
+	for i, test := range tests {
+		apiKey, err := h.checkAPIKey(test.req)
+		if test.code != 0 {
+			if e, ok := err.(*mogogo.Error); !ok || e.Code != test.code {
+				t.Errorf("%d: want error %d, got %v", i, test.code, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%d: unexpected error %v", i, err)
+		} else if test.principal == nil && apiKey != nil {
+			t.Errorf("%d: want no api key, got %v", i, apiKey)
+		} else if test.principal != nil && (apiKey == nil || apiKey.Principal != test.principal) {
+			t.Errorf("%d: want principal %v, got %v", i, test.principal, apiKey)
+		}
+	}
+	if b, _ := ioutil.ReadAll(goodReq.Body); string(b) != `{"s1":"a"}` {
+		t.Errorf("want the body put back, got %q", b)
+	}
+	h.MaxSignedBody = 4
+	_, err := h.checkAPIKey(newReq("key2", sign(now), now, `{"s1":"a"}`))
+	if e, ok := err.(*mogogo.Error); !ok || e.Code != mogogo.RequestEntityTooLarge {
+		t.Errorf("want a body over MaxSignedBody refused with 413, got %v", err)
+	}
+}
+
+func TestCanonical(t *testing.T) {
+	served := 0
+	h := Canonical(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		served++
+	}))
+	for _, c := range []struct {
+		method, url, location, sig string
+	}{
+		{"GET", "http://localhost/ss?n=10&c=0", "/ss?c=0&n=10", ""},
+		{"GET", "http://localhost/ss?c=0&n=10", "", ""},
+		{"HEAD", "http://localhost/ss?q=a%20b", "/ss?q=a+b", ""},
+		{"POST", "http://localhost/ss?n=10&c=0", "", ""},
+		{"PATCH", "http://localhost/ss?n=10&c=0", "", ""},
+		{"GET", "http://localhost/ss?n=10&c=0", "", "sig"},
+		{"GET", "http://localhost/img/1?size=s&exp=1&sig=x", "", ""},
+		{"GET", "http://localhost/ss?t=b&t=a", "", ""},
+	} {
+		req, err := http.NewRequest(c.method, c.url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.sig != "" {
+			req.Header.Set("X-Api-Signature", c.sig)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if c.location == "" && w.Code != 200 {
+			t.Errorf("%s %s: want served, got %d", c.method, c.url, w.Code)
+		} else if c.location != "" && (w.Code != 307 || w.Header().Get("Location") != c.location) {
+			t.Errorf("%s %s: want 307 to %s, got %d %s", c.method, c.url, c.location, w.Code, w.Header().Get("Location"))
+		}
+	}
+	if served != 6 {
+		t.Errorf("want 6 requests served, got %d", served)
+	}
+}
+
+func TestResponseMultiStatus(t *testing.T) {
+	h := &HTTPHandler{}
+	req, err := http.NewRequest("PUT", "http://localhost/test-sync", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sr := &mogogo.SyncResult{Inserted: 2, Conflicts: []int{1}, Items: []mogogo.ItemStatus{
+		{Status: 201},
+		{Status: 409, Err: &mogogo.Error{Code: mogogo.Conflict}},
+		{Status: 201},
+	}}
+	status, resp := h.responseBody(nil, req, nil, sr, testRes{}, nil, true)
+	items := resp.(map[string]interface{})["items"].([]interface{})
+	if status != mogogo.MultiStatus || len(items) != 3 {
+		t.Fatalf("want 207 with 3 items, got %d %v", status, resp)
+	}
+	for i, want := range []int{201, 409, 201} {
+		if got := items[i].(map[string]interface{})["statusCode"]; got != want {
+			t.Errorf("item %d: want %d, got %v", i, want, got)
+		}
+	}
+	sr.Items[1] = mogogo.ItemStatus{Status: 200}
+	if status, _ = h.responseBody(nil, req, nil, sr, testRes{}, nil, true); status != 200 {
+		t.Errorf("want 200 when every item succeeds, got %d", status)
+	}
+}
+
+func TestResponseRetryAfter(t *testing.T) {
+	h := &HTTPHandler{}
+	req, err := http.NewRequest("GET", "http://localhost/ss", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	h.responseError(w, req, &mogogo.Error{Code: mogogo.TooManyRequests, RetryAfter: 1500 * time.Millisecond}, "", time.Now())
+	if w.Code != 429 || w.Header().Get("Retry-After") != "2" {
+		t.Errorf("want 429 with Retry-After 2, got %d %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	w = httptest.NewRecorder()
+	h.responseError(w, req, &mogogo.Error{Code: mogogo.ServiceUnavailable}, "", time.Now())
+	if w.Code != 503 || w.Header().Get("Retry-After") != "" {
+		t.Errorf("want 503 without Retry-After, got %d %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	w = httptest.NewRecorder()
+	h.responseJSON(w, req, 200, map[string]interface{}{"retryAfter": 5}, time.Now())
+	if w.Header().Get("Retry-After") != "" {
+		t.Errorf("want no Retry-After from a body key, got %q", w.Header().Get("Retry-After"))
+	}
+	header := http.Header{}
+	h.errToMap(header, &mogogo.Error{Code: mogogo.ServiceUnavailable, RetryAfter: time.Minute})
+	if header.Get("Retry-After") != "60" {
+		t.Errorf("want Retry-After 60, got %q", header.Get("Retry-After"))
+	}
+}
@@ -1,11 +1,22 @@
 package net
 
 import (
+	"bytes"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base32"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
 	"hash/crc64"
 	"io"
+	"io/ioutil"
+	"mogogo"
+	"net/http"
 	"strconv"
+	"strings"
+	"time"
 )
 
 var crc64Table = crc64.MakeTable(crc64.ISO)
@@ -19,10 +30,136 @@ func randId() string {
 	b := make([]byte, n)
 	n, err := io.ReadFull(rand.Reader, b)
 	if n != len(b) {
-		panic("random bytes not enough")
+		panic(&mogogo.Bug{Msg: "random bytes not enough"})
 	}
 	if err != nil {
 		panic(err)
 	}
 	return base32.HexEncoding.EncodeToString(b)
 }
+
+// parseRange answers a single byte range header against size bytes:
+// 206 with the range, 416 when it selects nothing, 200 when the
+// header is absent or malformed and the whole body is sent.
+func parseRange(s string, size int64) (start, end int64, status int) {
+	if !strings.HasPrefix(s, "bytes=") || strings.Contains(s, ",") {
+		return 0, 0, 200
+	}
+	se := strings.SplitN(strings.TrimPrefix(s, "bytes="), "-", 2)
+	if len(se) != 2 {
+		return 0, 0, 200
+	}
+	var err error
+	if se[0] == "" {
+		n, err := strconv.ParseInt(se[1], 10, 64)
+		if err != nil || n < 0 {
+			return 0, 0, 200
+		}
+		if n == 0 || size == 0 {
+			return 0, 0, 416
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, size - 1, 206
+	}
+	start, err = strconv.ParseInt(se[0], 10, 64)
+	if err != nil || start < 0 {
+		return 0, 0, 200
+	}
+	if se[1] != "" {
+		end, err = strconv.ParseInt(se[1], 10, 64)
+		if err != nil || end < start {
+			return 0, 0, 200
+		}
+	}
+	if start >= size {
+		return 0, 0, 416
+	}
+	if se[1] == "" || end >= size {
+		end = size - 1
+	}
+	return start, end, 206
+}
+
+const (
+	signExpParam = "exp"
+	signSigParam = "sig"
+)
+
+func signature(resId *mogogo.ResId, secret []byte) string {
+	params := make(mogogo.Params)
+	for k, v := range resId.Params {
+		if k != signSigParam {
+			params[k] = v
+		}
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(resId.URL().Path + "?" + params.Encode()))
+	return base64.URLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// apiSkew is how far an api request's timestamp may be from the clock.
+const apiSkew = 5 * time.Minute
+
+// defaultMaxSignedBody caps the body read to check an api signature when
+// HTTPHandler.MaxSignedBody is zero.
+const defaultMaxSignedBody = 1 << 20
+
+// requestSignature signs the method, the URI, the timestamp header and a
+// SHA-256 of the body, which it reads, up to max bytes, and puts back.
+func requestSignature(req *http.Request, secret []byte, max int64) (string, error) {
+	sum := sha256.New()
+	if req.Body != nil {
+		b, err := ioutil.ReadAll(io.LimitReader(req.Body, max+1))
+		req.Body.Close()
+		if err != nil {
+			return "", &mogogo.Error{Code: mogogo.BadRequest, Msg: "read request body", Err: err}
+		}
+		if int64(len(b)) > max {
+			return "", &mogogo.Error{
+				Code: mogogo.RequestEntityTooLarge,
+				Msg:  fmt.Sprintf("signed body exceeds %d bytes", max),
+			}
+		}
+		sum.Write(b)
+		req.Body = ioutil.NopCloser(bytes.NewReader(b))
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(req.Method + " " + req.URL.RequestURI() + "\n"))
+	mac.Write([]byte(req.Header.Get(apiTimestampHeader) + "\n"))
+	mac.Write([]byte(hex.EncodeToString(sum.Sum(nil))))
+	return base64.URLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+func checkTimestamp(ts string, now time.Time) error {
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return &mogogo.Error{Code: mogogo.Unauthorized, Msg: "invalid api timestamp", Err: err}
+	}
+	if d := now.Sub(time.Unix(unix, 0)); d > apiSkew || d < -apiSkew {
+		return &mogogo.Error{Code: mogogo.Unauthorized, Msg: "api timestamp out of range"}
+	}
+	return nil
+}
+
+// SignResId signs resId for GET and HEAD requests until expires.
+func SignResId(resId *mogogo.ResId, secret []byte, expires time.Time) *mogogo.ResId {
+	ret := resId.Copy()
+	ret.Params[signExpParam] = strconv.FormatInt(expires.Unix(), 10)
+	ret.Params[signSigParam] = signature(ret, secret)
+	return ret
+}
+func verifySigned(resId *mogogo.ResId, secret []byte, now time.Time) error {
+	sig := resId.Params[signSigParam]
+	if !hmac.Equal([]byte(sig), []byte(signature(resId, secret))) {
+		return &mogogo.Error{Code: mogogo.Forbidden, Msg: "invalid signature"}
+	}
+	exp, err := strconv.ParseInt(resId.Params[signExpParam], 10, 64)
+	if err != nil {
+		return &mogogo.Error{Code: mogogo.Forbidden, Msg: "invalid signature", Err: err}
+	}
+	if now.Unix() > exp {
+		return &mogogo.Error{Code: mogogo.Forbidden, Msg: "signature expired"}
+	}
+	return nil
+}
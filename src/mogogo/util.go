@@ -1,17 +1,21 @@
 package mogogo
 
 import (
+	"encoding/base64"
 	"encoding/hex"
 	"fmt"
 	"labix.org/v2/mgo/bson"
+	"reflect"
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 	"unicode"
 )
 
 var (
 	queryNameRegexp *regexp.Regexp
+	slugRegexp      = regexp.MustCompile("^([a-z0-9]+-)*[a-z0-9]+$")
 )
 
 func init() {
@@ -26,9 +30,12 @@ func isQueryName(s string) bool {
 	return queryNameRegexp.Match([]byte(s))
 }
 
+func isSlug(s string) bool {
+	return slugRegexp.MatchString(s)
+}
 func checkQueryName(s string) {
 	if !isQueryName(s) {
-		panic(fmt.Sprintf("'%s' not a valid query name", s))
+		panic(bugf("'%s' not a valid query name", s))
 	}
 }
 func typeNameToQueryName(typ string) string {
@@ -53,10 +60,28 @@ func indexOf(sa []string, s string) (index int, ok bool) {
 	}
 	return -1, false
 }
-func parseObjectId(h string) (id bson.ObjectId, err error) {
-	d, err := hex.DecodeString(h)
+
+// hasTag reports whether the comma separated `mogogo` tag of sf has opt.
+func hasTag(sf reflect.StructField, opt string) bool {
+	_, ok := indexOf(strings.Split(sf.Tag.Get("mogogo"), ","), opt)
+	return ok
+}
+func tagName(sf reflect.StructField, key string) string {
+	name := strings.Split(sf.Tag.Get(key), ",")[0]
+	if name == "-" {
+		return ""
+	}
+	return name
+}
+func parseObjectId(s string) (id bson.ObjectId, err error) {
+	var d []byte
+	if len(s) == 16 {
+		d, err = base64.URLEncoding.DecodeString(s)
+	} else {
+		d, err = hex.DecodeString(s)
+	}
 	if err != nil || len(d) != 12 {
-		return bson.ObjectId(""), fmt.Errorf("id format error: %s", h)
+		return bson.ObjectId(""), fmt.Errorf("id format error: %s", s)
 	}
 	return bson.ObjectId(d), nil
 }
@@ -105,6 +130,16 @@ func parseParamFloat(m Params, key string, def float64) (ret float64, err error)
 	}
 	return
 }
+func parseParamTime(m Params, key string) (ret time.Time, err error) {
+	if v, ok := m[key]; ok {
+		ret, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			msg := fmt.Sprintf("param '%s' parse error, want RFC 3339 time, got '%s'", key, v)
+			ret, err = time.Time{}, &Error{Code: BadRequest, Msg: msg, Err: err}
+		}
+	}
+	return
+}
 func parseParamObjectId(m Params, key string) (ret bson.ObjectId, found bool, err error) {
 	if v, ok := m[key]; ok {
 		ret, err = parseObjectId(v)
@@ -119,6 +154,41 @@ func parseParamObjectId(m Params, key string) (ret bson.ObjectId, found bool, er
 	}
 	return
 }
+
+// PrefixMatch returns a case-insensitive selector matching values that start
+// with s literally, e.g. M{"Name": PrefixMatch(req.Params["q"])} in a SelectorFunc.
+func PrefixMatch(s string) M {
+	return M{"$regex": "^" + regexp.QuoteMeta(s), "$options": "i"}
+}
+
+// Exists returns a selector matching documents where the Go field is (or is
+// not) stored; nil pointers are omitted from documents, so Exists("Ptr", false)
+// selects those left unset. The key is resolved like any other selector field.
+func Exists(field string, exists bool) M {
+	return M{field: M{"$exists": exists}}
+}
+
+// CreatedBetween returns a selector matching documents created in
+// [from, to), read from the timestamp in their ids; a zero time leaves that
+// end open.
+func CreatedBetween(from, to time.Time) M {
+	r := idRange(from, to)
+	if len(r) == 0 {
+		return M{}
+	}
+	return M{"Id": r}
+}
+func idRange(from, to time.Time) M {
+	r := M{}
+	if !from.IsZero() {
+		r["$gte"] = bson.NewObjectIdWithTime(from)
+	}
+	if !to.IsZero() {
+		r["$lt"] = bson.NewObjectIdWithTime(to)
+	}
+	return r
+}
+
 func accMapMap(m map[string]interface{}, key0, key1 string, val interface{}) {
 	mv, ok := m[key0]
 	var m1 map[string]interface{}
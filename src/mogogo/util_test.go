@@ -2,6 +2,7 @@ package mogogo
 
 import (
 	"fmt"
+	"regexp"
 	"testing"
 )
 
@@ -63,3 +64,13 @@ func ExampleCheckQueryName() {
 	checkQueryName("aa-")
 	//Output:'aa-' not a valid query name
 }
+func TestPrefixMatch(t *testing.T) {
+	m := PrefixMatch("a.b*(c")
+	re := regexp.MustCompile("(?" + m["$options"].(string) + ")" + m["$regex"].(string))
+	if !re.MatchString("A.B*(cdef") {
+		t.Error("want match literally")
+	}
+	if re.MatchString("aXbb(c") || re.MatchString("xa.b*(c") {
+		t.Error("metacharacters not escaped")
+	}
+}